@@ -41,6 +41,14 @@ func BuildApi(cmd *cobra.Command, q *queue.UploadQueue, router *httprouter.Route
 		data.DumpFids(w, archivedb)
 	})
 
+	router.GET("/api/data/contracts", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		data.DumpContracts(w, archivedb)
+	})
+
+	router.GET("/api/data/contracts/:cid", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		data.ShowContract(w, archivedb, ps.ByName("cid"))
+	})
+
 	// NETWORK
 	router.GET("/api/network/deals", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		network.ShowDeals(cmd, w, r, ps)
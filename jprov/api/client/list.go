@@ -6,7 +6,7 @@ import (
 	"net/http"
 	"os"
 
-	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
 	"github.com/cosmos/cosmos-sdk/client"
 	sdk "github.com/cosmos/cosmos-sdk/types"
 
@@ -36,7 +36,7 @@ func ListQueue(cmd *cobra.Command, w http.ResponseWriter, r *http.Request, ps ht
 func ListFiles(cmd *cobra.Command, w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	clientCtx := client.GetClientContextFromCmd(cmd)
 
-	files, err := os.ReadDir(utils.GetFidDir(clientCtx.HomeDir, ps.ByName("file")))
+	files, err := os.ReadDir(archive.FindFileDir(clientCtx.HomeDir, ps.ByName("file")))
 	if err != nil {
 		fmt.Println(err)
 	}
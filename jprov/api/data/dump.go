@@ -2,6 +2,7 @@ package data
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -79,3 +80,44 @@ func DumpFids(w http.ResponseWriter, db archive.ArchiveDB) {
 		fmt.Println(err)
 	}
 }
+
+func DumpContracts(w http.ResponseWriter, db archive.ArchiveDB) {
+	data := make([]archive.ContractMetadata, 0)
+	iter := db.NewIterator()
+	defer iter.Release()
+
+	for iter.Next() {
+		meta, err := db.GetMetadata(string(iter.Key()))
+		if err != nil {
+			fmt.Printf("Error: DumpContracts(): %s", err.Error())
+			continue
+		}
+		data = append(data, meta)
+	}
+
+	v := types.ContractsResponse{
+		Data: data,
+	}
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func ShowContract(w http.ResponseWriter, db archive.ArchiveDB, cid string) {
+	meta, err := db.GetMetadata(cid)
+	if errors.Is(err, archive.ErrContractNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(meta)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	storagetypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
 )
@@ -40,6 +41,10 @@ type FidResponse struct {
 	Data []FidBlock `json:"data"`
 }
 
+type ContractsResponse struct {
+	Data []archive.ContractMetadata `json:"data"`
+}
+
 type DealsResponse struct {
 	Deals []storagetypes.LegacyActiveDeals `json:"deals"`
 }
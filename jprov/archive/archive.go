@@ -8,7 +8,6 @@ import (
 	"path/filepath"
 
 	merkletree "github.com/wealdtech/go-merkletree"
-	"github.com/wealdtech/go-merkletree/sha3"
 )
 
 const FilePerm os.FileMode = 0o666
@@ -32,30 +31,178 @@ type Archive interface {
 	// RetrieveTree returns *merkletree
 	// Returns error if the tree is not found
 	RetrieveTree(fid string) (tree *merkletree.MerkleTree, err error)
+	// WriteTreeData stores an encoded merkle tree as it is
+	WriteTreeData(fid string, data []byte) error
+	// RetrieveTreeData returns the merkle tree the way it was stored
+	// Returns error if the tree is not found
+	RetrieveTreeData(fid string) (data []byte, err error)
 	// Delete deletes archive from disk. This include the file and merkle tree.
 	Delete(fid string) error
+	// StageFile writes data to a temporary file inside the archive before its fid is known.
+	// The staged file is not visible to the archive until it is committed.
+	// Returns the name of the staged file and bytes written.
+	StageFile(data io.Reader) (stage string, written int64, err error)
+	// CommitFile atomically moves a staged file to the location of fid.
+	CommitFile(stage string, fid string) error
+	// DiscardFile removes a staged file that will not be committed.
+	DiscardFile(stage string) error
 }
 
 var _ Archive = &SingleCellArchive{}
 
 var _ Archive = &HybridCellArchive{}
 
+const stagingDir = "staging"
+
+// stageFile copies data into a new temporary file under dir.
+// The data is synced to disk before returning so a commit can't expose a partial file.
+func stageFile(dir string, data io.Reader) (stage string, written int64, err error) {
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	file, err := os.CreateTemp(dir, "*.jkl")
+	if err != nil {
+		return
+	}
+	stage = file.Name()
+	defer func() {
+		err = errors.Join(err, file.Close())
+		if err != nil {
+			err = errors.Join(err, os.Remove(stage))
+			stage = ""
+		}
+	}()
+
+	written, err = io.Copy(file, data)
+	if err != nil {
+		return
+	}
+
+	err = file.Sync()
+	return
+}
+
+// commitFile renames a staged file to path. Both must be on the same file system.
+func commitFile(stage, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(stage, path)
+}
+
+// writeTreeFile writes an encoded merkle tree to path. The tree is written
+// next to path first so an existing tree is never left half overwritten.
+func writeTreeFile(path string, data []byte) (err error) {
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "*.tree.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, os.Remove(file.Name()))
+		}
+	}()
+
+	_, err = file.Write(data)
+	err = errors.Join(err, file.Close())
+	if err != nil {
+		return
+	}
+	err = os.Chmod(file.Name(), FilePerm)
+	if err != nil {
+		return
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// writeTree encodes tree and stores it with a.
+func writeTree(a Archive, fid string, tree *merkletree.MerkleTree) error {
+	data, err := EncodeTree(tree)
+	if err != nil {
+		return err
+	}
+	return a.WriteTreeData(fid, data)
+}
+
+// retrieveTree decodes the merkle tree of fid stored in a.
+func retrieveTree(a Archive, fid string) (*merkletree.MerkleTree, error) {
+	data, err := a.RetrieveTreeData(fid)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeTree(data)
+}
+
+// ConvertTree rewrites the merkle tree of fid in the binary format if it is
+// still stored as JSON.
+func ConvertTree(a Archive, fid string) (converted bool, err error) {
+	data, err := a.RetrieveTreeData(fid)
+	if err != nil || IsBinaryTree(data) {
+		return false, err
+	}
+
+	tree, err := DecodeTree(data)
+	if err != nil {
+		return false, err
+	}
+	return true, writeTree(a, fid, tree)
+}
+
+// HybridCellArchive stores new files in the sharded layout and reads files
+// from every layout a provider might still have on disk: the sharded layout,
+// the flat layout of SingleCellArchive and the legacy multi cell layout.
 type HybridCellArchive struct {
 	rootDir           string
-	pathFactory       *SingleCellPathFactory
+	pathFactory       *ShardedPathFactory
+	flatPathFactory   *SingleCellPathFactory
 	legacyPathFactory *MultiCellPathFactory
 }
 
 func NewHybridCellArchive(rootDir string) *HybridCellArchive {
 	return &HybridCellArchive{
 		rootDir:           rootDir,
-		pathFactory:       NewSingleCellPathFactory(rootDir),
+		pathFactory:       NewShardedPathFactory(rootDir),
+		flatPathFactory:   NewSingleCellPathFactory(rootDir),
 		legacyPathFactory: NewMultiCellPathFactory(rootDir),
 	}
 }
 
-func (f *HybridCellArchive) WriteFileToDisk(data io.Reader, fid string) (written int64, err error) {
-	path := f.pathFactory.FilePath(fid)
+// writePathFactory returns the layout new data of fid goes to. Files that are
+// still in the flat layout are completed there and migrated as a whole.
+func (h *HybridCellArchive) writePathFactory(fid string) pathFactory {
+	_, err := os.Stat(h.flatPathFactory.FileDir(fid))
+	if err == nil {
+		return h.flatPathFactory
+	}
+	return h.pathFactory
+}
+
+// open opens the file at sharded and falls back to flat for files that were
+// not migrated yet.
+func (h *HybridCellArchive) open(sharded, flat string) (*os.File, error) {
+	file, err := os.Open(sharded)
+	if !errors.Is(err, os.ErrNotExist) {
+		return file, err
+	}
+	file, err = os.Open(flat)
+	if !errors.Is(err, os.ErrNotExist) {
+		return file, err
+	}
+	// the file could have been migrated after the first attempt
+	return os.Open(sharded)
+}
+
+func (h *HybridCellArchive) WriteFileToDisk(data io.Reader, fid string) (written int64, err error) {
+	path := h.writePathFactory(fid).FilePath(fid)
 	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
 	if err != nil {
 		return
@@ -96,7 +243,7 @@ func (h *HybridCellArchive) GetPiece(fid string, index, blockSize int64) (block
 		return nil, err
 	}
 
-	file, err = os.Open(h.pathFactory.FilePath(fid))
+	file, err = h.open(h.pathFactory.FilePath(fid), h.flatPathFactory.FilePath(fid))
 	if err != nil {
 		return nil, err
 	}
@@ -116,76 +263,78 @@ func (h *HybridCellArchive) GetPiece(fid string, index, blockSize int64) (block
 }
 
 func (h *HybridCellArchive) RetrieveFile(fid string) (data io.ReadSeekCloser, err error) {
-	data, err = os.Open(h.pathFactory.FilePath(fid))
-	return
+	return h.open(h.pathFactory.FilePath(fid), h.flatPathFactory.FilePath(fid))
 }
 
 func (h *HybridCellArchive) FileExist(fid string) bool {
-	_, err := os.Stat(h.pathFactory.FilePath(fid))
-	return errors.Is(err, os.ErrNotExist)
-}
-
-func (h *HybridCellArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) (err error) {
-	path := h.pathFactory.TreePath(fid)
-	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	if err != nil {
-		return
-	}
-
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, FilePerm)
-	if err != nil {
-		return
-	}
-	defer func() {
-		err = errors.Join(err, file.Close())
-	}()
-
-	data, err := tree.Export()
+	file, err := h.open(h.pathFactory.FilePath(fid), h.flatPathFactory.FilePath(fid))
 	if err != nil {
-		return
+		return errors.Is(err, os.ErrNotExist)
 	}
+	_ = file.Close()
+	return false
+}
 
-	_, err = file.Write(data)
-	return
+func (h *HybridCellArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) error {
+	return writeTree(h, fid, tree)
 }
 
-func (h *HybridCellArchive) retrieveLegacyTree(fid string) (*merkletree.MerkleTree, error) {
-	rawTree, err := os.ReadFile(h.legacyPathFactory.TreePath(fid))
+func (h *HybridCellArchive) WriteTreeData(fid string, data []byte) error {
+	err := writeTreeFile(h.writePathFactory(fid).TreePath(fid), data)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	tree, err := merkletree.ImportMerkleTree(rawTree, sha3.New512())
-	return tree, err
+	// the legacy tree would still be read first
+	err = os.Remove(h.legacyPathFactory.TreePath(fid))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
 }
 
 func (h *HybridCellArchive) RetrieveTree(fid string) (tree *merkletree.MerkleTree, err error) {
-	tree, err = h.retrieveLegacyTree(fid) // attempt to get legacy
+	return retrieveTree(h, fid)
+}
+
+func (h *HybridCellArchive) RetrieveTreeData(fid string) (data []byte, err error) {
+	data, err = os.ReadFile(h.legacyPathFactory.TreePath(fid)) // attempt to get legacy
 	if err == nil {
-		return tree, nil
+		return data, nil
 	} else if !os.IsNotExist(err) {
 		return nil, err
 	}
 
-	rawTree, err := os.ReadFile(h.pathFactory.TreePath(fid))
+	file, err := h.open(h.pathFactory.TreePath(fid), h.flatPathFactory.TreePath(fid))
 	if err != nil {
 		return
 	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
 
-	tree, err = merkletree.ImportMerkleTree(rawTree, sha3.New512())
-	return
+	return io.ReadAll(file)
 }
 
 func (h *HybridCellArchive) Delete(fid string) error {
 	// since the file and merkle tree is saved together in an isolated directory,
-	// just delete the whole directory
-	err := os.RemoveAll(h.pathFactory.FileDir(fid))
-	if err != nil {
-		// filePath factory might be broken
-		// read os.RemoveAll error conditions at std doc
-		return err
-	}
-	return nil
+	// just delete the whole directory in every layout
+	return errors.Join(
+		os.RemoveAll(h.pathFactory.FileDir(fid)),
+		os.RemoveAll(h.flatPathFactory.FileDir(fid)),
+	)
+}
+
+func (h *HybridCellArchive) StageFile(data io.Reader) (stage string, written int64, err error) {
+	return stageFile(filepath.Join(h.rootDir, stagingDir), data)
+}
+
+func (h *HybridCellArchive) CommitFile(stage string, fid string) error {
+	return commitFile(stage, h.writePathFactory(fid).FilePath(fid))
+}
+
+func (h *HybridCellArchive) DiscardFile(stage string) error {
+	return os.Remove(stage)
 }
 
 type SingleCellArchive struct {
@@ -249,38 +398,20 @@ func (f *SingleCellArchive) FileExist(fid string) bool {
 	return errors.Is(err, os.ErrNotExist)
 }
 
-func (f *SingleCellArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) (err error) {
-	path := f.pathFactory.TreePath(fid)
-	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	if err != nil {
-		return
-	}
-
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, FilePerm)
-	if err != nil {
-		return
-	}
-	defer func() {
-		err = errors.Join(err, file.Close())
-	}()
-
-	data, err := tree.Export()
-	if err != nil {
-		return
-	}
+func (f *SingleCellArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) error {
+	return writeTree(f, fid, tree)
+}
 
-	_, err = file.Write(data)
-	return
+func (f *SingleCellArchive) WriteTreeData(fid string, data []byte) error {
+	return writeTreeFile(f.pathFactory.TreePath(fid), data)
 }
 
 func (f *SingleCellArchive) RetrieveTree(fid string) (tree *merkletree.MerkleTree, err error) {
-	rawTree, err := os.ReadFile(f.pathFactory.TreePath(fid))
-	if err != nil {
-		return
-	}
+	return retrieveTree(f, fid)
+}
 
-	tree, err = merkletree.ImportMerkleTree(rawTree, sha3.New512())
-	return
+func (f *SingleCellArchive) RetrieveTreeData(fid string) (data []byte, err error) {
+	return os.ReadFile(f.pathFactory.TreePath(fid))
 }
 
 func (f *SingleCellArchive) Delete(fid string) error {
@@ -288,3 +419,15 @@ func (f *SingleCellArchive) Delete(fid string) error {
 	// just delete the whole directory
 	return os.RemoveAll(f.pathFactory.FileDir(fid))
 }
+
+func (f *SingleCellArchive) StageFile(data io.Reader) (stage string, written int64, err error) {
+	return stageFile(filepath.Join(f.rootDir, stagingDir), data)
+}
+
+func (f *SingleCellArchive) CommitFile(stage string, fid string) error {
+	return commitFile(stage, f.pathFactory.FilePath(fid))
+}
+
+func (f *SingleCellArchive) DiscardFile(stage string) error {
+	return os.Remove(stage)
+}
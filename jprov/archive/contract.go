@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/JackalLabs/jackal-provider/jprov/archive/kv"
 )
 
 type ArchiveDB interface {
@@ -15,158 +17,250 @@ type ArchiveDB interface {
 	GetContracts(fid string) ([]string, error)
 	SetContract(cid string, fid string) error
 	DeleteContract(cid string) (purge bool, err error)
-	NewIterator() iterator.Iterator
+	GetMetadata(cid string) (ContractMetadata, error)
+	UpdateMetadata(cid string, update func(meta *ContractMetadata)) error
+	NewIterator() kv.Iterator
 	Close() error
 }
 
 var _ ArchiveDB = &DoubleRefArchiveDB{}
 
-const cidSeparator = ","
+// The database has separate namespaces for the contracts, the references
+// of every fid to its contracts and the metadata of the contracts:
+//
+//	c/<cid>       -> fid
+//	f/<fid>/<cid> -> (empty)
+//	d/<cid>       -> ContractMetadata as JSON
+//	m/schema      -> version
+//
+// Databases of version 1 kept cid -> fid and fid -> "cid1,cid2," in one
+// keyspace. They are upgraded when they are opened.
+const (
+	archiveDBSchema = 2
+
+	contractPrefix  = "c/"
+	referencePrefix = "f/"
+	metadataPrefix  = "d/"
+	schemaKey       = "m/schema"
+
+	// cidSeparator joins the contracts of a fid in schema 1
+	cidSeparator = ","
+	// upgradeBatchSize is the number of contracts moved in one batch
+	upgradeBatchSize = 10000
+)
+
+var ErrUnknownSchema = errors.New("unknown archive database schema")
 
 type DoubleRefArchiveDB struct {
-	db *leveldb.DB
+	db           kv.Store
+	metadataLock sync.Mutex
 }
 
-func NewDoubleRefArchiveDB(filepath string) (*DoubleRefArchiveDB, error) {
-	db, err := leveldb.OpenFile(filepath, nil)
+// NewDoubleRefArchiveDB opens the database at filepath with backend, see
+// kv.Open.
+func NewDoubleRefArchiveDB(backend string, filepath string) (*DoubleRefArchiveDB, error) {
+	db, err := kv.Open(backend, filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	return &DoubleRefArchiveDB{db: db}, nil
-}
-
-func (d *DoubleRefArchiveDB) GetFid(cid string) (string, error) {
-	value, err := d.db.Get(d.key(cid), nil)
-	if errors.Is(err, leveldb.ErrNotFound) {
-		return "", ErrContractNotFound
-	}
+	d := &DoubleRefArchiveDB{db: db}
+	err = d.upgrade()
 	if err != nil {
-		return "", err
+		return nil, errors.Join(err, db.Close())
 	}
-	return string(value), err
+	return d, nil
 }
 
-func (d *DoubleRefArchiveDB) GetContracts(fid string) ([]string, error) {
-	value, err := d.db.Get([]byte(fid), nil)
+func contractKey(cid string) []byte {
+	return []byte(contractPrefix + cid)
+}
+
+func referencesPrefix(fid string) []byte {
+	return []byte(referencePrefix + fid + "/")
+}
+
+func referenceKey(fid string, cid string) []byte {
+	return append(referencesPrefix(fid), cid...)
+}
+
+func (d *DoubleRefArchiveDB) schema() (int, error) {
+	value, err := d.db.Get([]byte(schemaKey))
+	if errors.Is(err, kv.ErrNotFound) {
+		return 1, nil
+	}
 	if err != nil {
-		return nil, ErrFidNotFound
+		return 0, err
 	}
-	return strings.Split(string(value), cidSeparator), nil
+	return strconv.Atoi(string(value))
 }
 
-func (d *DoubleRefArchiveDB) SetContract(cid string, fid string) error {
-	value, err := d.db.Get([]byte(cid), nil) // check if it already exists
-	if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+// upgrade moves the contracts of a schema 1 database to their namespaces.
+// An upgrade that was interrupted continues where it stopped, contracts
+// that were already moved are skipped.
+func (d *DoubleRefArchiveDB) upgrade() error {
+	schema, err := d.schema()
+	if err != nil {
 		return err
 	}
-	if value != nil {
-		return ErrContractAlreadyExists
+	switch {
+	case schema == archiveDBSchema:
+		return nil
+	case schema > archiveDBSchema:
+		return fmt.Errorf("%w: %d, this version supports up to %d", ErrUnknownSchema, schema, archiveDBSchema)
 	}
 
-	batch := new(leveldb.Batch)
-	batch.Put([]byte(cid), []byte(fid))
-
-	err = d.addReference(batch, cid, fid)
-	if err != nil {
+	batch := new(kv.Batch)
+	iter := d.db.NewIterator(nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := string(iter.Key())
+		if strings.HasPrefix(key, contractPrefix) || strings.HasPrefix(key, referencePrefix) {
+			continue
+		}
+
+		// the reference lists "cid1,cid2," of fids are rebuilt from the contracts
+		value := string(iter.Value())
+		if !strings.Contains(value, cidSeparator) {
+			batch.Put(contractKey(key), []byte(value))
+			batch.Put(referenceKey(value, key), nil)
+		}
+		batch.Delete([]byte(key))
+
+		if batch.Len() >= 3*upgradeBatchSize {
+			err = d.db.Write(batch, false)
+			if err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
 		return err
 	}
-	err = d.db.Write(batch, nil)
-	return err
+
+	batch.Put([]byte(schemaKey), []byte(strconv.Itoa(archiveDBSchema)))
+	return d.db.Write(batch, true)
 }
 
-func (d *DoubleRefArchiveDB) addReference(batch *leveldb.Batch, cid string, fid string) error {
-	value, err := d.db.Get([]byte(fid), nil)
-	if errors.Is(err, leveldb.ErrNotFound) {
-		value = nil
-	} else if err != nil {
-		return err
+func (d *DoubleRefArchiveDB) GetFid(cid string) (string, error) {
+	value, err := d.db.Get(contractKey(cid))
+	if errors.Is(err, kv.ErrNotFound) {
+		return "", ErrContractNotFound
 	}
+	if err != nil {
+		return "", err
+	}
+	return string(value), err
+}
 
-	// reference look like this "potato,tomato,...,onion,"
-	var b strings.Builder
-	_, _ = b.WriteString(string(value))
-	_, _ = b.WriteString(string(cid))
-	_, _ = b.WriteString(cidSeparator)
+func (d *DoubleRefArchiveDB) GetContracts(fid string) ([]string, error) {
+	prefix := referencesPrefix(fid)
+	iter := d.db.NewIterator(prefix)
+	defer iter.Release()
 
-	batch.Put([]byte(fid), []byte(b.String()))
-	return nil
+	cids := make([]string, 0)
+	for iter.Next() {
+		cids = append(cids, string(iter.Key()[len(prefix):]))
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(cids) == 0 {
+		return nil, ErrFidNotFound
+	}
+	return cids, nil
 }
 
-func (d *DoubleRefArchiveDB) DeleteContract(cid string) (purge bool, err error) {
-	batch := new(leveldb.Batch)
-	purge, err = d.deleteReference(batch, cid)
+func (d *DoubleRefArchiveDB) SetContract(cid string, fid string) error {
+	exists, err := d.db.Has(contractKey(cid))
 	if err != nil {
-		return
+		return err
+	}
+	if exists {
+		return ErrContractAlreadyExists
 	}
 
-	batch.Delete([]byte(cid))
-	err = d.db.Write(batch, nil)
-	return
+	batch := new(kv.Batch)
+	batch.Put(contractKey(cid), []byte(fid))
+	batch.Put(referenceKey(fid, cid), nil)
+	return d.db.Write(batch, false)
 }
 
-func (d *DoubleRefArchiveDB) deleteReference(
-	batch *leveldb.Batch,
-	cid string,
-) (purge bool, err error) {
-	purge = false
-	fid, err := d.db.Get([]byte(cid), nil)
+// DeleteContract removes the contract and its metadata, purge is true if it
+// was the last contract of its fid.
+func (d *DoubleRefArchiveDB) DeleteContract(cid string) (purge bool, err error) {
+	// UpdateMetadata must not write the metadata of a deleted contract
+	d.metadataLock.Lock()
+	defer d.metadataLock.Unlock()
+
+	fid, err := d.GetFid(cid)
 	if err != nil {
-		return
+		return false, err
 	}
 
-	cidList, err := d.db.Get(fid, nil)
+	batch := new(kv.Batch)
+	batch.Delete(contractKey(cid))
+	batch.Delete(referenceKey(fid, cid))
+	batch.Delete(metadataKey(cid))
+	err = d.db.Write(batch, false)
 	if err != nil {
-		return
+		return false, err
 	}
 
-	var b strings.Builder
-	b.WriteString(string(cid))
-	b.WriteString(cidSeparator)
-
-	result := strings.Replace(string(cidList), b.String(), "", 1)
-
-	if len(result) == 0 {
-		batch.Delete(fid)
-		purge = true
-	} else {
-		batch.Put(fid, []byte(result))
+	_, err = d.GetContracts(fid)
+	if errors.Is(err, ErrFidNotFound) {
+		return true, nil
 	}
-
-	return
+	return false, err
 }
 
-func (d *DoubleRefArchiveDB) NewIterator() iterator.Iterator {
-	return d.db.NewIterator(nil, nil)
+// NewIterator iterates over all contracts, keys are cids and values fids.
+func (d *DoubleRefArchiveDB) NewIterator() kv.Iterator {
+	return &prefixIterator{
+		Iterator: d.db.NewIterator([]byte(contractPrefix)),
+		prefix:   len(contractPrefix),
+	}
 }
 
 func (d *DoubleRefArchiveDB) Close() error {
 	return d.db.Close()
 }
 
-func (d *DoubleRefArchiveDB) key(cid string) (key []byte) {
-	return []byte(cid)
+// prefixIterator hides the prefix of the keys it iterates over.
+type prefixIterator struct {
+	kv.Iterator
+	prefix int
+}
+
+func (p *prefixIterator) Key() []byte {
+	key := p.Iterator.Key()
+	if key == nil {
+		return nil
+	}
+	return key[p.prefix:]
 }
 
 type DowntimeDB struct {
-	db *leveldb.DB
+	db kv.Store
 }
 
-func NewDowntimeDB(filepath string) (*DowntimeDB, error) {
-	db, err := leveldb.OpenFile(filepath, nil)
+// NewDowntimeDB opens the database at filepath with backend, see kv.Open.
+func NewDowntimeDB(backend string, filepath string) (*DowntimeDB, error) {
+	db, err := kv.Open(backend, filepath)
 	if err != nil {
 		return nil, err
 	}
 	return &DowntimeDB{db: db}, nil
 }
 
-func (d *DowntimeDB) NewIterator() iterator.Iterator {
-	return d.db.NewIterator(nil, nil)
+func (d *DowntimeDB) NewIterator() kv.Iterator {
+	return d.db.NewIterator(nil)
 }
 
 func (d *DowntimeDB) Get(cid string) (block int64, err error) {
-	b, err := d.db.Get([]byte(cid), nil)
-	if errors.Is(err, leveldb.ErrNotFound) {
+	b, err := d.db.Get([]byte(cid))
+	if errors.Is(err, kv.ErrNotFound) {
 		return 0, ErrContractNotFound
 	}
 	if err != nil {
@@ -181,11 +275,11 @@ func (d *DowntimeDB) Set(cid string, block int64) error {
 	if err != nil {
 		return err
 	}
-	return d.db.Put([]byte(cid), b, nil)
+	return d.db.Put([]byte(cid), b)
 }
 
 func (d *DowntimeDB) Delete(cid string) error {
-	return d.db.Delete([]byte(cid), nil)
+	return d.db.Delete([]byte(cid))
 }
 
 func (d *DowntimeDB) Close() error {
@@ -1,14 +1,16 @@
 package archive
 
 import (
+	"errors"
 	"os"
+	"reflect"
 	"testing"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/JackalLabs/jackal-provider/jprov/archive/kv"
 )
 
-func OpenDB(t *testing.T) *leveldb.DB {
-	db, err := leveldb.OpenFile("./testdb", nil)
+func OpenDB(t *testing.T) kv.Store {
+	db, err := kv.Open(kv.LevelDB, "./testdb")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -16,7 +18,7 @@ func OpenDB(t *testing.T) *leveldb.DB {
 	return db
 }
 
-func CleanUp(t *testing.T, db *leveldb.DB) {
+func CleanUp(t *testing.T, db kv.Store) {
 	err := db.Close()
 	if err != nil {
 		t.Fatalf("Failed test db clean up: %s", err.Error())
@@ -34,20 +36,25 @@ func TestGetFid(t *testing.T) {
 
 	archive := DoubleRefArchiveDB{db: db}
 
-	key := []byte("cid0")
+	key := "cid0"
 	value := []byte("fid0")
-	err := db.Put(key, value, nil)
+	err := db.Put(contractKey(key), value)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	v, err := archive.GetFid(string(key))
+	v, err := archive.GetFid(key)
 	if err != nil {
-		t.Fatalf("%s: %s", string(key), err.Error())
+		t.Fatalf("%s: %s", key, err.Error())
 	}
 
 	if v != string(value) {
-		t.Errorf("%s: %s, expected %s", string(key), string(value), string(v))
+		t.Errorf("%s: %s, expected %s", key, string(value), string(v))
+	}
+
+	_, err = archive.GetFid("cid1")
+	if !errors.Is(err, ErrContractNotFound) {
+		t.Errorf("cid1: %v, expected %v", err, ErrContractNotFound)
 	}
 }
 
@@ -57,30 +64,31 @@ func TestGetContracts(t *testing.T) {
 
 	archive := DoubleRefArchiveDB{db: db}
 
-	k0 := []byte("fid0")
-	v0 := []byte("cid0,cid1,cid2")
-
-	err := db.Put(k0, v0, nil)
+	fid := "fid0"
+	for _, cid := range []string{"cid0", "cid1", "cid2"} {
+		err := archive.SetContract(cid, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a fid that starts with another fid
+	err := archive.SetContract("cid3", "fid00")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	cids, err := archive.GetContracts(string(k0))
+	cids, err := archive.GetContracts(fid)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	for _, c := range cids {
-		switch string(c) {
-		case "cid0":
-			continue
-		case "cid1":
-			continue
-		case "cid2":
-			continue
-		default:
-			t.Errorf("%s: %v, expected [cid0,cid1,cid2]", k0, cids)
-		}
+	if !reflect.DeepEqual(cids, []string{"cid0", "cid1", "cid2"}) {
+		t.Errorf("%s: %v, expected [cid0 cid1 cid2]", fid, cids)
+	}
+
+	_, err = archive.GetContracts("fid1")
+	if !errors.Is(err, ErrFidNotFound) {
+		t.Errorf("fid1: %v, expected %v", err, ErrFidNotFound)
 	}
 }
 
@@ -90,82 +98,272 @@ func TestSetContract(t *testing.T) {
 
 	archive := DoubleRefArchiveDB{db: db}
 
-	fid := []byte("fid0")
-	cid := []byte("cid0")
+	fid := "fid0"
+	cid := "cid0"
 
-	err := archive.SetContract(string(cid), string(fid))
+	err := archive.SetContract(cid, fid)
 	if err != nil {
 		t.Error(err)
 	}
 
-	value, err := db.Get(cid, nil)
+	value, err := db.Get([]byte("c/cid0"))
 	if err != nil {
 		t.Error(err)
 	}
 
-	if string(value) != string(fid) {
-		t.Errorf("%s: %s, expected %s", string(cid), string(value), string(fid))
+	if string(value) != fid {
+		t.Errorf("%s: %s, expected %s", cid, string(value), fid)
 	}
 
-	ref, err := db.Get(fid, nil)
+	_, err = db.Get([]byte("f/fid0/cid0"))
 	if err != nil {
 		t.Error(err)
 	}
 
-	if string(ref) != string("cid0,") {
-		t.Errorf("%s: %s, expected cid0", string(fid), string(ref))
+	err = archive.SetContract(cid, "fid1")
+	if !errors.Is(err, ErrContractAlreadyExists) {
+		t.Errorf("%s: %v, expected %v", cid, err, ErrContractAlreadyExists)
+	}
+}
+
+func TestDeleteContract(t *testing.T) {
+	db := OpenDB(t)
+	defer CleanUp(t, db)
+
+	archive := DoubleRefArchiveDB{db: db}
+
+	fid := "fid0"
+	for _, cid := range []string{"cid0", "cid1"} {
+		err := archive.SetContract(cid, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	cid1 := "cid1"
-	err = archive.SetContract(cid1, string(fid))
+	purge, err := archive.DeleteContract("cid0")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	ref, err = db.Get(fid, nil)
+	if purge {
+		t.Errorf("%s: %t, expected false", fid, purge)
+	}
+
+	cids, err := archive.GetContracts(fid)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cids, []string{"cid1"}) {
+		t.Errorf("%s: %v, expected [cid1]", fid, cids)
+	}
+
+	purge, err = archive.DeleteContract("cid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !purge {
+		t.Errorf("%s: %t, expected true", fid, purge)
 	}
 
-	if string(ref) != string("cid0,cid1,") {
-		t.Errorf("%s: %s, expected cid0,cid1", string(fid), string(ref))
+	_, err = archive.DeleteContract("cid1")
+	if !errors.Is(err, ErrContractNotFound) {
+		t.Errorf("cid1: %v, expected %v", err, ErrContractNotFound)
 	}
 }
 
-func TestDeleteContract(t *testing.T) {
+func TestIterateContracts(t *testing.T) {
+	db := OpenDB(t)
+	defer CleanUp(t, db)
+
+	archive := DoubleRefArchiveDB{db: db}
+
+	contracts := map[string]string{"cid0": "fid0", "cid1": "fid0", "cid2": "fid1"}
+	for cid, fid := range contracts {
+		err := archive.SetContract(cid, fid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter := archive.NewIterator()
+	defer iter.Release()
+
+	found := make(map[string]string)
+	for iter.Next() {
+		found[string(iter.Key())] = string(iter.Value())
+	}
+
+	if !reflect.DeepEqual(found, contracts) {
+		t.Errorf("%v, expected %v", found, contracts)
+	}
+}
+
+func TestContractMetadata(t *testing.T) {
 	db := OpenDB(t)
 	defer CleanUp(t, db)
 
 	archive := DoubleRefArchiveDB{db: db}
 
-	fid := []byte("fid0")
-	cid := []byte("cid0")
+	_, err := archive.GetMetadata("cid0")
+	if !errors.Is(err, ErrContractNotFound) {
+		t.Errorf("cid0: %v, expected %v", err, ErrContractNotFound)
+	}
+	err = archive.UpdateMetadata("cid0", func(meta *ContractMetadata) {})
+	if !errors.Is(err, ErrContractNotFound) {
+		t.Errorf("cid0: %v, expected %v", err, ErrContractNotFound)
+	}
 
-	err := db.Put(cid, fid, nil)
+	err = archive.SetContract("cid0", "fid0")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = db.Put(fid, []byte("cid1,cid0,cid1"), nil)
+	// contracts without a record
+	meta, err := archive.GetMetadata("cid0")
 	if err != nil {
 		t.Fatal(err)
 	}
+	expected := ContractMetadata{Cid: "cid0", Fid: "fid0"}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("%v, expected %v", meta, expected)
+	}
 
-	purge, err := archive.DeleteContract(string(cid))
+	err = archive.UpdateMetadata("cid0", func(meta *ContractMetadata) {
+		meta.Signee = "jkl1signee"
+		meta.FileSize = 13
+		meta.ChunkSize = 1024
+		meta.Fid = "fid1"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = archive.UpdateMetadata("cid0", func(meta *ContractMetadata) {
+		meta.LastProof = &ProofResult{Chunk: 2, Error: "failed"}
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	value, err := db.Get(fid, nil)
+	meta, err = archive.GetMetadata("cid0")
 	if err != nil {
 		t.Fatal(err)
 	}
+	expected = ContractMetadata{
+		Cid:       "cid0",
+		Fid:       "fid0",
+		Signee:    "jkl1signee",
+		FileSize:  13,
+		ChunkSize: 1024,
+		LastProof: &ProofResult{Chunk: 2, Error: "failed"},
+	}
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("%v, expected %v", meta, expected)
+	}
+	if meta.LastProof.Success() {
+		t.Error("last proof succeeded, expected failure")
+	}
 
-	if string(value) != "cid1,cid1" {
-		t.Errorf("%s: %s, expected cid1,cid2", string(fid), string(value))
+	// the metadata is deleted with the contract
+	_, err = archive.DeleteContract("cid0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	has, err := db.Has(metadataKey("cid0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Error("cid0: metadata was not deleted")
+	}
+}
 
-	if purge {
-		t.Errorf("%s: %t, expected false", string(fid), purge)
+func removeDB(t *testing.T) {
+	err := os.RemoveAll("./testdb")
+	if err != nil {
+		t.Fatalf("Failed test db clean up: %s", err.Error())
+	}
+}
+
+func TestUpgradeArchiveDB(t *testing.T) {
+	db := OpenDB(t)
+	defer removeDB(t)
+
+	legacy := map[string]string{
+		"cid0": "fid0",
+		"cid1": "fid0",
+		"cid2": "fid1",
+		"fid0": "cid0,cid1,",
+		"fid1": "cid2,",
+	}
+	for key, value := range legacy {
+		err := db.Put([]byte(key), []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opening the database again must not change it
+	for i := 0; i < 2; i++ {
+		archive, err := NewDoubleRefArchiveDB("", "./testdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cids, err := archive.GetContracts("fid0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cids, []string{"cid0", "cid1"}) {
+			t.Errorf("fid0: %v, expected [cid0 cid1]", cids)
+		}
+
+		fid, err := archive.GetFid("cid2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fid != "fid1" {
+			t.Errorf("cid2: %s, expected fid1", fid)
+		}
+
+		keys := make([]string, 0)
+		iter := archive.db.NewIterator(nil)
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		iter.Release()
+		expected := []string{"c/cid0", "c/cid1", "c/cid2", "f/fid0/cid0", "f/fid0/cid1", "f/fid1/cid2", "m/schema"}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("%v, expected %v", keys, expected)
+		}
+
+		err = archive.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnknownArchiveDBSchema(t *testing.T) {
+	db := OpenDB(t)
+	defer removeDB(t)
+
+	err := db.Put([]byte(schemaKey), []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDoubleRefArchiveDB("", "./testdb")
+	if !errors.Is(err, ErrUnknownSchema) {
+		t.Errorf("%v, expected %v", err, ErrUnknownSchema)
 	}
 }
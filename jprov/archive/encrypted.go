@@ -0,0 +1,534 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	merkletree "github.com/wealdtech/go-merkletree"
+)
+
+var _ Archive = &EncryptedArchive{}
+
+// Encrypted files start with a header holding a random data key, wrapped by
+// the key of the provider. The data follows in segments that are sealed with
+// AES-GCM on their own, so any part of a file can be read without decrypting
+// everything before it. The nonce of a segment is its index and the last
+// segment is marked as such, so segments can't be reordered or cut off.
+//
+//	magic | key nonce | wrapped data key | segment 0 | segment 1 | ...
+const (
+	encryptionMagic   = "JKLENC01"
+	encryptionKeySize = 32
+	// plaintext bytes per segment
+	encryptedSegmentSize = 64 << 10
+)
+
+var (
+	encryptionOverhead  = gcmOverhead()
+	encryptedHeaderSize = int64(len(encryptionMagic)) + int64(encryptionOverhead.nonce) + encryptionKeySize + int64(encryptionOverhead.tag)
+	// ciphertext bytes per full segment
+	sealedSegmentSize = int64(encryptedSegmentSize + encryptionOverhead.tag)
+)
+
+var (
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 32 bytes")
+	// ErrCorruptFile is returned when an encrypted file was changed after
+	// it was written.
+	ErrCorruptFile = errors.New("encrypted file is corrupt")
+	// ErrEncryptionKeyMissing is returned when files were encrypted with a
+	// key that can't be found anymore, a new key couldn't read them.
+	ErrEncryptionKeyMissing = errors.New("files were encrypted with a key that is missing")
+	// ErrWrongEncryptionKey is returned when the key isn't the one files
+	// were encrypted with.
+	ErrWrongEncryptionKey = errors.New("files were encrypted with another key")
+)
+
+func gcmOverhead() (overhead struct{ nonce, tag int }) {
+	aead, err := newAEAD(make([]byte, encryptionKeySize))
+	if err != nil {
+		panic(err)
+	}
+	overhead.nonce = aead.NonceSize()
+	overhead.tag = aead.Overhead()
+	return overhead
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != encryptionKeySize {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedArchive encrypts files and merkle trees before they are stored by
+// another archive and decrypts them when they are read, so pieces and proofs
+// are still served from the plaintext.
+// Files that were stored before encryption was turned on are read as they are.
+type EncryptedArchive struct {
+	archive Archive
+	key     cipher.AEAD
+}
+
+// NewEncryptedArchive wraps a with encryption under the 32 byte key.
+func NewEncryptedArchive(a Archive, key []byte) (*EncryptedArchive, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedArchive{archive: a, key: aead}, nil
+}
+
+// Unwrap returns the archive that stores the encrypted files.
+func (e *EncryptedArchive) Unwrap() Archive {
+	return e.archive
+}
+
+// Unwrap returns the archive at the bottom of a chain of wrapping archives.
+func Unwrap(a Archive) Archive {
+	for {
+		wrapper, ok := a.(interface{ Unwrap() Archive })
+		if !ok {
+			return a
+		}
+		a = wrapper.Unwrap()
+	}
+}
+
+// LoadOrCreateKey reads a hex encoded key from path, or creates a new random
+// key there if the file does not exist. checkPath holds a checksum of the key
+// next to the files it encrypts. A new key is only created if there's no
+// checksum, so a lost key is never replaced by one that can't read the files.
+func LoadOrCreateKey(path string, checkPath string) ([]byte, error) {
+	check, err := os.ReadFile(checkPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	check = bytes.TrimSpace(check)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if len(check) > 0 {
+			return nil, fmt.Errorf("%w: restore %s from its backup", ErrEncryptionKeyMissing, path)
+		}
+		return createKey(path, checkPath)
+	} else if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("%s: %w", path, ErrInvalidEncryptionKey)
+	}
+
+	switch {
+	case len(check) == 0:
+		// keys created before the checksum was kept
+		err = writeKeyCheck(checkPath, key)
+		if err != nil {
+			return nil, err
+		}
+	case string(check) != keyChecksum(key):
+		return nil, fmt.Errorf("%s: %w", path, ErrWrongEncryptionKey)
+	}
+	return key, nil
+}
+
+func createKey(path string, checkPath string) ([]byte, error) {
+	key := make([]byte, encryptionKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeKeyFile(path, key)
+	if err != nil {
+		return nil, err
+	}
+	err = writeKeyCheck(checkPath, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKeyCheck writes the checksum of key to path.
+func writeKeyCheck(path string, key []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(keyChecksum(key)+"\n"), 0o600)
+}
+
+// keyChecksum identifies key without revealing it.
+func keyChecksum(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeKeyFile writes key hex encoded to a new file at path that only the
+// owner can read.
+func writeKeyFile(path string, key []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	// fails instead of overwriting a key that was created in the meantime
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(hex.EncodeToString(key) + "\n")
+	return errors.Join(err, file.Sync(), file.Close())
+}
+
+func segmentNonce(index int64) []byte {
+	nonce := make([]byte, encryptionOverhead.nonce)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+func segmentData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingReader encrypts everything read from src.
+type encryptingReader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	index int64
+	next  []byte // the plaintext of the next segment
+	out   []byte // ciphertext that was not read yet
+	done  bool
+	// plaintext bytes read from src
+	read int64
+}
+
+func (e *EncryptedArchive) encrypt(src io.Reader) (*encryptingReader, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyNonce := make([]byte, e.key.NonceSize())
+	_, err = rand.Read(keyNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, keyNonce...)
+	header = e.key.Seal(header, keyNonce, dataKey, []byte(encryptionMagic))
+
+	r := &encryptingReader{src: src, aead: aead, out: header}
+	r.next, err = r.readSegment()
+	return r, err
+}
+
+func (r *encryptingReader) readSegment() ([]byte, error) {
+	segment := make([]byte, encryptedSegmentSize)
+	n, err := io.ReadFull(r.src, segment)
+	r.read += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return segment[:n], err
+}
+
+// seal encrypts the next segment. A segment is the last one if src ended
+// before or right after it.
+func (r *encryptingReader) seal() error {
+	segment := r.next
+	final := len(segment) < encryptedSegmentSize
+	if !final {
+		next, err := r.readSegment()
+		if err != nil {
+			return err
+		}
+		final = len(next) == 0
+		r.next = next
+	}
+
+	r.out = r.aead.Seal(r.out[:0], segmentNonce(r.index), segment, segmentData(final))
+	r.index++
+	r.done = final
+	return nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decryptingReader gives random access to the plaintext of an encrypted file.
+type decryptingReader struct {
+	src      io.ReadSeekCloser
+	aead     cipher.AEAD
+	size     int64 // of the plaintext
+	segments int64
+	offset   int64
+
+	// the last decrypted segment
+	index int64
+	plain []byte
+}
+
+// decrypt returns a reader of the plaintext of src. src is returned as it is
+// if it was not encrypted.
+func (e *EncryptedArchive) decrypt(src io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	header := make([]byte, encryptedHeaderSize)
+	_, err := io.ReadFull(src, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	// files stored before encryption was turned on are read as they are. A
+	// plaintext file that happens to start with the magic can't be told
+	// apart from an encrypted one and fails to decrypt.
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		_, err = src.Seek(0, io.SeekStart)
+		return src, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: truncated", ErrCorruptFile)
+	}
+
+	keyNonce := header[len(encryptionMagic) : len(encryptionMagic)+e.key.NonceSize()]
+	wrapped := header[len(encryptionMagic)+e.key.NonceSize():]
+	dataKey, err := e.key.Open(nil, keyNonce, wrapped, []byte(encryptionMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the key of the file: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	body := end - encryptedHeaderSize
+	segments := (body + sealedSegmentSize - 1) / sealedSegmentSize
+	if segments == 0 {
+		return nil, fmt.Errorf("%w: truncated", ErrCorruptFile)
+	}
+
+	return &decryptingReader{
+		src:      src,
+		aead:     aead,
+		size:     body - segments*int64(encryptionOverhead.tag),
+		segments: segments,
+		index:    -1,
+	}, nil
+}
+
+func (r *decryptingReader) load(index int64) error {
+	if index == r.index {
+		return nil
+	}
+
+	_, err := r.src.Seek(encryptedHeaderSize+index*sealedSegmentSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, sealedSegmentSize)
+	n, err := io.ReadFull(r.src, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	r.plain, err = r.aead.Open(sealed[:0], segmentNonce(index), sealed[:n], segmentData(index == r.segments-1))
+	if err != nil {
+		r.index = -1
+		return fmt.Errorf("%w: failed to decrypt segment %d: %w", ErrCorruptFile, index, err)
+	}
+	r.index = index
+	return nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.offset / encryptedSegmentSize
+	err := r.load(index)
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, r.plain[r.offset-index*encryptedSegmentSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("decryptingReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("decryptingReader.Seek: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.src.Close()
+}
+
+type bytesReadSeekCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadSeekCloser) Close() error {
+	return nil
+}
+
+func (e *EncryptedArchive) WriteFileToDisk(data io.Reader, fid string) (written int64, err error) {
+	r, err := e.encrypt(data)
+	if err != nil {
+		return 0, err
+	}
+	_, err = e.archive.WriteFileToDisk(r, fid)
+	return r.read, err
+}
+
+func (e *EncryptedArchive) GetPiece(fid string, index, blockSize int64) (block []byte, err error) {
+	file, err := e.RetrieveFile(fid)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+
+	_, err = file.Seek(index*blockSize, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	block = make([]byte, blockSize)
+	n, err := io.ReadFull(file, block)
+	// the last block is shorter unless the file size is n * blockSize
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return block[:n], nil
+}
+
+func (e *EncryptedArchive) RetrieveFile(fid string) (data io.ReadSeekCloser, err error) {
+	file, err := e.archive.RetrieveFile(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = e.decrypt(file)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	return data, nil
+}
+
+func (e *EncryptedArchive) FileExist(fid string) bool {
+	return e.archive.FileExist(fid)
+}
+
+func (e *EncryptedArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) error {
+	return writeTree(e, fid, tree)
+}
+
+func (e *EncryptedArchive) WriteTreeData(fid string, data []byte) error {
+	r, err := e.encrypt(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return e.archive.WriteTreeData(fid, sealed)
+}
+
+func (e *EncryptedArchive) RetrieveTree(fid string) (tree *merkletree.MerkleTree, err error) {
+	return retrieveTree(e, fid)
+}
+
+func (e *EncryptedArchive) RetrieveTreeData(fid string) (data []byte, err error) {
+	sealed, err := e.archive.RetrieveTreeData(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := e.decrypt(bytesReadSeekCloser{bytes.NewReader(sealed)})
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func (e *EncryptedArchive) Delete(fid string) error {
+	return e.archive.Delete(fid)
+}
+
+// StageFile encrypts data while it is staged. written is the size of the
+// plaintext.
+func (e *EncryptedArchive) StageFile(data io.Reader) (stage string, written int64, err error) {
+	r, err := e.encrypt(data)
+	if err != nil {
+		return "", 0, err
+	}
+	stage, _, err = e.archive.StageFile(r)
+	return stage, r.read, err
+}
+
+func (e *EncryptedArchive) CommitFile(stage string, fid string) error {
+	return e.archive.CommitFile(stage, fid)
+}
+
+func (e *EncryptedArchive) DiscardFile(stage string) error {
+	return e.archive.DiscardFile(stage)
+}
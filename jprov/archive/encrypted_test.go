@@ -0,0 +1,205 @@
+package archive_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+func setupEncryptedArchive(t *testing.T) (*archive.EncryptedArchive, *archive.HybridCellArchive) {
+	rootDir := t.TempDir()
+	key, err := archive.LoadOrCreateKey(filepath.Join(rootDir, "config", "storage_key"), filepath.Join(rootDir, "key_check"))
+	require.NoError(t, err)
+
+	base := archive.NewHybridCellArchive(rootDir)
+	encrypted, err := archive.NewEncryptedArchive(base, key)
+	require.NoError(t, err)
+	return encrypted, base
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	cases := map[string]struct {
+		size int
+	}{
+		"empty":         {size: 0},
+		"small":         {size: 1000},
+		"one_segment":   {size: 64 << 10},
+		"many_segments": {size: 3*(64<<10) + 123},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			encrypted, base := setupEncryptedArchive(t)
+
+			data := make([]byte, c.size)
+			_, err := rand.Read(data)
+			require.NoError(err)
+
+			stage, written, err := encrypted.StageFile(bytes.NewReader(data))
+			require.NoError(err)
+			require.EqualValues(c.size, written)
+			require.NoError(encrypted.CommitFile(stage, "jklf1test"))
+
+			// the plaintext is not stored
+			stored, err := base.RetrieveFile("jklf1test")
+			require.NoError(err)
+			raw, err := io.ReadAll(stored)
+			require.NoError(err)
+			require.NoError(stored.Close())
+			require.Greater(len(raw), c.size)
+			if c.size > 0 {
+				require.False(bytes.Contains(raw, data[:min(c.size, 64)]))
+			}
+
+			file, err := encrypted.RetrieveFile("jklf1test")
+			require.NoError(err)
+			got, err := io.ReadAll(file)
+			require.NoError(err)
+			require.Equal(data, got)
+
+			// random access across segments
+			end, err := file.Seek(0, io.SeekEnd)
+			require.NoError(err)
+			require.EqualValues(c.size, end)
+			require.NoError(file.Close())
+
+			for _, blockSize := range []int64{1000, 10240} {
+				for index := int64(0); index*blockSize < int64(c.size); index++ {
+					piece, err := encrypted.GetPiece("jklf1test", index, blockSize)
+					require.NoError(err)
+					require.Equal(data[index*blockSize:min((index+1)*blockSize, int64(c.size))], piece)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedArchiveTree(t *testing.T) {
+	require := require.New(t)
+	encrypted, base := setupEncryptedArchive(t)
+
+	tree, err := merkletree.NewUsing([][]byte{[]byte("hello"), []byte("world")}, sha3.New512(), false)
+	require.NoError(err)
+	require.NoError(encrypted.WriteTreeToDisk("jklf1test", tree))
+
+	_, err = base.RetrieveTree("jklf1test")
+	require.Error(err)
+
+	got, err := encrypted.RetrieveTree("jklf1test")
+	require.NoError(err)
+	require.Equal(tree.Root(), got.Root())
+}
+
+func TestEncryptedArchivePlaintext(t *testing.T) {
+	require := require.New(t)
+	encrypted, base := setupEncryptedArchive(t)
+	data := []byte("hello, world\n")
+
+	// stored before encryption was turned on
+	_, err := base.WriteFileToDisk(bytes.NewReader(data), "jklf1plain")
+	require.NoError(err)
+	tree, err := merkletree.NewUsing([][]byte{data}, sha3.New512(), false)
+	require.NoError(err)
+	require.NoError(base.WriteTreeToDisk("jklf1plain", tree))
+
+	piece, err := encrypted.GetPiece("jklf1plain", 1, 5)
+	require.NoError(err)
+	require.Equal(", wor", string(piece))
+
+	got, err := encrypted.RetrieveTree("jklf1plain")
+	require.NoError(err)
+	require.Equal(tree.Root(), got.Root())
+}
+
+func TestEncryptedArchiveTampered(t *testing.T) {
+	require := require.New(t)
+	encrypted, base := setupEncryptedArchive(t)
+
+	data := bytes.Repeat([]byte{'a'}, 2*(64<<10))
+	_, err := encrypted.WriteFileToDisk(bytes.NewReader(data), "jklf1test")
+	require.NoError(err)
+
+	stored, err := base.RetrieveFile("jklf1test")
+	require.NoError(err)
+	raw, err := io.ReadAll(stored)
+	require.NoError(err)
+	require.NoError(stored.Close())
+
+	// cutting off the last segment is noticed
+	require.NoError(base.Delete("jklf1test"))
+	_, err = base.WriteFileToDisk(bytes.NewReader(raw[:len(raw)-(64<<10)-16]), "jklf1test")
+	require.NoError(err)
+	_, err = encrypted.GetPiece("jklf1test", 0, 1024)
+	require.Error(err)
+
+	// so is a flipped bit
+	raw[len(raw)-1] ^= 1
+	require.NoError(base.Delete("jklf1test"))
+	_, err = base.WriteFileToDisk(bytes.NewReader(raw), "jklf1test")
+	require.NoError(err)
+	_, err = encrypted.GetPiece("jklf1test", 0, 1024)
+	require.NoError(err)
+	_, err = encrypted.GetPiece("jklf1test", 127, 1024)
+	require.Error(err)
+
+	// a different key can't read the file
+	other, err := archive.NewEncryptedArchive(base, bytes.Repeat([]byte{1}, 32))
+	require.NoError(err)
+	_, err = other.GetPiece("jklf1test", 0, 1024)
+	require.Error(err)
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "config", "storage_key")
+	checkPath := filepath.Join(t.TempDir(), "key_check")
+
+	key, err := archive.LoadOrCreateKey(path, checkPath)
+	require.NoError(err)
+	require.Len(key, 32)
+
+	info, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0o600), info.Mode().Perm())
+	require.FileExists(checkPath)
+
+	again, err := archive.LoadOrCreateKey(path, checkPath)
+	require.NoError(err)
+	require.Equal(key, again)
+
+	// a lost key isn't replaced, the files could not be read anymore
+	require.NoError(os.Remove(path))
+	_, err = archive.LoadOrCreateKey(path, checkPath)
+	require.ErrorIs(err, archive.ErrEncryptionKeyMissing)
+	require.NoFileExists(path)
+
+	// neither is a key other than the one of the files used
+	other := filepath.Join(t.TempDir(), "other_key")
+	_, err = archive.LoadOrCreateKey(other, filepath.Join(t.TempDir(), "other_check"))
+	require.NoError(err)
+	require.NoError(os.Rename(other, path))
+	_, err = archive.LoadOrCreateKey(path, checkPath)
+	require.ErrorIs(err, archive.ErrWrongEncryptionKey)
+
+	// keys without a checksum get one
+	require.NoError(os.Remove(checkPath))
+	again, err = archive.LoadOrCreateKey(path, checkPath)
+	require.NoError(err)
+	require.FileExists(checkPath)
+	_, err = archive.LoadOrCreateKey(path, checkPath)
+	require.NoError(err)
+	require.NotEqual(key, again)
+
+	require.NoError(os.WriteFile(path, []byte("abcd\n"), 0o600))
+	_, err = archive.LoadOrCreateKey(path, checkPath)
+	require.ErrorIs(err, archive.ErrInvalidEncryptionKey)
+}
@@ -0,0 +1,5 @@
+package archive
+
+// SetupMultiDiskArchive lets the tests of archive_test, which can ingest
+// files through utils, use disks of a fixed size.
+var SetupMultiDiskArchive = setupMultiDiskArchive
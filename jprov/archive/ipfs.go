@@ -2,15 +2,30 @@ package archive
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"sync"
 
 	badger "github.com/dgraph-io/badger/v4"
 	ipfslite "github.com/hsanjuan/ipfs-lite"
+	"github.com/ipfs/boxo/blockservice"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	ufsio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	multiaddr "github.com/multiformats/go-multiaddr"
 
+	merkletree "github.com/wealdtech/go-merkletree"
 	merkletree2 "github.com/wealdtech/go-merkletree/v2"
 
 	bds "github.com/ipfs/go-ds-badger2"
@@ -20,16 +35,31 @@ import (
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+var _ Archive = &IpfsArchive{}
+
+// IpfsArchive stores files as UnixFS DAGs of an ipfs-lite peer. The cid of
+// every fid, the merkle trees and the reference counts of the blocks are kept
+// in the badger database of the peer.
+// Files with the same data share blocks, a block is only removed once no
+// file or staged file uses it anymore.
 type IpfsArchive struct {
 	db   *badger.DB
 	ipfs *ipfslite.Peer
+	// dag only reads blocks stored by this peer so reading a missing file
+	// fails instead of waiting for the network
+	dag ipld.DAGService
+	// held for reading while blocks are added and for writing while they are
+	// removed, a new file can't lose blocks it shares with a deleted one
+	blocks sync.RWMutex
 }
 
 func merkleTreeKey(merkle []byte, owner string, start int64) []byte {
 	return []byte(fmt.Sprintf("tree/%x/%s/%d", merkle, owner, start))
 }
 
-func (i *IpfsArchive) WriteTreeToDisk(merkle []byte, owner string, start int64, tree *merkletree2.MerkleTree) (err error) {
+// WriteV2TreeToDisk stores a tree of the v2 merkletree package by the merkle
+// root, owner and start block of its deal.
+func (i *IpfsArchive) WriteV2TreeToDisk(merkle []byte, owner string, start int64, tree *merkletree2.MerkleTree) (err error) {
 	k := merkleTreeKey(merkle, owner, start)
 	v, err := json.Marshal(tree)
 	if err != nil {
@@ -55,53 +85,598 @@ func fidKey(fid string) []byte {
 	return []byte(fmt.Sprintf("cid/%x", h))
 }
 
+func fidTreeKey(fid string) []byte {
+	return []byte(fmt.Sprintf("fidtree/%x", fid))
+}
+
+// pinKey marks that the blocks of fid are reference counted. Files recorded
+// by older versions are not pinned until the pin reconciler runs.
+func pinKey(fid string) []byte {
+	return []byte(fmt.Sprintf("pin/%x", fid))
+}
+
+func stageKey(stage string) []byte {
+	return []byte("stage/" + stage)
+}
+
+func blockRefKey(c cid.Cid) []byte {
+	return []byte("ref/" + c.String())
+}
+
+// refBatchSize is the number of reference counts changed in one transaction,
+// large files have more blocks than fit into a single one.
+const refBatchSize = 10000
+
 func (i *IpfsArchive) WriteFileToDisk(data io.Reader, fid string) (written int64, err error) {
-	node, err := i.ipfs.AddFile(context.Background(), data, nil)
+	var replaced cid.Cid
+	written, err = i.add(data, func(c cid.Cid) (err error) {
+		replaced, err = i.recordFid(fid, c)
+		if err != nil {
+			return errors.Join(errors.New("failed to record fid to database"), err)
+		}
+		return nil
+	})
+	if err != nil || !replaced.Defined() {
+		return written, err
+	}
+	return written, i.release(replaced)
+}
+
+// add stores data as a new DAG, takes a reference on all of its blocks and
+// records its root with record. The blocks are not collected as garbage until
+// the root is recorded, the DAG is released again if record fails.
+func (i *IpfsArchive) add(data io.Reader, record func(c cid.Cid) error) (written int64, err error) {
+	c, written, err := i.addBlocks(data, record)
+	if err != nil && c.Defined() {
+		// release takes the lock addBlocks held
+		return 0, errors.Join(err, i.release(c))
+	}
+	return written, err
+}
+
+// addBlocks does the work of add while holding the blocks for reading. The
+// root of the DAG is returned if its blocks have to be released.
+func (i *IpfsArchive) addBlocks(data io.Reader, record func(c cid.Cid) error) (c cid.Cid, written int64, err error) {
+	i.blocks.RLock()
+	defer i.blocks.RUnlock()
+
+	counter := &countingReader{Reader: data}
+	node, err := i.ipfs.AddFile(context.Background(), counter, nil)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	blocks, err := i.dagBlocks(node.Cid())
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	_, err = i.updateRefs(blocks, 1)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	err = record(node.Cid())
+	if err != nil {
+		return node.Cid(), 0, err
+	}
+	return node.Cid(), counter.read, nil
+}
+
+// release drops a reference on all blocks of the DAG at c and removes the
+// blocks that are not used anymore. Blocks without a reference count were
+// added by older versions and are left to CollectGarbage.
+func (i *IpfsArchive) release(c cid.Cid) error {
+	i.blocks.Lock()
+	defer i.blocks.Unlock()
+
+	blocks, err := i.dagBlocks(c)
+	if err != nil {
+		return err
+	}
+	unused, err := i.updateRefs(blocks, -1)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range unused {
+		err = i.ipfs.BlockStore().DeleteBlock(context.Background(), b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dagBlocks returns the cids of all local blocks of the DAG at root, each
+// block only once.
+func (i *IpfsArchive) dagBlocks(root cid.Cid) ([]cid.Cid, error) {
+	seen := map[cid.Cid]bool{root: true}
+	blocks := make([]cid.Cid, 0)
+	next := []cid.Cid{root}
+	for len(next) > 0 {
+		c := next[len(next)-1]
+		next = next[:len(next)-1]
+
+		node, err := i.dag.Get(context.Background(), c)
+		if ipld.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, c)
+
+		for _, link := range node.Links() {
+			if !seen[link.Cid] {
+				seen[link.Cid] = true
+				next = append(next, link.Cid)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// updateRefs adds delta to the reference counts of blocks and returns the
+// blocks whose count dropped to zero.
+func (i *IpfsArchive) updateRefs(blocks []cid.Cid, delta int64) (unused []cid.Cid, err error) {
+	for len(blocks) > 0 {
+		batch := blocks[:min(len(blocks), refBatchSize)]
+		blocks = blocks[len(batch):]
+
+		err = i.db.Update(func(txn *badger.Txn) error {
+			for _, b := range batch {
+				refs, err := getUint64(txn, blockRefKey(b))
+				if errors.Is(err, badger.ErrKeyNotFound) && delta < 0 {
+					continue
+				}
+				if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+					return err
+				}
+
+				count := int64(refs) + delta
+				if count > 0 {
+					err = txn.Set(blockRefKey(b), binary.BigEndian.AppendUint64(nil, uint64(count)))
+				} else {
+					unused = append(unused, b)
+					err = txn.Delete(blockRefKey(b))
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unused, nil
+}
+
+func getUint64(txn *badger.Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
 	if err != nil {
 		return 0, err
 	}
+	var value uint64
+	err = item.Value(func(val []byte) error {
+		if len(val) != 8 {
+			return fmt.Errorf("invalid counter at %s", key)
+		}
+		value = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return value, err
+}
+
+// getCid returns the cid stored at key, the error wraps os.ErrNotExist if
+// there is none.
+func (i *IpfsArchive) getCid(key []byte) (c cid.Cid, err error) {
+	err = i.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			c, err = cid.Decode(string(val))
+			return err
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return cid.Undef, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	return c, err
+}
 
-	wrote, err := node.Size()
+// fidCid returns the cid of the DAG of fid and whether it is pinned. The
+// error wraps os.ErrNotExist if fid is not stored.
+func (i *IpfsArchive) fidCid(fid string) (c cid.Cid, pinned bool, err error) {
+	c, err = i.getCid(fidKey(fid))
 	if err != nil {
-		return 0, errors.Join(fmt.Errorf("failed to get bytes written"), err)
+		return cid.Undef, false, err
+	}
+
+	err = i.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(pinKey(fid))
+		pinned = err == nil
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	})
+	return c, pinned, err
+}
+
+// setFid points fid to the DAG at c and releases the DAG it pointed to
+// before.
+func (i *IpfsArchive) setFid(fid string, c cid.Cid) error {
+	replaced, err := i.recordFid(fid, c)
+	if err != nil || !replaced.Defined() {
+		return err
+	}
+	return i.release(replaced)
+}
+
+// recordFid points fid to c. The root fid pointed to before is returned if
+// its blocks are reference counted, it has to be released.
+func (i *IpfsArchive) recordFid(fid string, c cid.Cid) (replaced cid.Cid, err error) {
+	old, pinned, err := i.fidCid(fid)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cid.Undef, err
 	}
 
 	err = i.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(fidKey(fid), []byte(node.Cid().String()))
+		return errors.Join(txn.Set(fidKey(fid), []byte(c.String())), txn.Set(pinKey(fid), nil))
 	})
+	if err != nil || !pinned {
+		return cid.Undef, err
+	}
+	return old, nil
+}
+
+// GetPiece returns the block at index, io.EOF if it starts after the end
+// of the file.
+func (i *IpfsArchive) GetPiece(fid string, index, blockSize int64) (block []byte, err error) {
+	file, err := i.retrieveFile(fid)
 	if err != nil {
-		return int64(wrote), errors.Join(errors.New("failed to record fid to database"), err)
+		return nil, err
 	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
 
-	return int64(wrote), nil
+	start := index * blockSize
+	if start >= int64(file.Size()) {
+		return nil, io.EOF
+	}
+	_, err = file.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	block = make([]byte, blockSize)
+	n, err := io.ReadFull(file, block)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return block[:n], nil
+}
+
+func (i *IpfsArchive) RetrieveFile(fid string) (data io.ReadSeekCloser, err error) {
+	return i.retrieveFile(fid)
 }
 
-func NewIpfsArchive(db *badger.DB, port int) (*IpfsArchive, error) {
-	peer, err := newIpfsArchive(context.Background(), db, port)
+func (i *IpfsArchive) retrieveFile(fid string) (ufsio.DagReader, error) {
+	c, err := i.getCid(fidKey(fid))
 	if err != nil {
 		return nil, err
 	}
+	return i.OpenCid(c)
+}
 
-	return &IpfsArchive{db: db, ipfs: peer}, nil
+// OpenCid returns the file with the root c if all of its blocks are stored
+// by the peer. The error wraps os.ErrNotExist if the root is missing.
+func (i *IpfsArchive) OpenCid(c cid.Cid) (ufsio.DagReader, error) {
+	node, err := i.dag.Get(context.Background(), c)
+	if ipld.IsNotFound(err) {
+		return nil, fmt.Errorf("%s: %w", c, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ufsio.NewDagReader(context.Background(), node, i.dag)
 }
 
-func newIpfsArchive(ctx context.Context, db *badger.DB, port int) (*ipfslite.Peer, error) {
-	ds, err := bds.NewDatastoreFromDB(db)
+// FileExist is true for missing files like the other archives.
+func (i *IpfsArchive) FileExist(fid string) bool {
+	c, err := i.getCid(fidKey(fid))
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	ok, err := i.ipfs.HasBlock(context.Background(), c)
+	return err == nil && !ok
+}
+
+func (i *IpfsArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) error {
+	return writeTree(i, fid, tree)
+}
+
+func (i *IpfsArchive) WriteTreeData(fid string, data []byte) error {
+	return i.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(fidTreeKey(fid), data)
+	})
+}
+
+func (i *IpfsArchive) RetrieveTree(fid string) (tree *merkletree.MerkleTree, err error) {
+	return retrieveTree(i, fid)
+}
+
+func (i *IpfsArchive) RetrieveTreeData(fid string) (data []byte, err error) {
+	err = i.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(fidTreeKey(fid))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, fmt.Errorf("tree of %s: %w", fid, os.ErrNotExist)
+	}
+	return data, err
+}
+
+// Delete removes the file and its merkle tree. Deleting a file that doesn't
+// exist is not an error.
+func (i *IpfsArchive) Delete(fid string) error {
+	c, pinned, err := i.fidCid(fid)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = i.db.Update(func(txn *badger.Txn) error {
+		return errors.Join(txn.Delete(fidKey(fid)), txn.Delete(fidTreeKey(fid)), txn.Delete(pinKey(fid)))
+	})
+	if err != nil || !pinned {
+		return err
+	}
+	return i.release(c)
+}
+
+// Files returns the cid of every stored fid.
+func (i *IpfsArchive) Files() (map[string]cid.Cid, error) {
+	files := make(map[string]cid.Cid)
+	err := i.db.View(func(txn *badger.Txn) error {
+		prefix := []byte("cid/")
+		iter := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			fid, err := hex.DecodeString(string(item.Key()[len(prefix):]))
+			if err != nil {
+				return fmt.Errorf("invalid fid key %s: %w", item.Key(), err)
+			}
+			err = item.Value(func(val []byte) error {
+				c, err := cid.Decode(string(val))
+				files[string(fid)] = c
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Pin makes sure all blocks of fid are stored by the peer, missing blocks are
+// fetched from the network. The blocks of files recorded by older versions
+// are reference counted from then on.
+func (i *IpfsArchive) Pin(ctx context.Context, fid string) error {
+	c, pinned, err := i.fidCid(fid)
+	if err != nil {
+		return err
+	}
+
+	err = merkledag.FetchGraph(ctx, c, i.ipfs)
+	if err != nil || pinned {
+		return err
+	}
+
+	i.blocks.RLock()
+	defer i.blocks.RUnlock()
+
+	blocks, err := i.dagBlocks(c)
+	if err != nil {
+		return err
+	}
+	_, err = i.updateRefs(blocks, 1)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(pinKey(fid), nil)
+	})
+}
+
+// CollectGarbage removes the blocks that are not part of a stored or staged
+// file, like the blocks of files recorded by older versions that were
+// deleted.
+func (i *IpfsArchive) CollectGarbage(ctx context.Context) (removed int, err error) {
+	i.blocks.Lock()
+	defer i.blocks.Unlock()
+
+	roots, err := i.roots()
+	if err != nil {
+		return 0, err
+	}
+
+	// the blockstore lists blocks as raw cids, blocks are compared by hash
+	live := make(map[string]bool)
+	for _, root := range roots {
+		blocks, err := i.dagBlocks(root)
+		if err != nil {
+			return 0, err
+		}
+		for _, b := range blocks {
+			live[string(b.Hash())] = true
+		}
+	}
+
+	keys, err := i.ipfs.BlockStore().AllKeysChan(ctx)
+	if err != nil {
+		return 0, err
+	}
+	garbage := make([]cid.Cid, 0)
+	for c := range keys {
+		if !live[string(c.Hash())] {
+			garbage = append(garbage, c)
+		}
+	}
+
+	for _, c := range garbage {
+		err = i.ipfs.BlockStore().DeleteBlock(ctx, c)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// roots returns the cids of all stored and staged files.
+func (i *IpfsArchive) roots() ([]cid.Cid, error) {
+	roots := make([]cid.Cid, 0)
+	err := i.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range [][]byte{[]byte("cid/"), []byte("stage/")} {
+			iter := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				err := iter.Item().Value(func(val []byte) error {
+					c, err := cid.Decode(string(val))
+					roots = append(roots, c)
+					return err
+				})
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			iter.Close()
+		}
+		return nil
+	})
+	return roots, err
+}
+
+// StageFile adds data to the DAG without a fid, the stage is a random name
+// pointing to the DAG.
+func (i *IpfsArchive) StageFile(data io.Reader) (stage string, written int64, err error) {
+	name := make([]byte, 16)
+	_, err = rand.Read(name)
+	if err != nil {
+		return "", 0, err
+	}
+	stage = hex.EncodeToString(name)
+
+	written, err = i.add(data, func(c cid.Cid) error {
+		return i.db.Update(func(txn *badger.Txn) error {
+			return txn.Set(stageKey(stage), []byte(c.String()))
+		})
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return stage, written, nil
+}
+
+func (i *IpfsArchive) CommitFile(stage string, fid string) error {
+	c, err := i.getCid(stageKey(stage))
+	if err != nil {
+		return err
+	}
+
+	err = i.setFid(fid, c)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(stageKey(stage))
+	})
+}
+
+func (i *IpfsArchive) DiscardFile(stage string) error {
+	c, err := i.getCid(stageKey(stage))
+	if err != nil {
+		return err
+	}
+
+	err = i.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(stageKey(stage))
+	})
+	if err != nil {
+		return err
+	}
+	return i.release(c)
+}
+
+type countingReader struct {
+	io.Reader
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// IpfsPeerConfig configures the libp2p host of the IPFS peer.
+type IpfsPeerConfig struct {
+	Port int
+	// Key is the identity of the peer, see LoadOrCreatePeerKey
+	Key crypto.PrivKey
+	// BootstrapPeers are connected to on start. The public IPFS bootstrap
+	// peers are used if there are none, unless the swarm is private.
+	BootstrapPeers []peer.AddrInfo
+	// SwarmKey is the pre-shared key of a private swarm, only peers with the
+	// same key can connect. nil joins the public IPFS network.
+	SwarmKey pnet.PSK
+	// Offline peers don't connect to the network, only local blocks are read.
+	Offline bool
+}
+
+func NewIpfsArchive(db *badger.DB, config IpfsPeerConfig) (*IpfsArchive, error) {
+	peer, err := newIpfsPeer(context.Background(), db, config)
 	if err != nil {
 		return nil, err
 	}
 
-	priv, _, err := crypto.GenerateKeyPair(crypto.RSA, 2048)
+	return newIpfsArchive(db, peer), nil
+}
+
+func newIpfsArchive(db *badger.DB, peer *ipfslite.Peer) *IpfsArchive {
+	local := blockservice.New(peer.BlockStore(), offline.Exchange(peer.BlockStore()))
+	return &IpfsArchive{db: db, ipfs: peer, dag: merkledag.NewDAGService(local)}
+}
+
+func newIpfsPeer(ctx context.Context, db *badger.DB, config IpfsPeerConfig) (*ipfslite.Peer, error) {
+	ds, err := bds.NewDatastoreFromDB(db)
 	if err != nil {
 		return nil, err
 	}
 
-	listen, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port))
+	if config.Offline {
+		return ipfslite.New(ctx, ds, nil, nil, nil, &ipfslite.Config{Offline: true})
+	}
+
+	listen, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", config.Port))
 
 	h, dht, err := ipfslite.SetupLibp2p(
 		ctx,
-		priv,
-		nil,
+		config.Key,
+		config.SwarmKey,
 		[]multiaddr.Multiaddr{listen},
 		ds,
 		ipfslite.Libp2pOptionsExtra...,
@@ -115,11 +690,64 @@ func newIpfsArchive(ctx context.Context, db *badger.DB, port int) (*ipfslite.Pee
 		return nil, err
 	}
 
-	lite.Bootstrap(ipfslite.DefaultBootstrapPeers())
+	bootstrap := config.BootstrapPeers
+	if len(bootstrap) == 0 && config.SwarmKey == nil {
+		bootstrap = ipfslite.DefaultBootstrapPeers()
+	}
+	lite.Bootstrap(bootstrap)
 
 	return lite, nil
 }
 
+// LoadOrCreatePeerKey reads the private key of the IPFS peer from path, or
+// creates a new key there if the file does not exist. The peer ID is derived
+// from the key and stays the same as long as the file is kept.
+func LoadOrCreatePeerKey(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid peer key: %w", path, err)
+		}
+		return crypto.UnmarshalPrivateKey(raw)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, _, err := crypto.GenerateKeyPair(crypto.RSA, 2048)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeKeyFile(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadSwarmKey reads a pre-shared swarm key in the swarm.key format of
+// go-ipfs from path.
+func LoadSwarmKey(path string) (key pnet.PSK, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+
+	key, err = pnet.DecodeV1PSK(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid swarm key: %w", path, err)
+	}
+	return key, nil
+}
+
 func (i *IpfsArchive) Stop() error {
 	return i.db.Close()
 }
@@ -0,0 +1,245 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+func newTestIpfsArchive(t *testing.T) *IpfsArchive {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	a, err := NewIpfsArchive(db, IpfsPeerConfig{Offline: true})
+	require.NoError(t, err)
+	return a
+}
+
+// blockCount returns the number of blocks stored by the peer of a.
+func blockCount(t *testing.T, a *IpfsArchive) int {
+	keys, err := a.ipfs.BlockStore().AllKeysChan(context.Background())
+	require.NoError(t, err)
+	count := 0
+	for range keys {
+		count++
+	}
+	return count
+}
+
+func TestIpfsArchive(t *testing.T) {
+	require := require.New(t)
+
+	a := newTestIpfsArchive(t)
+	// large enough to be split into several blocks
+	data := bytes.Repeat([]byte("jackal "), 100000)
+
+	written, err := a.WriteFileToDisk(bytes.NewReader(data), "jklf1a")
+	require.NoError(err)
+	require.EqualValues(len(data), written)
+	require.False(a.FileExist("jklf1a")) // FileExist is true for missing files
+	require.True(a.FileExist("jklf1b"))
+
+	file, err := a.RetrieveFile("jklf1a")
+	require.NoError(err)
+	_, err = file.Seek(int64(len(data)-10), io.SeekStart)
+	require.NoError(err)
+	tail, err := io.ReadAll(file)
+	require.NoError(err)
+	require.Equal(data[len(data)-10:], tail)
+	require.NoError(file.Close())
+
+	blockSize := int64(300000)
+	piece, err := a.GetPiece("jklf1a", 1, blockSize)
+	require.NoError(err)
+	require.Equal(data[blockSize:2*blockSize], piece)
+	piece, err = a.GetPiece("jklf1a", 2, blockSize)
+	require.NoError(err)
+	require.Equal(data[2*blockSize:], piece)
+	_, err = a.GetPiece("jklf1a", 3, blockSize)
+	require.ErrorIs(err, io.EOF)
+
+	_, err = a.RetrieveFile("jklf1b")
+	require.ErrorIs(err, os.ErrNotExist)
+
+	tree, err := merkletree.NewUsing([][]byte{{1}, {2}}, sha3.New512(), false)
+	require.NoError(err)
+	require.NoError(a.WriteTreeToDisk("jklf1a", tree))
+	got, err := a.RetrieveTree("jklf1a")
+	require.NoError(err)
+	require.Equal(tree.Root(), got.Root())
+	_, err = a.RetrieveTreeData("jklf1b")
+	require.ErrorIs(err, os.ErrNotExist)
+
+	require.NoError(a.Delete("jklf1a"))
+	require.True(a.FileExist("jklf1a"))
+	_, err = a.RetrieveTree("jklf1a")
+	require.ErrorIs(err, os.ErrNotExist)
+	require.Zero(blockCount(t, a))
+
+	require.NoError(a.Delete("jklf1a"))
+}
+
+func TestIpfsArchiveSharedBlocks(t *testing.T) {
+	require := require.New(t)
+
+	a := newTestIpfsArchive(t)
+	data := bytes.Repeat([]byte{7}, 1<<20)
+
+	_, err := a.WriteFileToDisk(bytes.NewReader(data), "jklf1a")
+	require.NoError(err)
+	blocks := blockCount(t, a)
+
+	stage, written, err := a.StageFile(bytes.NewReader(data))
+	require.NoError(err)
+	require.EqualValues(len(data), written)
+	require.NoError(a.CommitFile(stage, "jklf1b"))
+	require.Equal(blocks, blockCount(t, a))
+
+	// the blocks are still used by jklf1b
+	require.NoError(a.Delete("jklf1a"))
+	file, err := a.RetrieveFile("jklf1b")
+	require.NoError(err)
+	got, err := io.ReadAll(file)
+	require.NoError(err)
+	require.Equal(data, got)
+	require.NoError(file.Close())
+
+	stage, _, err = a.StageFile(bytes.NewReader([]byte("discarded")))
+	require.NoError(err)
+	require.NoError(a.DiscardFile(stage))
+	require.Equal(blocks, blockCount(t, a))
+
+	// overwriting a fid releases the old data
+	_, err = a.WriteFileToDisk(bytes.NewReader([]byte("new")), "jklf1b")
+	require.NoError(err)
+	require.Equal(1, blockCount(t, a))
+}
+
+func TestIpfsArchiveAddDuringGarbageCollection(t *testing.T) {
+	require := require.New(t)
+
+	a := newTestIpfsArchive(t)
+	data := bytes.Repeat([]byte{3}, 1<<20)
+
+	collected := make(chan error, 1)
+	written, err := a.add(bytes.NewReader(data), func(c cid.Cid) error {
+		go func() {
+			_, err := a.CollectGarbage(context.Background())
+			collected <- err
+		}()
+
+		// garbage collection waits until the root is recorded
+		select {
+		case err := <-collected:
+			return errors.Join(errors.New("garbage collected before the root was recorded"), err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		_, err := a.recordFid("jklf1gc", c)
+		return err
+	})
+	require.NoError(err)
+	require.EqualValues(len(data), written)
+	require.NoError(<-collected)
+
+	file, err := a.RetrieveFile("jklf1gc")
+	require.NoError(err)
+	got, err := io.ReadAll(file)
+	require.NoError(err)
+	require.Equal(data, got)
+	require.NoError(file.Close())
+
+	// the blocks are released if the root can't be recorded
+	_, err = a.add(bytes.NewReader([]byte("unrecorded")), func(c cid.Cid) error {
+		return os.ErrPermission
+	})
+	require.ErrorIs(err, os.ErrPermission)
+	removed, err := a.CollectGarbage(context.Background())
+	require.NoError(err)
+	require.Zero(removed)
+}
+
+func TestLoadOrCreatePeerKey(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "config", "ipfs_key")
+	key, err := LoadOrCreatePeerKey(path)
+	require.NoError(err)
+
+	// the peer ID survives a restart
+	loaded, err := LoadOrCreatePeerKey(path)
+	require.NoError(err)
+	require.True(key.Equals(loaded))
+
+	stat, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0o600), stat.Mode().Perm())
+
+	require.NoError(os.WriteFile(path, []byte("not a key"), 0o600))
+	_, err = LoadOrCreatePeerKey(path)
+	require.Error(err)
+}
+
+func TestLoadSwarmKey(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "swarm.key")
+	hexKey := strings.Repeat("0f", 32)
+	require.NoError(os.WriteFile(valid, []byte("/key/swarm/psk/1.0.0/\n/base16/\n"+hexKey+"\n"), 0o600))
+
+	key, err := LoadSwarmKey(valid)
+	require.NoError(err)
+	require.Equal(hexKey, hex.EncodeToString(key))
+
+	invalid := filepath.Join(dir, "invalid.key")
+	require.NoError(os.WriteFile(invalid, []byte(hexKey), 0o600))
+	_, err = LoadSwarmKey(invalid)
+	require.Error(err)
+
+	_, err = LoadSwarmKey(filepath.Join(dir, "missing.key"))
+	require.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestIpfsArchiveLegacyFiles(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	a := newTestIpfsArchive(t)
+	legacy := func(fid, data string) {
+		_, err := a.WriteFileToDisk(bytes.NewReader([]byte(data)), fid)
+		require.NoError(err)
+		// older versions did not count references
+		require.NoError(a.db.DropPrefix([]byte("ref/"), pinKey(fid)))
+	}
+	legacy("jklf1a", "a")
+	legacy("jklf1b", "b")
+
+	// blocks without references are left for the garbage collection
+	require.NoError(a.Delete("jklf1a"))
+	require.Equal(2, blockCount(t, a))
+	removed, err := a.CollectGarbage(ctx)
+	require.NoError(err)
+	require.Equal(1, removed)
+	require.False(a.FileExist("jklf1b"))
+
+	// pinned files release their blocks like new ones
+	require.NoError(a.Pin(ctx, "jklf1b"))
+	require.NoError(a.Delete("jklf1b"))
+	require.Zero(blockCount(t, a))
+
+	require.ErrorIs(a.Pin(ctx, "jklf1b"), os.ErrNotExist)
+}
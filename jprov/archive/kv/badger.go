@@ -0,0 +1,145 @@
+package kv
+
+import (
+	"errors"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+type badgerDB struct {
+	db *badger.DB
+}
+
+func openBadger(path string) (*badgerDB, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		return nil, err
+	}
+	return &badgerDB{db: db}, nil
+}
+
+func (b *badgerDB) Get(key []byte) (value []byte, err error) {
+	err = b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (b *badgerDB) Has(key []byte) (bool, error) {
+	err := b.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *badgerDB) Put(key []byte, value []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+func (b *badgerDB) Delete(key []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+// Write applies batch in one transaction, batches that don't fit into a
+// transaction fail with badger.ErrTxnTooBig.
+func (b *badgerDB) Write(batch *Batch, sync bool) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
+		for _, op := range batch.ops {
+			var err error
+			if op.delete {
+				err = txn.Delete(op.key)
+			} else {
+				err = txn.Set(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || !sync {
+		return err
+	}
+	return b.db.Sync()
+}
+
+func (b *badgerDB) NewIterator(prefix []byte) Iterator {
+	txn := b.db.NewTransaction(false)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	return &badgerIterator{txn: txn, iter: txn.NewIterator(opts)}
+}
+
+func (b *badgerDB) Close() error {
+	return b.db.Close()
+}
+
+type badgerIterator struct {
+	txn      *badger.Txn
+	iter     *badger.Iterator
+	started  bool
+	released bool
+	value    []byte
+	err      error
+}
+
+func (i *badgerIterator) Next() bool {
+	if i.err != nil || i.released {
+		return false
+	}
+	if i.started {
+		i.iter.Next()
+	} else {
+		i.iter.Rewind()
+		i.started = true
+	}
+	if !i.iter.Valid() {
+		return false
+	}
+
+	i.value, i.err = i.iter.Item().ValueCopy(i.value[:0])
+	return i.err == nil
+}
+
+func (i *badgerIterator) Key() []byte {
+	if !i.started || i.released || !i.iter.Valid() {
+		return nil
+	}
+	return i.iter.Item().Key()
+}
+
+func (i *badgerIterator) Value() []byte {
+	if !i.started || i.released || !i.iter.Valid() {
+		return nil
+	}
+	return i.value
+}
+
+func (i *badgerIterator) Error() error {
+	return i.err
+}
+
+func (i *badgerIterator) Release() {
+	if i.released {
+		return
+	}
+	i.released = true
+	i.iter.Close()
+	i.txn.Discard()
+}
@@ -0,0 +1,220 @@
+// Package kv is the key-value store the archive and downtime databases are
+// kept in. The stores differ in their engine, which is chosen when a
+// database is created and detected when it is opened again.
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	LevelDB = "leveldb"
+	Badger  = "badger"
+	Pebble  = "pebble"
+
+	// copyBatchSize is the number of entries copied in one batch
+	copyBatchSize = 10000
+)
+
+var Backends = []string{LevelDB, Badger, Pebble}
+
+var (
+	ErrNotFound        = errors.New("key not found")
+	ErrClosed          = errors.New("database is closed")
+	ErrUnknownBackend  = errors.New("unknown database backend")
+	ErrBackendMismatch = errors.New("database uses another backend")
+)
+
+type Store interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Write applies all changes of batch at once, sync waits until they
+	// are on disk.
+	Write(batch *Batch, sync bool) error
+	// NewIterator iterates over the keys starting with prefix in order.
+	// Writes made while iterating are not seen.
+	NewIterator(prefix []byte) Iterator
+	Close() error
+}
+
+// Iterator is positioned before the first key, the key and value are only
+// valid until the next call of Next.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
+}
+
+type op struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Batch collects changes that are written together.
+type Batch struct {
+	ops []op
+}
+
+func (b *Batch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, op{key: bytes.Clone(key), value: bytes.Clone(value)})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, op{key: bytes.Clone(key), delete: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Open opens the database at path with backend, it is created if it doesn't
+// exist. An empty backend opens the database with the backend it was created
+// with, new databases use LevelDB.
+func Open(backend string, path string) (Store, error) {
+	existing, err := Detect(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case backend == "" && existing == "":
+		backend = LevelDB
+	case backend == "":
+		backend = existing
+	case existing != "" && existing != backend:
+		return nil, fmt.Errorf("%w: %s is a %s database, convert it with `jprovd data convert-db %s`", ErrBackendMismatch, path, existing, backend)
+	}
+
+	switch backend {
+	case LevelDB:
+		return openLevelDB(path)
+	case Badger:
+		return openBadger(path)
+	case Pebble:
+		return openPebble(path)
+	default:
+		return nil, fmt.Errorf("%w: %s, use one of %v", ErrUnknownBackend, backend, Backends)
+	}
+}
+
+// Detect returns the backend of the database at path or an empty string if
+// there is none.
+func Detect(path string) (string, error) {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	// pebble and leveldb both keep a CURRENT file
+	switch {
+	case slices.Contains(names, "KEYREGISTRY"):
+		return Badger, nil
+	case slices.ContainsFunc(names, func(name string) bool { return strings.HasPrefix(name, "OPTIONS-") }):
+		return Pebble, nil
+	case slices.Contains(names, "CURRENT"):
+		return LevelDB, nil
+	case len(names) == 0:
+		return "", nil
+	default:
+		return "", fmt.Errorf("%w: no database found in %s", ErrUnknownBackend, path)
+	}
+}
+
+// Copy writes all entries of src to dst and returns their number.
+func Copy(dst Store, src Store) (copied int, err error) {
+	iter := src.NewIterator(nil)
+	defer iter.Release()
+
+	batch := new(Batch)
+	for iter.Next() {
+		batch.Put(iter.Key(), iter.Value())
+		copied++
+
+		if batch.Len() >= copyBatchSize {
+			err = dst.Write(batch, false)
+			if err != nil {
+				return copied, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return copied, err
+	}
+	return copied, dst.Write(batch, true)
+}
+
+// Convert copies the database at path to a new one with backend, which
+// replaces it. The old database is kept next to it at backup, it is empty if
+// the database already uses backend or doesn't exist.
+func Convert(path string, backend string) (backup string, copied int, err error) {
+	if !slices.Contains(Backends, backend) {
+		return "", 0, fmt.Errorf("%w: %s, use one of %v", ErrUnknownBackend, backend, Backends)
+	}
+	from, err := Detect(path)
+	if err != nil || from == "" || from == backend {
+		return "", 0, err
+	}
+
+	backup = path + "." + from
+	_, err = os.Stat(backup)
+	if err == nil {
+		return "", 0, fmt.Errorf("%s already exists, remove it to convert %s again", backup, path)
+	}
+
+	converted := path + ".convert"
+	err = os.RemoveAll(converted)
+	if err != nil {
+		return "", 0, err
+	}
+	copied, err = copyDB(converted, backend, path, from)
+	if err != nil {
+		return "", 0, errors.Join(err, os.RemoveAll(converted))
+	}
+
+	err = os.Rename(path, backup)
+	if err != nil {
+		return "", 0, errors.Join(err, os.RemoveAll(converted))
+	}
+	return backup, copied, os.Rename(converted, path)
+}
+
+func copyDB(dstPath string, dstBackend string, srcPath string, srcBackend string) (copied int, err error) {
+	src, err := Open(srcBackend, srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		err = errors.Join(err, src.Close())
+	}()
+
+	dst, err := Open(dstBackend, dstPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		err = errors.Join(err, dst.Close())
+	}()
+
+	return Copy(dst, src)
+}
@@ -0,0 +1,187 @@
+package kv_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive/kv"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T, backend string, path string) kv.Store {
+	db, err := kv.Open(backend, path)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// entries returns all entries of db starting with prefix.
+func entries(t *testing.T, db kv.Store, prefix string) map[string]string {
+	iter := db.NewIterator([]byte(prefix))
+	defer iter.Release()
+
+	found := make(map[string]string)
+	var keys []string
+	for iter.Next() {
+		found[string(iter.Key())] = string(iter.Value())
+		keys = append(keys, string(iter.Key()))
+	}
+	require.NoError(t, iter.Error())
+	require.IsIncreasing(t, keys)
+	return found
+}
+
+func TestStore(t *testing.T) {
+	for _, backend := range kv.Backends {
+		t.Run(backend, func(t *testing.T) {
+			require := require.New(t)
+
+			path := filepath.Join(t.TempDir(), "db")
+			db := openStore(t, backend, path)
+
+			_, err := db.Get([]byte("a/1"))
+			require.ErrorIs(err, kv.ErrNotFound)
+			has, err := db.Has([]byte("a/1"))
+			require.NoError(err)
+			require.False(has)
+
+			require.NoError(db.Put([]byte("a/1"), []byte("one")))
+			require.NoError(db.Put([]byte("empty"), nil))
+			value, err := db.Get([]byte("a/1"))
+			require.NoError(err)
+			require.Equal("one", string(value))
+			has, err = db.Has([]byte("empty"))
+			require.NoError(err)
+			require.True(has)
+
+			batch := new(kv.Batch)
+			key := []byte("a/2")
+			batch.Put(key, []byte("two"))
+			key[2] = '3' // the batch keeps its own copy
+			batch.Put([]byte("b/1"), []byte("three"))
+			batch.Delete([]byte("empty"))
+			require.Equal(3, batch.Len())
+			require.NoError(db.Write(batch, true))
+
+			require.Equal(map[string]string{"a/1": "one", "a/2": "two"}, entries(t, db, "a/"))
+			require.Len(entries(t, db, ""), 3)
+
+			// writes made while iterating are not seen
+			iter := db.NewIterator([]byte("a/"))
+			require.NoError(db.Put([]byte("a/0"), []byte("zero")))
+			require.NoError(db.Delete([]byte("a/2")))
+			count := 0
+			for iter.Next() {
+				count++
+			}
+			require.NoError(iter.Error())
+			iter.Release()
+			require.Equal(2, count)
+
+			require.NoError(db.Close())
+			detected, err := kv.Detect(path)
+			require.NoError(err)
+			require.Equal(backend, detected)
+
+			// the backend of existing databases is detected
+			db = openStore(t, "", path)
+			require.Equal(map[string]string{"a/0": "zero", "a/1": "one"}, entries(t, db, "a/"))
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	detected, err := kv.Detect(filepath.Join(dir, "missing"))
+	require.NoError(err)
+	require.Empty(detected)
+
+	// new databases use leveldb
+	path := filepath.Join(dir, "db")
+	db := openStore(t, "", path)
+	require.NoError(db.Close())
+	detected, err = kv.Detect(path)
+	require.NoError(err)
+	require.Equal(kv.LevelDB, detected)
+
+	_, err = kv.Open(kv.Pebble, path)
+	require.ErrorIs(err, kv.ErrBackendMismatch)
+
+	_, err = kv.Open("sqlite", filepath.Join(dir, "other"))
+	require.ErrorIs(err, kv.ErrUnknownBackend)
+
+	unknown := filepath.Join(dir, "unknown")
+	require.NoError(os.MkdirAll(unknown, os.ModePerm))
+	require.NoError(os.WriteFile(filepath.Join(unknown, "file"), nil, 0o600))
+	_, err = kv.Open("", unknown)
+	require.ErrorIs(err, kv.ErrUnknownBackend)
+}
+
+func TestCopy(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	src := openStore(t, kv.LevelDB, filepath.Join(dir, kv.LevelDB))
+	batch := new(kv.Batch)
+	expected := make(map[string]string)
+	for i := 0; i < 25000; i++ {
+		key := filepath.Join("c", string(rune('a'+i%26)), string(rune(i)))
+		batch.Put([]byte(key), []byte(key))
+		expected[key] = key
+	}
+	require.NoError(src.Write(batch, false))
+
+	for _, backend := range []string{kv.Badger, kv.Pebble} {
+		dst := openStore(t, backend, filepath.Join(dir, backend))
+		copied, err := kv.Copy(dst, src)
+		require.NoError(err)
+		require.Equal(len(expected), copied)
+		require.Equal(expected, entries(t, dst, ""))
+	}
+}
+
+func TestConvert(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "archivedb")
+	db, err := kv.Open(kv.LevelDB, path)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("c/cid0"), []byte("fid0")))
+	require.NoError(db.Close())
+
+	_, _, err = kv.Convert(path, "sqlite")
+	require.ErrorIs(err, kv.ErrUnknownBackend)
+
+	backup, copied, err := kv.Convert(path, kv.Pebble)
+	require.NoError(err)
+	require.Equal(1, copied)
+	require.Equal(path+".leveldb", backup)
+	require.NoDirExists(path + ".convert")
+
+	detected, err := kv.Detect(path)
+	require.NoError(err)
+	require.Equal(kv.Pebble, detected)
+	detected, err = kv.Detect(backup)
+	require.NoError(err)
+	require.Equal(kv.LevelDB, detected)
+
+	// converting to the same backend does nothing
+	backup, copied, err = kv.Convert(path, kv.Pebble)
+	require.NoError(err)
+	require.Empty(backup)
+	require.Zero(copied)
+
+	// the backup of the first conversion is not overwritten
+	_, _, err = kv.Convert(path, kv.LevelDB)
+	require.NoError(err)
+	_, _, err = kv.Convert(path, kv.Badger)
+	require.Error(err)
+
+	db = openStore(t, "", path)
+	value, err := db.Get([]byte("c/cid0"))
+	require.NoError(err)
+	require.Equal("fid0", string(value))
+}
@@ -0,0 +1,61 @@
+package kv
+
+import (
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type levelDB struct {
+	db *leveldb.DB
+}
+
+func openLevelDB(path string) (*levelDB, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDB{db: db}, nil
+}
+
+func (l *levelDB) Get(key []byte) ([]byte, error) {
+	value, err := l.db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (l *levelDB) Has(key []byte) (bool, error) {
+	return l.db.Has(key, nil)
+}
+
+func (l *levelDB) Put(key []byte, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *levelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *levelDB) Write(batch *Batch, sync bool) error {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	return l.db.Write(b, &opt.WriteOptions{Sync: sync})
+}
+
+func (l *levelDB) NewIterator(prefix []byte) Iterator {
+	return l.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (l *levelDB) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,176 @@
+package kv
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// pebbleDB returns ErrClosed after it was closed, pebble panics instead.
+type pebbleDB struct {
+	db     *pebble.DB
+	closed atomic.Bool
+}
+
+// pebbleLogger only logs fatal errors, pebble logs every recovered WAL.
+type pebbleLogger struct{}
+
+func (pebbleLogger) Infof(format string, args ...interface{}) {}
+
+func (pebbleLogger) Fatalf(format string, args ...interface{}) {
+	pebble.DefaultLogger.Fatalf(format, args...)
+}
+
+func openPebble(path string) (*pebbleDB, error) {
+	db, err := pebble.Open(path, &pebble.Options{Logger: pebbleLogger{}})
+	if err != nil {
+		return nil, err
+	}
+	return &pebbleDB{db: db}, nil
+}
+
+func (p *pebbleDB) Get(key []byte) (value []byte, err error) {
+	if p.closed.Load() {
+		return nil, ErrClosed
+	}
+	data, closer, err := p.db.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, closer.Close())
+	}()
+
+	// data is only valid until closer is closed
+	return append([]byte{}, data...), nil
+}
+
+func (p *pebbleDB) Has(key []byte) (bool, error) {
+	if p.closed.Load() {
+		return false, ErrClosed
+	}
+	_, closer, err := p.db.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, closer.Close()
+}
+
+func (p *pebbleDB) Put(key []byte, value []byte) error {
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	return p.db.Set(key, value, pebble.NoSync)
+}
+
+func (p *pebbleDB) Delete(key []byte) error {
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	return p.db.Delete(key, pebble.NoSync)
+}
+
+func (p *pebbleDB) Write(batch *Batch, sync bool) error {
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	b := p.db.NewBatch()
+	defer b.Close()
+
+	for _, op := range batch.ops {
+		var err error
+		if op.delete {
+			err = b.Delete(op.key, nil)
+		} else {
+			err = b.Set(op.key, op.value, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	opts := pebble.NoSync
+	if sync {
+		opts = pebble.Sync
+	}
+	return b.Commit(opts)
+}
+
+func (p *pebbleDB) NewIterator(prefix []byte) Iterator {
+	if p.closed.Load() {
+		return &pebbleIterator{err: ErrClosed}
+	}
+	opts := new(pebble.IterOptions)
+	if len(prefix) > 0 {
+		r := util.BytesPrefix(prefix)
+		opts.LowerBound, opts.UpperBound = r.Start, r.Limit
+	}
+	iter, err := p.db.NewIter(opts)
+	return &pebbleIterator{iter: iter, err: err}
+}
+
+func (p *pebbleDB) Close() error {
+	if p.closed.Swap(true) {
+		return ErrClosed
+	}
+	return p.db.Close()
+}
+
+type pebbleIterator struct {
+	iter    *pebble.Iterator
+	started bool
+	err     error
+}
+
+func (i *pebbleIterator) Next() bool {
+	if i.err != nil || i.iter == nil {
+		return false
+	}
+	if i.started {
+		return i.iter.Next()
+	}
+	i.started = true
+	return i.iter.First()
+}
+
+func (i *pebbleIterator) Key() []byte {
+	if !i.started || i.iter == nil || !i.iter.Valid() {
+		return nil
+	}
+	return i.iter.Key()
+}
+
+func (i *pebbleIterator) Value() []byte {
+	if !i.started || i.iter == nil || !i.iter.Valid() {
+		return nil
+	}
+	value, err := i.iter.ValueAndErr()
+	if err != nil {
+		i.err = err
+		return nil
+	}
+	return value
+}
+
+func (i *pebbleIterator) Error() error {
+	if i.err != nil || i.iter == nil {
+		return i.err
+	}
+	return i.iter.Error()
+}
+
+func (i *pebbleIterator) Release() {
+	if i.iter == nil {
+		return
+	}
+	i.err = errors.Join(i.err, i.iter.Close())
+	i.iter = nil
+}
@@ -0,0 +1,164 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files used to be stored flat as storage/<fid>, which gets slow once
+// millions of directories share the storage directory. New files are stored
+// in the sharded layout of ShardedPathFactory and HybridCellArchive moves the
+// flat directories over while the provider keeps running.
+
+// directories are listed in batches so the storage directory is never read
+// into memory at once
+const readDirBatch = 1024
+
+// WalkStorage calls fn for every file directory under rootDir/storage, in
+// both the flat and the sharded layout. sharded tells in which layout fid was
+// found. A fid can be reported twice while it is being migrated.
+func WalkStorage(rootDir string, fn func(fid string, sharded bool) error) error {
+	storage := filepath.Join(rootDir, "storage")
+
+	return readDirBatches(storage, func(entry os.DirEntry) error {
+		if !entry.IsDir() {
+			return nil
+		}
+		if !IsShardDir(entry.Name()) {
+			return fn(entry.Name(), false)
+		}
+
+		first := filepath.Join(storage, entry.Name())
+		return readDirBatches(first, func(second os.DirEntry) error {
+			if !second.IsDir() || !IsShardDir(second.Name()) {
+				return nil
+			}
+			return readDirBatches(filepath.Join(first, second.Name()), func(file os.DirEntry) error {
+				if !file.IsDir() {
+					return nil
+				}
+				return fn(file.Name(), true)
+			})
+		})
+	})
+}
+
+// readDirBatches calls fn for every entry of dir. A missing dir is empty.
+func readDirBatches(dir string, fn func(os.DirEntry) error) (err error) {
+	d, err := os.Open(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, d.Close())
+	}()
+
+	for {
+		entries, err := d.ReadDir(readDirBatch)
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// MigrateFlatLayout moves every file directory of the flat layout to the
+// sharded layout and returns how many were moved. It is safe to run while the
+// archive is in use since each directory is moved with a single rename.
+// Directories that still hold blocks of the legacy multi cell layout are left
+// alone until they are glued by the migrate command.
+func (h *HybridCellArchive) MigrateFlatLayout() (moved int, err error) {
+	var fids []string
+	err = WalkStorage(h.rootDir, func(fid string, sharded bool) error {
+		if !sharded {
+			fids = append(fids, fid)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, fid := range fids {
+		ok, err := h.migrateFid(fid)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func (h *HybridCellArchive) migrateFid(fid string) (bool, error) {
+	flat := h.flatPathFactory.FileDir(fid)
+
+	_, err := os.Stat(filepath.Join(flat, "0.jkl"))
+	if err == nil {
+		// legacy blocks are only read from the flat layout
+		return false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	sharded := h.pathFactory.FileDir(fid)
+	err = os.MkdirAll(filepath.Dir(sharded), os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(sharded)
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.Rename(flat, sharded)
+		return err == nil, err
+	} else if err != nil {
+		return false, err
+	}
+
+	// both exist if a write raced with an earlier migration, the files are
+	// content addressed so a copy that is in both is the same
+	entries, err := os.ReadDir(flat)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		src := filepath.Join(flat, entry.Name())
+		dst := filepath.Join(sharded, entry.Name())
+
+		_, err := os.Stat(dst)
+		if err == nil {
+			err = os.RemoveAll(src)
+		} else if errors.Is(err, os.ErrNotExist) {
+			err = os.Rename(src, dst)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = os.Remove(flat)
+	return err == nil, err
+}
+
+// FindFileDir returns the directory of fid under rootDir in the layout it is
+// stored in. Missing files are reported in the flat layout.
+func FindFileDir(rootDir, fid string) string {
+	sharded := NewShardedPathFactory(rootDir).FileDir(fid)
+	if _, err := os.Stat(sharded); err == nil {
+		return sharded
+	}
+	return NewSingleCellPathFactory(rootDir).FileDir(fid)
+}
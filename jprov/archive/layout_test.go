@@ -0,0 +1,139 @@
+package archive_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+func TestShardedPathFactory(t *testing.T) {
+	require := require.New(t)
+
+	p := archive.NewShardedPathFactory("root")
+	dir := p.FileDir("jklf1test")
+
+	// storage/<first>/<second>/<fid>
+	rel, err := filepath.Rel(filepath.Join("root", "storage"), dir)
+	require.NoError(err)
+	first, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	second, fid, _ := strings.Cut(rest, "/")
+	require.True(archive.IsShardDir(first))
+	require.True(archive.IsShardDir(second))
+	require.Equal("jklf1test", fid)
+
+	require.Equal(filepath.Join(dir, "jklf1test.jkl"), p.FilePath("jklf1test"))
+	require.Equal(filepath.Join(dir, "jklf1test.tree"), p.TreePath("jklf1test"))
+
+	// the same fid always lands in the same shard
+	require.Equal(dir, archive.NewShardedPathFactory("root").FileDir("jklf1test"))
+
+	require.False(archive.IsShardDir("jklf1test"))
+	require.False(archive.IsShardDir("AB"))
+	require.False(archive.IsShardDir("zz"))
+}
+
+// writeFlatFile stores fid in the flat layout of SingleCellArchive
+func writeFlatFile(t *testing.T, rootDir, fid string, data []byte) {
+	flat := archive.NewSingleCellArchive(rootDir)
+	_, err := flat.WriteFileToDisk(bytes.NewReader(data), fid)
+	require.NoError(t, err)
+
+	tree, err := merkletree.NewUsing([][]byte{data}, sha3.New512(), false)
+	require.NoError(t, err)
+	require.NoError(t, flat.WriteTreeToDisk(fid, tree))
+}
+
+func TestHybridCellArchiveMigrateFlatLayout(t *testing.T) {
+	require := require.New(t)
+
+	rootDir := t.TempDir()
+	hybrid := archive.NewHybridCellArchive(rootDir)
+	flat := archive.NewSingleCellPathFactory(rootDir)
+	sharded := archive.NewShardedPathFactory(rootDir)
+	data := []byte("hello, world\n")
+
+	writeFlatFile(t, rootDir, "jklf1flat", data)
+
+	// an unfinished legacy file stays where it is
+	legacyDir := flat.FileDir("jklf1legacy")
+	require.NoError(os.MkdirAll(legacyDir, os.ModePerm))
+	require.NoError(os.WriteFile(filepath.Join(legacyDir, "0.jkl"), data, archive.FilePerm))
+
+	// new files go to the sharded layout
+	_, err := hybrid.WriteFileToDisk(bytes.NewReader(data), "jklf1new")
+	require.NoError(err)
+	require.FileExists(sharded.FilePath("jklf1new"))
+
+	// files are read from both layouts during the transition
+	for _, fid := range []string{"jklf1flat", "jklf1new"} {
+		require.False(hybrid.FileExist(fid))
+		piece, err := hybrid.GetPiece(fid, 1, 5)
+		require.NoError(err)
+		require.Equal(", wor", string(piece))
+	}
+	_, err = hybrid.RetrieveTree("jklf1flat")
+	require.NoError(err)
+
+	var fids []string
+	require.NoError(archive.WalkStorage(rootDir, func(fid string, _ bool) error {
+		fids = append(fids, fid)
+		return nil
+	}))
+	sort.Strings(fids)
+	require.Equal([]string{"jklf1flat", "jklf1legacy", "jklf1new"}, fids)
+
+	moved, err := hybrid.MigrateFlatLayout()
+	require.NoError(err)
+	require.Equal(1, moved)
+
+	require.NoDirExists(flat.FileDir("jklf1flat"))
+	require.FileExists(sharded.FilePath("jklf1flat"))
+	require.FileExists(sharded.TreePath("jklf1flat"))
+	require.DirExists(legacyDir)
+
+	file, err := hybrid.RetrieveFile("jklf1flat")
+	require.NoError(err)
+	got, err := io.ReadAll(file)
+	require.NoError(err)
+	require.NoError(file.Close())
+	require.Equal(data, got)
+
+	// running it again has nothing left to do
+	moved, err = hybrid.MigrateFlatLayout()
+	require.NoError(err)
+	require.Zero(moved)
+
+	require.NoError(hybrid.Delete("jklf1flat"))
+	require.True(hybrid.FileExist("jklf1flat"))
+}
+
+func TestHybridCellArchiveMigrateMerge(t *testing.T) {
+	require := require.New(t)
+
+	rootDir := t.TempDir()
+	hybrid := archive.NewHybridCellArchive(rootDir)
+	sharded := archive.NewShardedPathFactory(rootDir)
+	data := []byte("hello, world\n")
+
+	// a file that ended up in both layouts
+	writeFlatFile(t, rootDir, "jklf1both", data)
+	require.NoError(os.MkdirAll(sharded.FileDir("jklf1both"), os.ModePerm))
+	require.NoError(os.WriteFile(sharded.FilePath("jklf1both"), data, archive.FilePerm))
+
+	moved, err := hybrid.MigrateFlatLayout()
+	require.NoError(err)
+	require.Equal(1, moved)
+
+	require.NoDirExists(archive.NewSingleCellPathFactory(rootDir).FileDir("jklf1both"))
+	require.FileExists(sharded.FilePath("jklf1both"))
+	require.FileExists(sharded.TreePath("jklf1both"))
+}
@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive/kv"
+)
+
+// ContractMetadata is what the provider knows about a contract without
+// asking the chain. Fields that are unknown, for example of contracts that
+// were stored by older versions, are left empty.
+type ContractMetadata struct {
+	Cid        string `json:"cid"`
+	Fid        string `json:"fid"`
+	Signee     string `json:"signee,omitempty"`
+	FileSize   int64  `json:"file_size,omitempty"`
+	Merkle     string `json:"merkle,omitempty"`
+	StartBlock int64  `json:"start_block,omitempty"`
+	EndBlock   int64  `json:"end_block,omitempty"`
+	// ChunkSize is the size of the pieces the merkle tree was built from
+	ChunkSize int64        `json:"chunk_size,omitempty"`
+	LastProof *ProofResult `json:"last_proof,omitempty"`
+}
+
+// ProofResult is the outcome of the latest proof of a contract.
+type ProofResult struct {
+	Time time.Time `json:"time"`
+	// Chunk is the index of the piece that was proven
+	Chunk int64 `json:"chunk"`
+	// Height is the block the proof was included in, zero for attestations
+	// and failed proofs
+	Height   int64  `json:"height,omitempty"`
+	Attested bool   `json:"attested,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (p *ProofResult) Success() bool {
+	return p.Error == ""
+}
+
+func metadataKey(cid string) []byte {
+	return []byte(metadataPrefix + cid)
+}
+
+// GetMetadata returns the metadata of the contract cid. Contracts without a
+// record only have their cid and fid set.
+func (d *DoubleRefArchiveDB) GetMetadata(cid string) (ContractMetadata, error) {
+	fid, err := d.GetFid(cid)
+	if err != nil {
+		return ContractMetadata{}, err
+	}
+
+	var meta ContractMetadata
+	value, err := d.db.Get(metadataKey(cid))
+	if err != nil && !errors.Is(err, kv.ErrNotFound) {
+		return meta, err
+	}
+	if err == nil {
+		err = json.Unmarshal(value, &meta)
+		if err != nil {
+			return meta, err
+		}
+	}
+
+	meta.Cid = cid
+	meta.Fid = fid
+	return meta, nil
+}
+
+// UpdateMetadata changes the metadata of the contract cid with update.
+// Updates of the same database don't run concurrently, nothing is written if
+// the metadata didn't change.
+func (d *DoubleRefArchiveDB) UpdateMetadata(cid string, update func(meta *ContractMetadata)) error {
+	d.metadataLock.Lock()
+	defer d.metadataLock.Unlock()
+
+	meta, err := d.GetMetadata(cid)
+	if err != nil {
+		return err
+	}
+	old, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// the contract can't be moved to another cid or fid
+	fid := meta.Fid
+	update(&meta)
+	meta.Cid, meta.Fid = cid, fid
+
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(old, value) {
+		return nil
+	}
+	return d.db.Put(metadataKey(cid), value)
+}
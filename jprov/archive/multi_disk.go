@@ -0,0 +1,505 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	merkletree "github.com/wealdtech/go-merkletree"
+)
+
+var _ Archive = &MultiDiskArchive{}
+
+// DiskMode controls what a disk of a MultiDiskArchive is used for.
+type DiskMode string
+
+const (
+	// new files are placed on the disk
+	DiskReadWrite DiskMode = "rw"
+	// files on the disk are served but no new files are placed on it
+	DiskReadOnly DiskMode = "ro"
+	// files are moved off the disk when rebalancing so it can be removed
+	DiskDrain DiskMode = "drain"
+)
+
+// disks are rebalanced when the weighted free space of two disks differs by
+// more than this fraction
+const rebalanceThreshold = 0.1
+
+var ErrNoWritableDisk = errors.New("no disk accepts new files")
+
+type DiskConfig struct {
+	Root string
+	// Weight scales the free space of the disk when placing files,
+	// a disk with weight 2 gets files until it has half the free space of a
+	// disk with weight 1.
+	Weight int64
+	Mode   DiskMode
+}
+
+// ParseDiskConfig parses a disk given as path[:weight[:mode]]. The weight
+// defaults to 1 and the mode to rw.
+func ParseDiskConfig(s string) (DiskConfig, error) {
+	config := DiskConfig{Weight: 1, Mode: DiskReadWrite}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 || len(parts[0]) == 0 {
+		return config, fmt.Errorf("invalid disk %q, must be path[:weight[:mode]]", s)
+	}
+	config.Root = parts[0]
+
+	if len(parts) > 1 && len(parts[1]) > 0 {
+		weight, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || weight < 1 {
+			return config, fmt.Errorf("invalid weight of disk %q, must be a positive number", s)
+		}
+		config.Weight = weight
+	}
+
+	if len(parts) > 2 {
+		switch mode := DiskMode(parts[2]); mode {
+		case DiskReadWrite, DiskReadOnly, DiskDrain:
+			config.Mode = mode
+		default:
+			return config, fmt.Errorf("invalid mode of disk %q, must be rw, ro or drain", s)
+		}
+	}
+
+	return config, nil
+}
+
+type disk struct {
+	DiskConfig
+	archive *HybridCellArchive
+	free    func() (int64, error)
+}
+
+// score is the weighted free space used to place files
+func (d *disk) score(free int64) int64 {
+	return free * d.Weight
+}
+
+// MultiDiskArchive spreads files over the root directories of several disks.
+// Each disk is laid out like a HybridCellArchive. New files are placed on
+// the writable disk with the most weighted free space.
+//
+// The location of every file is kept in an index in memory. Files missing
+// from the index are looked up on every disk, so the index does not need to
+// survive restarts or be shared with other archives of the same disks.
+type MultiDiskArchive struct {
+	disks []*disk
+
+	mu    sync.RWMutex
+	index map[string]*disk
+}
+
+func NewMultiDiskArchive(configs []DiskConfig) (*MultiDiskArchive, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("multi disk archive needs at least one disk")
+	}
+
+	m := MultiDiskArchive{index: make(map[string]*disk)}
+	roots := make(map[string]bool)
+	for _, config := range configs {
+		root := filepath.Clean(config.Root)
+		if roots[root] {
+			return nil, fmt.Errorf("disk %s is configured twice", root)
+		}
+		roots[root] = true
+
+		m.disks = append(m.disks, &disk{
+			DiskConfig: config,
+			archive:    NewHybridCellArchive(root),
+			free:       statfsFree(root),
+		})
+	}
+
+	return &m, nil
+}
+
+// statfsFree returns the space available to unprivileged users on the
+// filesystem of dir.
+func statfsFree(dir string) func() (int64, error) {
+	return func() (int64, error) {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(dir, &stat)
+		if err != nil {
+			return 0, err
+		}
+		return int64(stat.Bavail) * int64(stat.Bsize), nil
+	}
+}
+
+// FreeSpace returns the free space of the disk the next file is placed on.
+// A file has to fit on one disk, the free space of all disks together would
+// admit files that can't be stored.
+func (m *MultiDiskArchive) FreeSpace() (int64, error) {
+	d, err := m.place(nil)
+	if errors.Is(err, ErrNoWritableDisk) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return d.free()
+}
+
+// place returns the writable disk with the most weighted free space, other
+// than the excluded one.
+func (m *MultiDiskArchive) place(exclude *disk) (*disk, error) {
+	var best *disk
+	var bestScore int64
+	for _, d := range m.disks {
+		if d.Mode != DiskReadWrite || d == exclude {
+			continue
+		}
+		free, err := d.free()
+		if err != nil {
+			return nil, err
+		}
+		if score := d.score(free); best == nil || score > bestScore {
+			best, bestScore = d, score
+		}
+	}
+	if best == nil {
+		return nil, ErrNoWritableDisk
+	}
+	return best, nil
+}
+
+// locate returns the disk that stores fid.
+func (m *MultiDiskArchive) locate(fid string) (*disk, error) {
+	m.mu.RLock()
+	d, ok := m.index[fid]
+	m.mu.RUnlock()
+	if ok {
+		return d, nil
+	}
+
+	for _, d := range m.disks {
+		if !d.archive.FileExist(fid) { // FileExist is true for missing files
+			m.setLocation(fid, d)
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", fid, os.ErrNotExist)
+}
+
+func (m *MultiDiskArchive) setLocation(fid string, d *disk) {
+	m.mu.Lock()
+	m.index[fid] = d
+	m.mu.Unlock()
+}
+
+// stagingDisk returns the disk a file was staged on
+func (m *MultiDiskArchive) stagingDisk(stage string) (*disk, error) {
+	for _, d := range m.disks {
+		rel, err := filepath.Rel(filepath.Join(d.archive.rootDir, stagingDir), stage)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not staged on any disk", stage)
+}
+
+func (m *MultiDiskArchive) WriteFileToDisk(data io.Reader, fid string) (written int64, err error) {
+	stage, written, err := m.StageFile(data)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.CommitFile(stage, fid)
+	if err != nil {
+		return 0, errors.Join(err, m.DiscardFile(stage))
+	}
+	return written, nil
+}
+
+func (m *MultiDiskArchive) GetPiece(fid string, index, blockSize int64) (block []byte, err error) {
+	d, err := m.locate(fid)
+	if err != nil {
+		return nil, err
+	}
+	return d.archive.GetPiece(fid, index, blockSize)
+}
+
+func (m *MultiDiskArchive) RetrieveFile(fid string) (data io.ReadSeekCloser, err error) {
+	d, err := m.locate(fid)
+	if err != nil {
+		return nil, err
+	}
+	return d.archive.RetrieveFile(fid)
+}
+
+func (m *MultiDiskArchive) FileExist(fid string) bool {
+	_, err := m.locate(fid)
+	return err != nil
+}
+
+func (m *MultiDiskArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) error {
+	return writeTree(m, fid, tree)
+}
+
+// WriteTreeData writes the tree next to the file, or to the disk the file
+// would be placed on if it was not written yet.
+func (m *MultiDiskArchive) WriteTreeData(fid string, data []byte) error {
+	d, err := m.locate(fid)
+	if err != nil {
+		d, err = m.place(nil)
+		if err != nil {
+			return err
+		}
+	}
+	return d.archive.WriteTreeData(fid, data)
+}
+
+func (m *MultiDiskArchive) RetrieveTree(fid string) (tree *merkletree.MerkleTree, err error) {
+	return retrieveTree(m, fid)
+}
+
+func (m *MultiDiskArchive) RetrieveTreeData(fid string) (data []byte, err error) {
+	d, err := m.locate(fid)
+	if err != nil {
+		return nil, err
+	}
+	return d.archive.RetrieveTreeData(fid)
+}
+
+func (m *MultiDiskArchive) Delete(fid string) error {
+	m.mu.Lock()
+	delete(m.index, fid)
+	m.mu.Unlock()
+
+	// a file is only on one disk, unless it was being moved
+	var err error
+	for _, d := range m.disks {
+		err = errors.Join(err, d.archive.Delete(fid))
+	}
+	return err
+}
+
+// StageFile stages data on the disk it will be placed on, so committing it
+// does not copy it between disks.
+func (m *MultiDiskArchive) StageFile(data io.Reader) (stage string, written int64, err error) {
+	d, err := m.place(nil)
+	if err != nil {
+		return "", 0, err
+	}
+	return d.archive.StageFile(data)
+}
+
+func (m *MultiDiskArchive) CommitFile(stage string, fid string) error {
+	d, err := m.stagingDisk(stage)
+	if err != nil {
+		return err
+	}
+
+	// a replaced copy can be on another disk
+	prev, err := m.locate(fid)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = d.archive.CommitFile(stage, fid)
+	if err != nil {
+		return err
+	}
+	m.setLocation(fid, d)
+
+	if prev != nil && prev != d {
+		return prev.archive.Delete(fid)
+	}
+	return nil
+}
+
+func (m *MultiDiskArchive) DiscardFile(stage string) error {
+	return os.Remove(stage)
+}
+
+// MigrateFlatLayout moves the files of every disk to the sharded layout.
+func (m *MultiDiskArchive) MigrateFlatLayout() (moved int, err error) {
+	for _, d := range m.disks {
+		n, err := d.archive.MigrateFlatLayout()
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// Rebalance moves all files off drained disks, then moves files between
+// writable disks until their weighted free space is about even, e.g. after a
+// disk was added. Read-only disks are left alone. It can run while the
+// archive is in use. Files that can't be moved are skipped for the rest of
+// the run and reported together in the returned error.
+func (m *MultiDiskArchive) Rebalance() (moved int, err error) {
+	failed := make(map[string]bool)
+	var errs []error
+	for _, d := range m.disks {
+		if d.Mode != DiskDrain {
+			continue
+		}
+		n, err := m.drain(d, failed)
+		moved += n
+		errs = append(errs, err)
+	}
+
+	// every pass evens out the emptiest and the fullest disk, the passes are
+	// bounded so rounding can't move files back and forth forever
+	for i := 1; i < len(m.disks); i++ {
+		n, err := m.balance(failed)
+		moved += n
+		errs = append(errs, err)
+		if n == 0 {
+			break
+		}
+	}
+	return moved, errors.Join(errs...)
+}
+
+func (m *MultiDiskArchive) drain(d *disk, failed map[string]bool) (moved int, err error) {
+	var errs []error
+	err = m.walkDisk(d, func(fid string) (bool, error) {
+		if failed[fid] {
+			return true, nil
+		}
+		dst, err := m.place(d)
+		if err != nil {
+			return false, err
+		}
+		err = m.move(fid, d, dst)
+		if err != nil {
+			failed[fid] = true
+			errs = append(errs, fmt.Errorf("failed to move %s off %s: %w", fid, d.Root, err))
+			return true, nil
+		}
+		moved++
+		return true, nil
+	})
+	return moved, errors.Join(append(errs, err)...)
+}
+
+// balance moves files from the writable disk with the least weighted free
+// space to the one with the most, until moving another file would tip the
+// balance the other way.
+func (m *MultiDiskArchive) balance(failed map[string]bool) (moved int, err error) {
+	var src, dst *disk
+	var srcFree, dstFree int64
+	for _, d := range m.disks {
+		if d.Mode != DiskReadWrite {
+			continue
+		}
+		free, err := d.free()
+		if err != nil {
+			return 0, err
+		}
+		if src == nil || d.score(free) < src.score(srcFree) {
+			src, srcFree = d, free
+		}
+		if dst == nil || d.score(free) > dst.score(dstFree) {
+			dst, dstFree = d, free
+		}
+	}
+	if src == dst {
+		return 0, nil
+	}
+	gap := dst.score(dstFree) - src.score(srcFree)
+	if float64(gap) <= rebalanceThreshold*float64(dst.score(dstFree)) {
+		return 0, nil
+	}
+
+	var errs []error
+	err = m.walkDisk(src, func(fid string) (bool, error) {
+		if failed[fid] {
+			return true, nil
+		}
+		size, err := m.fileSize(src, fid)
+		if err == nil && dst.score(dstFree-size) < src.score(srcFree+size) {
+			return false, nil
+		}
+		if err == nil {
+			err = m.move(fid, src, dst)
+		}
+		if err != nil {
+			failed[fid] = true
+			errs = append(errs, fmt.Errorf("failed to move %s off %s: %w", fid, src.Root, err))
+			return true, nil
+		}
+		moved++
+		srcFree += size
+		dstFree -= size
+		return true, nil
+	})
+	return moved, errors.Join(append(errs, err)...)
+}
+
+// walkDisk calls fn for every file on d until it returns false.
+func (m *MultiDiskArchive) walkDisk(d *disk, fn func(fid string) (bool, error)) error {
+	stop := errors.New("stop")
+	err := WalkStorage(d.archive.rootDir, func(fid string, _ bool) error {
+		next, err := fn(fid)
+		if err != nil {
+			return err
+		}
+		if !next {
+			return stop
+		}
+		return nil
+	})
+	if errors.Is(err, stop) {
+		return nil
+	}
+	return err
+}
+
+func (m *MultiDiskArchive) fileSize(d *disk, fid string) (size int64, err error) {
+	file, err := d.archive.RetrieveFile(fid)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+	return file.Seek(0, io.SeekEnd)
+}
+
+// move copies fid from src to dst and deletes it from src once it is
+// complete on dst. Reads are served from src until then.
+func (m *MultiDiskArchive) move(fid string, src, dst *disk) (err error) {
+	// files are moved as they are stored, they might be encrypted
+	tree, err := src.archive.RetrieveTreeData(fid)
+	if err != nil {
+		return err
+	}
+
+	file, err := src.archive.RetrieveFile(fid)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+
+	stage, _, err := dst.archive.StageFile(file)
+	if err != nil {
+		return err
+	}
+	err = dst.archive.CommitFile(stage, fid)
+	if err != nil {
+		return errors.Join(err, dst.archive.DiscardFile(stage))
+	}
+	err = dst.archive.WriteTreeData(fid, tree)
+	if err != nil {
+		return errors.Join(err, dst.archive.Delete(fid))
+	}
+
+	m.setLocation(fid, dst)
+	return src.archive.Delete(fid)
+}
@@ -0,0 +1,36 @@
+package archive_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiDiskIngestFile(t *testing.T) {
+	require := require.New(t)
+
+	// staging a file shifts the free space, trees must still follow the file
+	m := archive.SetupMultiDiskArchive(t, []int64{10000, 10000},
+		archive.DiskConfig{Weight: 1, Mode: archive.DiskReadWrite},
+		archive.DiskConfig{Weight: 1, Mode: archive.DiskReadWrite},
+	)
+
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprint(i)), 1000)
+		file, err := utils.IngestFile(m, bytes.NewReader(data), 100)
+		require.NoError(err)
+		require.NoError(file.Commit())
+
+		tree, err := m.RetrieveTree(file.Fid)
+		require.NoError(err)
+		require.Equal(file.Tree.Root(), tree.Root())
+
+		piece, err := m.GetPiece(file.Fid, 3, 100)
+		require.NoError(err)
+		require.Equal(data[300:400], piece)
+	}
+}
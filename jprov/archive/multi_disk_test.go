@@ -0,0 +1,221 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+// setupMultiDiskArchive creates an archive with a disk of the given size for
+// every config. The free space of a disk is its size minus the size of its
+// stored and staged files, merkle trees are not counted.
+func setupMultiDiskArchive(t *testing.T, sizes []int64, configs ...DiskConfig) *MultiDiskArchive {
+	for i := range configs {
+		configs[i].Root = t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(configs[i].Root, "storage"), os.ModePerm))
+	}
+	m, err := NewMultiDiskArchive(configs)
+	require.NoError(t, err)
+
+	for i, d := range m.disks {
+		root, size := d.Root, sizes[i]
+		d.free = func() (int64, error) {
+			used := int64(0)
+			err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || entry.IsDir() || filepath.Ext(path) == ".tree" {
+					return err
+				}
+				info, err := entry.Info()
+				used += info.Size()
+				return err
+			})
+			return size - used, err
+		}
+	}
+	return m
+}
+
+func writeMultiDiskFile(t *testing.T, m *MultiDiskArchive, fid string, size int) {
+	data := bytes.Repeat([]byte{'a'}, size)
+	_, err := m.WriteFileToDisk(bytes.NewReader(data), fid)
+	require.NoError(t, err)
+
+	tree, err := merkletree.NewUsing([][]byte{data}, sha3.New512(), false)
+	require.NoError(t, err)
+	require.NoError(t, m.WriteTreeToDisk(fid, tree))
+}
+
+func TestParseDiskConfig(t *testing.T) {
+	cases := map[string]struct {
+		disk      string
+		expConfig DiskConfig
+		fails     bool
+	}{
+		"path":        {disk: "/mnt/a", expConfig: DiskConfig{Root: "/mnt/a", Weight: 1, Mode: DiskReadWrite}},
+		"weight":      {disk: "/mnt/a:3", expConfig: DiskConfig{Root: "/mnt/a", Weight: 3, Mode: DiskReadWrite}},
+		"mode":        {disk: "/mnt/a::drain", expConfig: DiskConfig{Root: "/mnt/a", Weight: 1, Mode: DiskDrain}},
+		"all":         {disk: "/mnt/a:2:ro", expConfig: DiskConfig{Root: "/mnt/a", Weight: 2, Mode: DiskReadOnly}},
+		"no_path":     {disk: ":2", fails: true},
+		"zero_weight": {disk: "/mnt/a:0", fails: true},
+		"bad_mode":    {disk: "/mnt/a:1:wo", fails: true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			config, err := ParseDiskConfig(c.disk)
+			if c.fails {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expConfig, config)
+		})
+	}
+}
+
+func TestMultiDiskArchivePlacement(t *testing.T) {
+	require := require.New(t)
+
+	m := setupMultiDiskArchive(t, []int64{1000, 1000, 5000},
+		DiskConfig{Weight: 1, Mode: DiskReadWrite},
+		DiskConfig{Weight: 3, Mode: DiskReadWrite},
+		DiskConfig{Weight: 1, Mode: DiskReadOnly},
+	)
+
+	// the weighted free space of disk 1 stays ahead until it holds 2/3 of its space
+	for i := 0; i < 6; i++ {
+		writeMultiDiskFile(t, m, "jklf1file"+string(rune('a'+i)), 100)
+	}
+
+	onDisk := make(map[*disk]int)
+	for fid, d := range m.index {
+		onDisk[d]++
+		require.False(m.FileExist(fid))
+	}
+	require.Equal(map[*disk]int{m.disks[1]: 6}, onDisk)
+
+	// files must fit on the disk they are placed on
+	free, err := m.FreeSpace()
+	require.NoError(err)
+	require.EqualValues(1000-600, free)
+
+	// files are found again without the index
+	m.index = make(map[string]*disk)
+	piece, err := m.GetPiece("jklf1filea", 0, 10)
+	require.NoError(err)
+	require.Equal("aaaaaaaaaa", string(piece))
+	require.Equal(m.disks[1], m.index["jklf1filea"])
+
+	require.NoError(m.Delete("jklf1filea"))
+	require.True(m.FileExist("jklf1filea"))
+
+	// no disk left to write to
+	m.disks[0].Mode = DiskReadOnly
+	m.disks[1].Mode = DiskDrain
+	_, _, err = m.StageFile(bytes.NewReader(nil))
+	require.ErrorIs(err, ErrNoWritableDisk)
+}
+
+func TestMultiDiskArchiveReplace(t *testing.T) {
+	require := require.New(t)
+
+	m := setupMultiDiskArchive(t, []int64{1000, 1000},
+		DiskConfig{Weight: 1, Mode: DiskReadWrite},
+		DiskConfig{Weight: 1, Mode: DiskDrain},
+	)
+	_, err := m.disks[1].archive.WriteFileToDisk(bytes.NewReader([]byte("old")), "jklf1file")
+	require.NoError(err)
+
+	// a new copy of a file replaces the one on another disk
+	stage, _, err := m.StageFile(bytes.NewReader([]byte("new")))
+	require.NoError(err)
+	require.NoError(m.CommitFile(stage, "jklf1file"))
+	require.True(m.disks[1].archive.FileExist("jklf1file")) // FileExist is true for missing files
+
+	m.index = make(map[string]*disk)
+	piece, err := m.GetPiece("jklf1file", 0, 10)
+	require.NoError(err)
+	require.Equal("new", string(piece))
+}
+
+func TestMultiDiskArchiveRebalance(t *testing.T) {
+	require := require.New(t)
+
+	m := setupMultiDiskArchive(t, []int64{1000, 1000},
+		DiskConfig{Weight: 1, Mode: DiskReadWrite},
+		DiskConfig{Weight: 1, Mode: DiskReadOnly},
+	)
+	for i := 0; i < 8; i++ {
+		writeMultiDiskFile(t, m, "jklf1file"+string(rune('a'+i)), 100)
+	}
+
+	// a new disk was added
+	m.disks[1].Mode = DiskReadWrite
+	moved, err := m.Rebalance()
+	require.NoError(err)
+	require.Equal(4, moved)
+
+	for _, d := range m.disks {
+		free, err := d.free()
+		require.NoError(err)
+		require.EqualValues(600, free)
+	}
+
+	// drain the first disk so it can be removed
+	m.disks[0].Mode = DiskDrain
+	m.disks = append(m.disks, setupMultiDiskArchive(t, []int64{1000}, DiskConfig{Weight: 1, Mode: DiskReadWrite}).disks...)
+	moved, err = m.Rebalance()
+	require.NoError(err)
+	require.GreaterOrEqual(moved, 4)
+
+	free, err := m.disks[0].free()
+	require.NoError(err)
+	require.EqualValues(1000, free)
+
+	for i := 0; i < 8; i++ {
+		fid := "jklf1file" + string(rune('a'+i))
+		file, err := m.RetrieveFile(fid)
+		require.NoError(err)
+		data, err := io.ReadAll(file)
+		require.NoError(err)
+		require.NoError(file.Close())
+		require.Len(data, 100)
+
+		_, err = m.RetrieveTree(fid)
+		require.NoError(err)
+		require.NotEqual(m.disks[0], m.index[fid])
+	}
+}
+
+func TestMultiDiskArchiveRebalanceSkip(t *testing.T) {
+	require := require.New(t)
+
+	m := setupMultiDiskArchive(t, []int64{1000, 1000},
+		DiskConfig{Weight: 1, Mode: DiskReadWrite},
+		DiskConfig{Weight: 1, Mode: DiskReadOnly},
+	)
+	for i := 0; i < 4; i++ {
+		writeMultiDiskFile(t, m, "jklf1file"+string(rune('a'+i)), 100)
+	}
+	// a file without its tree can't be moved
+	_, err := m.WriteFileToDisk(bytes.NewReader([]byte("broken")), "jklf1broken")
+	require.NoError(err)
+
+	m.disks[0].Mode = DiskDrain
+	m.disks[1].Mode = DiskReadWrite
+	moved, err := m.Rebalance()
+	require.ErrorContains(err, "jklf1broken")
+	require.Equal(4, moved)
+
+	require.False(m.disks[0].archive.FileExist("jklf1broken"))
+	for i := 0; i < 4; i++ {
+		require.False(m.disks[1].archive.FileExist("jklf1file" + string(rune('a'+i))))
+	}
+}
@@ -0,0 +1,302 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	merkletree "github.com/wealdtech/go-merkletree"
+)
+
+var _ Archive = &ObjectStoreArchive{}
+
+type ObjectStoreConfig struct {
+	// Endpoint is the url of the S3 compatible store, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix is prepended to the key of every object in the bucket
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// ObjectStoreArchive stores files and merkle trees in a bucket of an S3
+// compatible object store. Objects use the same layout as the storage
+// directory of SingleCellArchive, so an existing storage directory can be
+// copied to the bucket as is.
+// Uploads are still staged on the local disk under rootDir until they are
+// committed.
+type ObjectStoreArchive struct {
+	rootDir     string
+	client      *s3Client
+	pathFactory *SingleCellPathFactory
+}
+
+func NewObjectStoreArchive(rootDir string, config ObjectStoreConfig) (*ObjectStoreArchive, error) {
+	client, err := newS3Client(config.Endpoint, config.Bucket, config.Region, config.AccessKey, config.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectStoreArchive{
+		rootDir:     rootDir,
+		client:      client,
+		pathFactory: NewSingleCellPathFactory(config.Prefix),
+	}, nil
+}
+
+func (o *ObjectStoreArchive) fileKey(fid string) string {
+	return filepath.ToSlash(o.pathFactory.FilePath(fid))
+}
+
+func (o *ObjectStoreArchive) treeKey(fid string) string {
+	return filepath.ToSlash(o.pathFactory.TreePath(fid))
+}
+
+func (o *ObjectStoreArchive) WriteFileToDisk(data io.Reader, fid string) (written int64, err error) {
+	// the size of an object must be known before it is sent
+	stage, written, err := o.StageFile(data)
+	if err != nil {
+		return 0, err
+	}
+
+	err = o.CommitFile(stage, fid)
+	if err != nil {
+		return 0, errors.Join(err, o.DiscardFile(stage))
+	}
+	return written, nil
+}
+
+// GetPiece fetches only the block at index with a ranged request.
+func (o *ObjectStoreArchive) GetPiece(fid string, index, blockSize int64) (block []byte, err error) {
+	start := index * blockSize
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+blockSize-1))
+
+	resp, err := o.client.do(http.MethodGet, o.fileKey(fid), header, nil, 0, "")
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.Status == http.StatusRequestedRangeNotSatisfiable {
+		// same as reading past the end of a file on disk
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, resp.Body.Close())
+	}()
+
+	body := io.Reader(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent {
+		// the store ignored the range and sent the whole object
+		_, err = io.CopyN(io.Discard, body, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err = io.ReadAll(io.LimitReader(body, blockSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(block) == 0 {
+		return nil, io.EOF
+	}
+	return block, nil
+}
+
+func (o *ObjectStoreArchive) RetrieveFile(fid string) (data io.ReadSeekCloser, err error) {
+	key := o.fileKey(fid)
+
+	resp, err := o.client.do(http.MethodHead, key, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("object store: invalid size of %s: %w", key, err)
+	}
+
+	return &objectReader{client: o.client, key: key, size: size}, nil
+}
+
+func (o *ObjectStoreArchive) FileExist(fid string) bool {
+	resp, err := o.client.do(http.MethodHead, o.fileKey(fid), nil, nil, 0, "")
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	_ = resp.Body.Close()
+	return false
+}
+
+func (o *ObjectStoreArchive) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) error {
+	return writeTree(o, fid, tree)
+}
+
+func (o *ObjectStoreArchive) WriteTreeData(fid string, data []byte) error {
+	hash := sha256.Sum256(data)
+	resp, err := o.client.do(http.MethodPut, o.treeKey(fid), nil, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(hash[:]))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (o *ObjectStoreArchive) RetrieveTree(fid string) (tree *merkletree.MerkleTree, err error) {
+	return retrieveTree(o, fid)
+}
+
+func (o *ObjectStoreArchive) RetrieveTreeData(fid string) (data []byte, err error) {
+	resp, err := o.client.do(http.MethodGet, o.treeKey(fid), nil, nil, 0, "")
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = errors.Join(err, resp.Body.Close())
+	}()
+
+	return io.ReadAll(resp.Body)
+}
+
+// Delete removes the file and its merkle tree. Deleting objects that don't
+// exist is not an error.
+func (o *ObjectStoreArchive) Delete(fid string) error {
+	for _, key := range []string{o.fileKey(fid), o.treeKey(fid)} {
+		resp, err := o.client.do(http.MethodDelete, key, nil, nil, 0, "")
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+	}
+	return nil
+}
+
+func (o *ObjectStoreArchive) StageFile(data io.Reader) (stage string, written int64, err error) {
+	return stageFile(filepath.Join(o.rootDir, stagingDir), data)
+}
+
+// CommitFile uploads the staged file and removes it from the local disk.
+// The object only becomes visible once it was uploaded completely.
+func (o *ObjectStoreArchive) CommitFile(stage string, fid string) error {
+	err := o.putFile(stage, o.fileKey(fid))
+	if err != nil {
+		return err
+	}
+	return os.Remove(stage)
+}
+
+func (o *ObjectStoreArchive) putFile(path, key string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the file is closed here and not by the http client
+	resp, err := o.client.do(http.MethodPut, key, nil, io.NopCloser(file), stat.Size(), s3UnsignedBody)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (o *ObjectStoreArchive) DiscardFile(stage string) error {
+	return os.Remove(stage)
+}
+
+// objectReader reads an object with ranged requests. Seeking is free, the
+// next read opens a new request at the offset.
+type objectReader struct {
+	client *s3Client
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *objectReader) Read(p []byte) (n int, err error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		resp, err := r.client.do(http.MethodGet, r.key, header, nil, 0, "")
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+
+		if resp.StatusCode != http.StatusPartialContent {
+			_, err = io.CopyN(io.Discard, r.body, r.offset)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("objectReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("objectReader.Seek: negative position")
+	}
+
+	if offset != r.offset {
+		err := r.closeBody()
+		if err != nil {
+			return 0, err
+		}
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *objectReader) closeBody() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func (r *objectReader) Close() error {
+	return r.closeBody()
+}
@@ -0,0 +1,167 @@
+package archive_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+// fakeObjectStore is an in memory stand-in for an S3 compatible store
+// serving a single bucket with path style requests.
+type fakeObjectStore struct {
+	t       *testing.T
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	require.True(s.t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/"))
+	require.NotEmpty(s.t, r.Header.Get("X-Amz-Content-Sha256"))
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+s.bucket+"/")
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		// S3 rejects uploads of unknown length
+		require.Empty(s.t, r.TransferEncoding)
+		data, err := io.ReadAll(r.Body)
+		require.NoError(s.t, err)
+		require.EqualValues(s.t, r.ContentLength, len(data))
+		s.objects[key] = data
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func setupObjectStoreArchive(t *testing.T) (*archive.ObjectStoreArchive, *fakeObjectStore) {
+	store := &fakeObjectStore{t: t, bucket: "jackal", objects: make(map[string][]byte)}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	a, err := archive.NewObjectStoreArchive(t.TempDir(), archive.ObjectStoreConfig{
+		Endpoint:  server.URL,
+		Bucket:    store.bucket,
+		Prefix:    "provider",
+		AccessKey: "minio",
+		SecretKey: "minio123",
+	})
+	require.NoError(t, err)
+	return a, store
+}
+
+func TestObjectStoreArchiveFile(t *testing.T) {
+	require := require.New(t)
+
+	a, store := setupObjectStoreArchive(t)
+	data := []byte("hello, world\n")
+	fid := "jklf1test"
+
+	require.True(a.FileExist(fid))
+
+	stage, written, err := a.StageFile(bytes.NewReader(data))
+	require.NoError(err)
+	require.EqualValues(len(data), written)
+	require.Empty(store.objects)
+
+	require.NoError(a.CommitFile(stage, fid))
+	require.Equal(data, store.objects["provider/storage/jklf1test/jklf1test.jkl"])
+	_, err = os.Stat(stage)
+	require.ErrorIs(err, os.ErrNotExist)
+	require.False(a.FileExist(fid))
+
+	cases := map[string]struct {
+		index     int64
+		blockSize int64
+		expBlock  string
+		expErr    error
+	}{
+		"first":    {index: 0, blockSize: 5, expBlock: "hello"},
+		"middle":   {index: 1, blockSize: 5, expBlock: ", wor"},
+		"last":     {index: 1, blockSize: 8, expBlock: "orld\n"},
+		"past_end": {index: 2, blockSize: 8, expErr: io.EOF},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			block, err := a.GetPiece(fid, c.index, c.blockSize)
+			if c.expErr != nil {
+				require.ErrorIs(err, c.expErr)
+				return
+			}
+			require.NoError(err)
+			require.Equal(c.expBlock, string(block))
+		})
+	}
+
+	file, err := a.RetrieveFile(fid)
+	require.NoError(err)
+	all, err := io.ReadAll(file)
+	require.NoError(err)
+	require.Equal(data, all)
+
+	_, err = file.Seek(7, io.SeekStart)
+	require.NoError(err)
+	rest, err := io.ReadAll(file)
+	require.NoError(err)
+	require.Equal("world\n", string(rest))
+	require.NoError(file.Close())
+
+	_, err = a.RetrieveFile("jklf1missing")
+	require.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestObjectStoreArchiveTree(t *testing.T) {
+	require := require.New(t)
+
+	a, store := setupObjectStoreArchive(t)
+	fid := "jklf1test"
+
+	tree, err := merkletree.NewUsing([][]byte{[]byte("a"), []byte("b")}, sha3.New512(), false)
+	require.NoError(err)
+
+	require.NoError(a.WriteTreeToDisk(fid, tree))
+	got, err := a.RetrieveTree(fid)
+	require.NoError(err)
+	require.Equal(tree.Root(), got.Root())
+
+	_, err = a.WriteFileToDisk(bytes.NewReader([]byte("data")), fid)
+	require.NoError(err)
+	require.Len(store.objects, 2)
+
+	require.NoError(a.Delete(fid))
+	require.Empty(store.objects)
+	require.True(a.FileExist(fid))
+	_, err = a.RetrieveTree(fid)
+	require.ErrorIs(err, os.ErrNotExist)
+
+	// deleting twice is fine
+	require.NoError(a.Delete(fid))
+}
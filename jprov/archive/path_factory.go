@@ -1,6 +1,8 @@
 package archive
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -18,6 +20,8 @@ type pathFactory interface {
 // Check if the struct satifies the inferface
 var _ pathFactory = &SingleCellPathFactory{}
 
+var _ pathFactory = &ShardedPathFactory{}
+
 // SingleCellPathFactory is used for a file system that stores
 // files as a single file
 type SingleCellPathFactory struct {
@@ -58,6 +62,50 @@ func (s *SingleCellPathFactory) treeName(fid string) (name string) {
 	return b.String()
 }
 
+// ShardedPathFactory stores files like SingleCellPathFactory but spreads the
+// directories of the files over two levels of shards named after the sha256
+// hash of the fid, e.g. storage/ab/cd/<fid>/<fid>.jkl.
+// A single directory never holds more than 256 shards or a handful of files.
+type ShardedPathFactory struct {
+	rootDir string
+	fileExt string
+	treeExt string
+}
+
+func NewShardedPathFactory(rootDir string) *ShardedPathFactory {
+	return &ShardedPathFactory{rootDir: rootDir, fileExt: ".jkl", treeExt: ".tree"}
+}
+
+// shards returns the names of the two shard directories of fid
+func shards(fid string) (string, string) {
+	hash := sha256.Sum256([]byte(fid))
+	h := hex.EncodeToString(hash[:2])
+	return h[:2], h[2:]
+}
+
+// IsShardDir reports whether name is a shard directory of the sharded layout
+// rather than the directory of a file in the flat layout.
+func IsShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+func (s *ShardedPathFactory) FilePath(fid string) (path string) {
+	return filepath.Join(s.FileDir(fid), fid+s.fileExt)
+}
+
+func (s *ShardedPathFactory) FileDir(fid string) (dir string) {
+	first, second := shards(fid)
+	return filepath.Join(s.rootDir, "storage", first, second, fid)
+}
+
+func (s *ShardedPathFactory) TreePath(fid string) (path string) {
+	return filepath.Join(s.FileDir(fid), fid+s.treeExt)
+}
+
 type MultiCellPathFactory struct {
 	rootDir string
 	fileExt string
@@ -0,0 +1,241 @@
+package archive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A minimal client for the S3 API, enough to store and read objects of a
+// single bucket. Requests use path style addressing so any S3 compatible
+// store like MinIO works without DNS setup.
+
+const (
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	s3DefaultRegion  = "us-east-1"
+	s3RequestTimeout = 5 * time.Minute
+)
+
+// sha256 of an empty body
+var s3EmptyBody = hex.EncodeToString(sha256.New().Sum(nil))
+
+// s3Error is the error returned by the object store.
+// Missing objects are reported as os.ErrNotExist.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("object store: %s", http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("object store: %s: %s", e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == os.ErrNotExist && e.Status == http.StatusNotFound
+}
+
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Client(endpoint, bucket, region, accessKey, secretKey string) (*s3Client, error) {
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("object store: bucket is required")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("object store: invalid endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("object store: endpoint must be a http or https url")
+	}
+
+	if len(region) == 0 {
+		region = s3DefaultRegion
+	}
+
+	return &s3Client{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: s3RequestTimeout},
+	}, nil
+}
+
+// s3Escape encodes an object key the way S3 expects it in the canonical
+// request, everything but unreserved characters and slashes is escaped.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			_ = b.WriteByte(c)
+		default:
+			_, _ = fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (c *s3Client) objectURL(key string) string {
+	base := strings.TrimSuffix(c.endpoint.String(), "/")
+	return fmt.Sprintf("%s/%s/%s", base, s3Escape(c.bucket), s3Escape(key))
+}
+
+// do sends a request for the object at key and returns the response if the
+// store answered with a success status. The body must be closed by the caller.
+// Uploads need the size of the body since S3 does not accept chunked requests.
+func (c *s3Client) do(method, key string, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	if body != nil && size == 0 {
+		// a body without length would be sent chunked
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequest(method, c.objectURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil && body != http.NoBody {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if len(payloadHash) == 0 {
+		payloadHash = s3EmptyBody
+	}
+	if len(c.accessKey) > 0 {
+		signV4(req, c.accessKey, c.secretKey, c.region, payloadHash, time.Now())
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	s3Err := s3Error{Status: resp.StatusCode}
+	if method != http.MethodHead {
+		// the error document is best effort, the status is what matters
+		_ = xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&s3Err)
+	}
+	return nil, &s3Err
+}
+
+// signV4 signs req with AWS signature version 4 for the S3 service.
+// The host, range and all x-amz headers are signed.
+func signV4(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3TimeFormat)
+	date := now.Format(s3DateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		_, _ = fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, queryEscape(k)+"="+queryEscape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func queryEscape(s string) string {
+	return strings.ReplaceAll(s3Escape(s), "/", "%2F")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
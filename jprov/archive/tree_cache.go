@@ -0,0 +1,201 @@
+package archive
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	merkletree "github.com/wealdtech/go-merkletree"
+)
+
+var _ Archive = &TreeCache{}
+
+// TreeCache keeps the parsed merkle trees of another archive in memory so
+// proofs don't read and import the whole tree of a file every time. The
+// least recently used trees are dropped once all trees take up more than the
+// size of the cache.
+type TreeCache struct {
+	archive Archive
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // of *cachedTree, most recently used first
+	trees map[string]*list.Element
+	// counts invalidations so trees read before one are not cached after it
+	epoch uint64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type cachedTree struct {
+	fid  string
+	tree *merkletree.MerkleTree
+	size int64
+}
+
+// TreeCacheStats counts how often the trees were found in the cache.
+type TreeCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Trees     int   `json:"trees"`
+	Size      int64 `json:"size"`
+	MaxSize   int64 `json:"max_size"`
+}
+
+// NewTreeCache caches up to maxSize bytes of the trees of a.
+func NewTreeCache(a Archive, maxSize int64) *TreeCache {
+	return &TreeCache{
+		archive: a,
+		maxSize: maxSize,
+		lru:     list.New(),
+		trees:   make(map[string]*list.Element),
+	}
+}
+
+// Unwrap returns the archive the trees are read from.
+func (c *TreeCache) Unwrap() Archive {
+	return c.archive
+}
+
+func (c *TreeCache) Stats() TreeCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return TreeCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Trees:     c.lru.Len(),
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+	}
+}
+
+func (c *TreeCache) get(fid string) (tree *merkletree.MerkleTree, epoch uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.trees[fid]
+	if !ok {
+		c.misses++
+		return nil, c.epoch, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedTree).tree, c.epoch, true
+}
+
+// add caches the tree of fid unless it was invalidated since epoch.
+func (c *TreeCache) add(fid string, tree *merkletree.MerkleTree, size int64, epoch uint64) {
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+
+	c.remove(fid)
+	c.trees[fid] = c.lru.PushFront(&cachedTree{fid: fid, tree: tree, size: size})
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back().Value.(*cachedTree).fid)
+		c.evictions++
+	}
+}
+
+// remove drops the tree of fid. The caller must hold c.mu.
+func (c *TreeCache) remove(fid string) {
+	elem, ok := c.trees[fid]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.trees, fid)
+	c.size -= elem.Value.(*cachedTree).size
+}
+
+func (c *TreeCache) invalidate(fid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.remove(fid)
+}
+
+func (c *TreeCache) RetrieveTree(fid string) (*merkletree.MerkleTree, error) {
+	tree, epoch, ok := c.get(fid)
+	if ok {
+		return tree, nil
+	}
+
+	data, err := c.archive.RetrieveTreeData(fid)
+	if err != nil {
+		return nil, err
+	}
+	tree, size, err := decodeTree(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.add(fid, tree, size, epoch)
+	return tree, nil
+}
+
+func (c *TreeCache) RetrieveTreeData(fid string) ([]byte, error) {
+	return c.archive.RetrieveTreeData(fid)
+}
+
+func (c *TreeCache) WriteTreeToDisk(fid string, tree *merkletree.MerkleTree) error {
+	err := c.archive.WriteTreeToDisk(fid, tree)
+	// after the write so trees read during it are not kept
+	c.invalidate(fid)
+	return err
+}
+
+func (c *TreeCache) WriteTreeData(fid string, data []byte) error {
+	err := c.archive.WriteTreeData(fid, data)
+	c.invalidate(fid)
+	return err
+}
+
+func (c *TreeCache) Delete(fid string) error {
+	err := c.archive.Delete(fid)
+	c.invalidate(fid)
+	return err
+}
+
+func (c *TreeCache) WriteFileToDisk(data io.Reader, fid string) (written int64, err error) {
+	return c.archive.WriteFileToDisk(data, fid)
+}
+
+func (c *TreeCache) GetPiece(fid string, index, blockSize int64) (block []byte, err error) {
+	return c.archive.GetPiece(fid, index, blockSize)
+}
+
+func (c *TreeCache) RetrieveFile(fid string) (data io.ReadSeekCloser, err error) {
+	return c.archive.RetrieveFile(fid)
+}
+
+func (c *TreeCache) FileExist(fid string) bool {
+	return c.archive.FileExist(fid)
+}
+
+func (c *TreeCache) StageFile(data io.Reader) (stage string, written int64, err error) {
+	return c.archive.StageFile(data)
+}
+
+func (c *TreeCache) CommitFile(stage string, fid string) error {
+	return c.archive.CommitFile(stage, fid)
+}
+
+func (c *TreeCache) DiscardFile(stage string) error {
+	return c.archive.DiscardFile(stage)
+}
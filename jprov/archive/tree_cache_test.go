@@ -0,0 +1,93 @@
+package archive_test
+
+import (
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+func newTestTree(t *testing.T, leaves ...string) *merkletree.MerkleTree {
+	data := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		data[i] = []byte(leaf)
+	}
+	tree, err := merkletree.NewUsing(data, sha3.New512(), false)
+	require.NoError(t, err)
+	return tree
+}
+
+func TestTreeCache(t *testing.T) {
+	require := require.New(t)
+
+	base := archive.NewHybridCellArchive(t.TempDir())
+	tree := newTestTree(t, "a", "b")
+	for _, fid := range []string{"jklf1a", "jklf1b", "jklf1c"} {
+		require.NoError(base.WriteTreeToDisk(fid, tree))
+	}
+
+	probe := archive.NewTreeCache(base, 1<<20)
+	_, err := probe.RetrieveTree("jklf1a")
+	require.NoError(err)
+	size := probe.Stats().Size
+	require.Positive(size)
+
+	// room for two trees
+	cache := archive.NewTreeCache(base, 2*size)
+
+	got, err := cache.RetrieveTree("jklf1a")
+	require.NoError(err)
+	require.Equal(tree.Root(), got.Root())
+
+	again, err := cache.RetrieveTree("jklf1a")
+	require.NoError(err)
+	require.Same(got, again)
+	require.Equal(archive.TreeCacheStats{Hits: 1, Misses: 1, Trees: 1, Size: size, MaxSize: 2 * size}, cache.Stats())
+
+	// b pushes out c, the least recently used tree
+	_, err = cache.RetrieveTree("jklf1c")
+	require.NoError(err)
+	_, err = cache.RetrieveTree("jklf1a")
+	require.NoError(err)
+	_, err = cache.RetrieveTree("jklf1b")
+	require.NoError(err)
+
+	stats := cache.Stats()
+	require.EqualValues(2, stats.Hits)
+	require.EqualValues(3, stats.Misses)
+	require.EqualValues(1, stats.Evictions)
+	require.Equal(2, stats.Trees)
+
+	_, err = cache.RetrieveTree("jklf1a")
+	require.NoError(err)
+	_, err = cache.RetrieveTree("jklf1c")
+	require.NoError(err)
+	require.EqualValues(4, cache.Stats().Misses)
+
+	// a new tree replaces the cached one
+	other := newTestTree(t, "c", "d")
+	require.NoError(cache.WriteTreeToDisk("jklf1c", other))
+	got, err = cache.RetrieveTree("jklf1c")
+	require.NoError(err)
+	require.Equal(other.Root(), got.Root())
+
+	// deleted trees are not served from the cache
+	require.NoError(cache.Delete("jklf1c"))
+	_, err = cache.RetrieveTree("jklf1c")
+	require.Error(err)
+	require.Equal(1, cache.Stats().Trees)
+}
+
+func TestTreeCacheTooLarge(t *testing.T) {
+	require := require.New(t)
+
+	cache := archive.NewTreeCache(archive.NewHybridCellArchive(t.TempDir()), 10)
+	require.NoError(cache.WriteTreeToDisk("jklf1a", newTestTree(t, "a", "b")))
+
+	_, err := cache.RetrieveTree("jklf1a")
+	require.NoError(err)
+	require.Zero(cache.Stats().Trees)
+	require.Zero(cache.Stats().Size)
+}
@@ -0,0 +1,259 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"unsafe"
+
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+// Merkle trees are stored in a binary format instead of the JSON export of
+// the tree, which is about twice the size and slow to parse:
+//
+//	magic | version | flags | hash type | data | nodes
+//
+// data and nodes are lists of hashes of the same width, empty entries are
+// marked in a bitmap and take up width zero bytes:
+//
+//	count (uint64) | width (uint16) | bitmap | count * width bytes
+//
+// Trees exported as JSON are still read.
+const (
+	treeMagic   = "JKLTREE"
+	treeVersion = 1
+
+	treeSalted = 1 << 0
+	treeSorted = 1 << 1
+
+	// the hash all trees are created with
+	treeHashSha3512 = 1
+)
+
+var ErrInvalidTree = errors.New("invalid merkle tree")
+
+// sliceHeaderSize is the memory used by a slice on 64 bit platforms
+const sliceHeaderSize = 24
+
+// treeFields has the layout of merkletree.MerkleTree, which doesn't export
+// its fields. Trees are read and created through it, MerkleTree otherwise
+// only exposes its hashes as JSON.
+type treeFields struct {
+	salt   bool
+	sorted bool
+	hash   merkletree.HashType
+	data   [][]byte
+	nodes  [][]byte
+}
+
+// errTreeLayout is set if treeFields doesn't match MerkleTree anymore.
+var errTreeLayout = checkTreeLayout()
+
+func checkTreeLayout() error {
+	tree, fields := reflect.TypeOf(merkletree.MerkleTree{}), reflect.TypeOf(treeFields{})
+	if tree.Size() != fields.Size() || tree.NumField() != fields.NumField() {
+		return errors.New("unknown layout of merkletree.MerkleTree")
+	}
+	for i := 0; i < tree.NumField(); i++ {
+		a, b := tree.Field(i), fields.Field(i)
+		if a.Name != b.Name || a.Type != b.Type || a.Offset != b.Offset {
+			return fmt.Errorf("unknown layout of merkletree.MerkleTree field %s", a.Name)
+		}
+	}
+	return nil
+}
+
+func fieldsOf(tree *merkletree.MerkleTree) (*treeFields, error) {
+	if errTreeLayout != nil {
+		return nil, errTreeLayout
+	}
+	return (*treeFields)(unsafe.Pointer(tree)), nil
+}
+
+func newTree(fields treeFields) (*merkletree.MerkleTree, error) {
+	if errTreeLayout != nil {
+		return nil, errTreeLayout
+	}
+	tree := new(merkletree.MerkleTree)
+	*(*treeFields)(unsafe.Pointer(tree)) = fields
+	return tree, nil
+}
+
+// treeSize estimates the memory used by a tree with the hashes of fields.
+func treeSize(fields treeFields) int64 {
+	size := int64(0)
+	for _, column := range [][][]byte{fields.data, fields.nodes} {
+		for _, entry := range column {
+			size += int64(len(entry)) + sliceHeaderSize
+		}
+	}
+	return size
+}
+
+// IsBinaryTree returns true if data is a tree in the binary format.
+func IsBinaryTree(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(treeMagic))
+}
+
+// EncodeTree returns tree in the binary format.
+func EncodeTree(tree *merkletree.MerkleTree) ([]byte, error) {
+	fields, err := fieldsOf(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(0)
+	if fields.salt {
+		flags |= treeSalted
+	}
+	if fields.sorted {
+		flags |= treeSorted
+	}
+
+	buf := make([]byte, 0, len(treeMagic)+3+columnSize(fields.data)+columnSize(fields.nodes))
+	buf = append(buf, treeMagic...)
+	buf = append(buf, treeVersion, flags, treeHashSha3512)
+
+	buf, err = appendColumn(buf, fields.data)
+	if err != nil {
+		return nil, fmt.Errorf("data: %w", err)
+	}
+	buf, err = appendColumn(buf, fields.nodes)
+	if err != nil {
+		return nil, fmt.Errorf("nodes: %w", err)
+	}
+	return buf, nil
+}
+
+// DecodeTree reads a tree in the binary format or exported as JSON.
+func DecodeTree(data []byte) (*merkletree.MerkleTree, error) {
+	tree, _, err := decodeTree(data)
+	return tree, err
+}
+
+// decodeTree reads a tree like DecodeTree and estimates its memory.
+func decodeTree(data []byte) (tree *merkletree.MerkleTree, size int64, err error) {
+	fields := treeFields{hash: sha3.New512()}
+
+	if !IsBinaryTree(data) {
+		var e merkletree.Export
+		err = e.UnmarshalJSON(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		fields.salt, fields.sorted, fields.data, fields.nodes = e.Salt, e.Sorted, e.Data, e.Nodes
+		tree, err = newTree(fields)
+		return tree, treeSize(fields), err
+	}
+
+	data = data[len(treeMagic):]
+	if len(data) < 3 {
+		return nil, 0, ErrInvalidTree
+	}
+	version, flags, hash := data[0], data[1], data[2]
+	if version != treeVersion {
+		return nil, 0, fmt.Errorf("%w: unknown version %d", ErrInvalidTree, version)
+	}
+	if hash != treeHashSha3512 {
+		return nil, 0, fmt.Errorf("%w: unknown hash type %d", ErrInvalidTree, hash)
+	}
+
+	fields.salt = flags&treeSalted != 0
+	fields.sorted = flags&treeSorted != 0
+	fields.data, data, err = readColumn(data[3:])
+	if err != nil {
+		return nil, 0, err
+	}
+	fields.nodes, data, err = readColumn(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) > 0 || len(fields.nodes) < 2 {
+		return nil, 0, ErrInvalidTree
+	}
+
+	tree, err = newTree(fields)
+	return tree, treeSize(fields), err
+}
+
+func columnSize(column [][]byte) int {
+	width := 0
+	for _, entry := range column {
+		width = max(width, len(entry))
+	}
+	return 8 + 2 + (len(column)+7)/8 + len(column)*width
+}
+
+func appendColumn(buf []byte, column [][]byte) ([]byte, error) {
+	width := 0
+	for _, entry := range column {
+		if len(entry) == 0 {
+			continue
+		}
+		if width != 0 && len(entry) != width {
+			return nil, errors.New("hashes of different width")
+		}
+		width = len(entry)
+	}
+	if width > math.MaxUint16 {
+		return nil, errors.New("hashes are too wide")
+	}
+
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(column)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(width))
+
+	empty := make([]byte, (len(column)+7)/8)
+	for i, entry := range column {
+		if len(entry) == 0 {
+			empty[i/8] |= 1 << (i % 8)
+		}
+	}
+	buf = append(buf, empty...)
+
+	padding := make([]byte, width)
+	for _, entry := range column {
+		if len(entry) == 0 {
+			buf = append(buf, padding...)
+		} else {
+			buf = append(buf, entry...)
+		}
+	}
+	return buf, nil
+}
+
+// readColumn reads a column from the start of data. The entries share the
+// memory of data.
+func readColumn(data []byte) (column [][]byte, rest []byte, err error) {
+	if len(data) < 10 {
+		return nil, nil, ErrInvalidTree
+	}
+	count := binary.BigEndian.Uint64(data)
+	width := uint64(binary.BigEndian.Uint16(data[8:]))
+	data = data[10:]
+
+	// count is bound by the size of the bitmap so count * width can't overflow
+	if count > uint64(len(data))*8 {
+		return nil, nil, ErrInvalidTree
+	}
+	bitmap := (count + 7) / 8
+	if bitmap+count*width > uint64(len(data)) {
+		return nil, nil, ErrInvalidTree
+	}
+	empty := data[:bitmap]
+	data = data[bitmap:]
+
+	column = make([][]byte, count)
+	for i := range column {
+		entry := data[:width:width]
+		data = data[width:]
+		if empty[i/8]&(1<<(i%8)) == 0 {
+			column[i] = entry
+		}
+	}
+	return column, data, nil
+}
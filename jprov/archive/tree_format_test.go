@@ -0,0 +1,191 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	stdjson "encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+func TestTreeFormat(t *testing.T) {
+	require := require.New(t)
+
+	leaves := [][]byte{
+		bytes.Repeat([]byte{1}, 32),
+		bytes.Repeat([]byte{2}, 32),
+		bytes.Repeat([]byte{3}, 32),
+		nil, // files ending at a block boundary have an empty last leaf
+	}
+
+	for _, salt := range []bool{false, true} {
+		tree, err := merkletree.NewUsing(leaves, sha3.New512(), salt)
+		require.NoError(err)
+		exported, err := tree.Export()
+		require.NoError(err)
+
+		encoded, err := EncodeTree(tree)
+		require.NoError(err)
+		require.True(IsBinaryTree(encoded))
+		require.Less(len(encoded), len(exported))
+
+		decoded, size, err := decodeTree(encoded)
+		require.NoError(err)
+		reexported, err := decoded.Export()
+		require.NoError(err)
+		require.Equal(exported, reexported)
+
+		proof, err := decoded.GenerateProof(leaves[1], 0)
+		require.NoError(err)
+		valid, err := merkletree.VerifyProofUsing(leaves[1], salt, proof, [][]byte{tree.Root()}, sha3.New512())
+		require.NoError(err)
+		require.True(valid)
+
+		// trees exported as JSON are still read
+		legacy, legacySize, err := decodeTree(exported)
+		require.NoError(err)
+		require.Equal(tree.Root(), legacy.Root())
+		require.Positive(size)
+		require.Equal(size, legacySize)
+	}
+}
+
+func TestTreeLayout(t *testing.T) {
+	// fails if go-merkletree changed MerkleTree, treeFields has to follow
+	require.NoError(t, checkTreeLayout())
+}
+
+// decodeTreeJSON is how trees were read before they were created from
+// their hashes, it is kept to compare the loaders.
+func decodeTreeJSON(data []byte) (*merkletree.MerkleTree, error) {
+	if !IsBinaryTree(data) {
+		var e merkletree.Export
+		err := stdjson.Unmarshal(data, &e)
+		if err != nil {
+			return nil, err
+		}
+		return merkletree.ImportMerkleTree(data, sha3.New512())
+	}
+
+	var e merkletree.Export
+	var err error
+	e.Data, data, err = readColumn(data[len(treeMagic)+3:])
+	if err != nil {
+		return nil, err
+	}
+	e.Nodes, _, err = readColumn(data)
+	if err != nil {
+		return nil, err
+	}
+	exported, err := stdjson.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return merkletree.ImportMerkleTree(exported, sha3.New512())
+}
+
+func BenchmarkDecodeTree(b *testing.B) {
+	// the tree of a 160 MiB file with the default chunk size
+	leaves := make([][]byte, 1<<14)
+	for i := range leaves {
+		leaves[i] = make([]byte, 32)
+		_, err := rand.Read(leaves[i])
+		require.NoError(b, err)
+	}
+	tree, err := merkletree.NewUsing(leaves, sha3.New512(), false)
+	require.NoError(b, err)
+	exported, err := tree.Export()
+	require.NoError(b, err)
+	encoded, err := EncodeTree(tree)
+	require.NoError(b, err)
+
+	loaders := map[string]func([]byte) (*merkletree.MerkleTree, error){
+		"old": decodeTreeJSON,
+		"new": DecodeTree,
+	}
+	formats := map[string][]byte{
+		"binary": encoded,
+		"json":   exported,
+	}
+	for _, loader := range []string{"old", "new"} {
+		for _, format := range []string{"binary", "json"} {
+			b.Run(loader+"/"+format, func(b *testing.B) {
+				for n := 0; n < b.N; n++ {
+					_, err := loaders[loader](formats[format])
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeInvalidTree(t *testing.T) {
+	tree, err := merkletree.NewUsing([][]byte{{1}, {2}}, sha3.New512(), false)
+	require.NoError(t, err)
+	encoded, err := EncodeTree(tree)
+	require.NoError(t, err)
+
+	cases := map[string][]byte{
+		"header":    []byte(treeMagic),
+		"version":   append([]byte(treeMagic), 2, 0, treeHashSha3512),
+		"hash":      append([]byte(treeMagic), treeVersion, 0, 2),
+		"truncated": encoded[:len(encoded)-1],
+		"trailing":  append(bytes.Clone(encoded), 0),
+		"count":     append(append([]byte(treeMagic), treeVersion, 0, treeHashSha3512), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 64),
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := DecodeTree(data)
+			require.ErrorIs(t, err, ErrInvalidTree)
+		})
+	}
+}
+
+func TestConvertTree(t *testing.T) {
+	require := require.New(t)
+
+	rootDir := t.TempDir()
+	hybrid := NewHybridCellArchive(rootDir)
+	tree, err := merkletree.NewUsing([][]byte{{1}, {2}, {3}}, sha3.New512(), false)
+	require.NoError(err)
+	exported, err := tree.Export()
+	require.NoError(err)
+
+	// a JSON tree at the legacy path and one in the sharded layout
+	legacyPath := hybrid.legacyPathFactory.TreePath("jklf1legacy")
+	require.NoError(os.MkdirAll(filepath.Dir(legacyPath), os.ModePerm))
+	require.NoError(os.WriteFile(legacyPath, exported, FilePerm))
+	require.NoError(writeTreeFile(hybrid.pathFactory.TreePath("jklf1json"), exported))
+
+	for _, fid := range []string{"jklf1legacy", "jklf1json"} {
+		converted, err := ConvertTree(hybrid, fid)
+		require.NoError(err)
+		require.True(converted)
+
+		data, err := hybrid.RetrieveTreeData(fid)
+		require.NoError(err)
+		require.True(IsBinaryTree(data))
+
+		got, err := hybrid.RetrieveTree(fid)
+		require.NoError(err)
+		require.Equal(tree.Root(), got.Root())
+
+		converted, err = ConvertTree(hybrid, fid)
+		require.NoError(err)
+		require.False(converted)
+	}
+	require.NoFileExists(legacyPath)
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(hybrid.pathFactory.FileDir("jklf1json"))
+	require.NoError(err)
+	require.Len(entries, 1)
+}
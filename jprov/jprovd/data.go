@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	apitypes "github.com/JackalLabs/jackal-provider/jprov/api/types"
 	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/archive/kv"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
 	"github.com/JackalLabs/jackal-provider/jprov/utils"
 	"github.com/cosmos/cosmos-sdk/client"
 	"github.com/spf13/cobra"
@@ -22,7 +25,7 @@ func CmdDumpDatabase() *cobra.Command {
 				return err
 			}
 
-			db, err := archive.NewDoubleRefArchiveDB(utils.GetArchiveDBPath(clientCtx))
+			db, err := archive.NewDoubleRefArchiveDB("", utils.GetArchiveDBPath(clientCtx))
 			if err != nil {
 				fmt.Println(err)
 				return
@@ -57,3 +60,163 @@ func CmdDumpDatabase() *cobra.Command {
 
 	return cmd
 }
+
+func CmdShowContracts() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "contracts [cid]",
+		Short: "Print the metadata of all contracts or of one contract.",
+		Long:  `Print the metadata the provider stored for its contracts without querying the chain. The provider must be stopped.`,
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			clientCtx, err := client.GetClientTxContext(cmd)
+			if err != nil {
+				return err
+			}
+
+			db, err := archive.NewDoubleRefArchiveDB("", utils.GetArchiveDBPath(clientCtx))
+			if err != nil {
+				return err
+			}
+			defer func() {
+				err = errors.Join(err, db.Close())
+			}()
+
+			var v any
+			if len(args) == 1 {
+				v, err = db.GetMetadata(args[0])
+				if err != nil {
+					return err
+				}
+			} else {
+				v, err = allMetadata(db)
+				if err != nil {
+					return err
+				}
+			}
+
+			r, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(string(r))
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func allMetadata(db archive.ArchiveDB) (apitypes.ContractsResponse, error) {
+	iter := db.NewIterator()
+	defer iter.Release()
+
+	data := make([]archive.ContractMetadata, 0)
+	for iter.Next() {
+		meta, err := db.GetMetadata(string(iter.Key()))
+		if err != nil {
+			return apitypes.ContractsResponse{}, err
+		}
+		data = append(data, meta)
+	}
+	return apitypes.ContractsResponse{Data: data}, iter.Error()
+}
+
+func CmdConvertDatabases() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "convert-db [leveldb|badger|pebble]",
+		Short: "Copy the archive and downtime databases to another key-value store.",
+		Long:  `Copy the archive and downtime databases to another key-value store. The old databases are kept next to the new ones with the name of their store appended and can be deleted once the provider runs. The provider must be stopped.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clientCtx, err := client.GetClientTxContext(cmd)
+			if err != nil {
+				return err
+			}
+
+			for _, path := range []string{utils.GetArchiveDBPath(clientCtx), utils.GetDowntimeDBPath(clientCtx)} {
+				backup, copied, err := kv.Convert(path, args[0])
+				if err != nil {
+					return fmt.Errorf("failed to convert %s: %w", path, err)
+				}
+				if backup == "" {
+					fmt.Printf("%s already uses %s or doesn't exist\n", path, args[0])
+					continue
+				}
+				fmt.Printf("copied %d entries of %s to %s, the old database is at %s\n", copied, path, args[0], backup)
+			}
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+func CmdConvertTrees() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "convert-trees",
+		Short: "Rewrite stored merkle trees in the binary format.",
+		Long:  "Rewrite stored merkle trees in the binary format. The provider must be stopped while the trees are converted.",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			clientCtx, err := client.GetClientTxContext(cmd)
+			if err != nil {
+				return err
+			}
+
+			db, err := archive.NewDoubleRefArchiveDB("", utils.GetArchiveDBPath(clientCtx))
+			if err != nil {
+				return err
+			}
+			defer func() {
+				err = errors.Join(err, db.Close())
+			}()
+
+			fids := make(map[string]bool)
+			iter := db.NewIterator()
+			for iter.Next() {
+				fids[string(iter.Value())] = true
+			}
+			iter.Release()
+			if err := iter.Error(); err != nil {
+				return err
+			}
+
+			fileArchive, err := utils.NewArchive(cmd, clientCtx.HomeDir)
+			if err != nil {
+				return err
+			}
+
+			converted := 0
+			for fid := range fids {
+				ok, err := archive.ConvertTree(fileArchive, fid)
+				if err != nil {
+					fmt.Printf("failed to convert tree of %s: %s\n", fid, err.Error())
+					continue
+				}
+				if ok {
+					converted++
+				}
+			}
+
+			fmt.Printf("converted %d of %d trees\n", converted, len(fids))
+			return nil
+		},
+	}
+
+	cmd.Flags().String(types.FlagArchive, types.DefaultArchive, "Where files are stored (filesystem|s3|ipfs).")
+	cmd.Flags().String(types.FlagS3Endpoint, "", "The url of the S3 compatible object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Bucket, "", "The bucket to store files in, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Region, "us-east-1", "The region of the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Prefix, "", "The prefix of all objects in the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3AccessKey, "", "The access key of the object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3SecretKeyFile, "", "The file with the secret key of the object store, used with --archive=s3. Defaults to the AWS_SECRET_ACCESS_KEY environment variable.")
+	cmd.Flags().StringSlice(types.FlagDisks, nil, "Spread files over several disks given as path[:weight[:mode]] with mode rw, ro or drain, instead of the home directory.")
+	cmd.Flags().Bool(types.FlagEncrypt, false, "Encrypt stored files and merkle trees with the key at --encryption-key.")
+	cmd.Flags().String(types.FlagEncryptionKey, "", "The file with the key used by --encrypt, created on the first start. Required with --encrypt and should not be on a disk files are stored on.")
+	cmd.Flags().Bool(types.FlagEncryptionKeyStrict, false, "Refuse to start if --encryption-key is on a disk files are stored on.")
+	cmd.Flags().StringSlice(types.FlagIpfsBootstrap, nil, "Multiaddrs including the peer ID of the IPFS peers to bootstrap from instead of the public bootstrap peers.")
+	cmd.Flags().String(types.FlagIpfsSwarmKey, "", "The swarm.key file of a private IPFS swarm, only peers with the same key can connect.")
+
+	return cmd
+}
@@ -33,8 +33,13 @@ func StartServerCommand() *cobra.Command {
 			clientCtx := client.GetClientContextFromCmd(cmd)
 			serverCtx := utils.GetServerContextFromCmd(cmd)
 
+			backend, err := cmd.Flags().GetString(types.FlagDBBackend)
+			if err != nil {
+				return err
+			}
+
 			dbPath := utils.GetArchiveDBPath(clientCtx)
-			archivedb, err := archive.NewDoubleRefArchiveDB(dbPath)
+			archivedb, err := archive.NewDoubleRefArchiveDB(backend, dbPath)
 			if err != nil {
 				return err
 			}
@@ -43,7 +48,7 @@ func StartServerCommand() *cobra.Command {
 			}()
 
 			downtimedbPath := utils.GetDowntimeDBPath(clientCtx)
-			downtimedb, err := archive.NewDowntimeDB(downtimedbPath)
+			downtimedb, err := archive.NewDowntimeDB(backend, downtimedbPath)
 			if err != nil {
 				return err
 			}
@@ -96,6 +101,28 @@ func StartServerCommand() *cobra.Command {
 	cmd.Flags().String(types.FlagProviderName, "A Storage Provider", "The name to identify this provider in block explorers.")
 	cmd.Flags().Int64(types.FlagSleep, types.DefaultSleep, "The time, in milliseconds, before adding another proof msg to the queue.")
 	cmd.Flags().Bool(types.FlagDoReport, types.DefaultDoReport, "Should this provider report deals (uses gas).")
+	cmd.Flags().Bool(types.FlagRequireSignature, false, "Reject uploads that are not signed by the sender's key.")
+	cmd.Flags().Bool(types.FlagFullDownload, false, "Download whole files when checking other providers instead of probing a random chunk.")
+	cmd.Flags().Int64(types.FlagDownloadRate, 0, "The maximum bandwidth of all file downloads in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int64(types.FlagClientRate, 0, "The maximum bandwidth of file downloads per client IP in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxDownloads, 0, "The maximum number of concurrent file downloads, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxClientDownloads, 0, "The maximum number of concurrent file downloads per client IP, 0 for unlimited.")
+	cmd.Flags().String(types.FlagArchive, types.DefaultArchive, "Where files are stored (filesystem|s3|ipfs).")
+	cmd.Flags().String(types.FlagS3Endpoint, "", "The url of the S3 compatible object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Bucket, "", "The bucket to store files in, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Region, "us-east-1", "The region of the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Prefix, "", "The prefix of all objects in the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3AccessKey, "", "The access key of the object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3SecretKeyFile, "", "The file with the secret key of the object store, used with --archive=s3. Defaults to the AWS_SECRET_ACCESS_KEY environment variable.")
+	cmd.Flags().StringSlice(types.FlagDisks, nil, "Spread files over several disks given as path[:weight[:mode]] with mode rw, ro or drain, instead of the home directory.")
+	cmd.Flags().Bool(types.FlagEncrypt, false, "Encrypt stored files and merkle trees with the key at --encryption-key.")
+	cmd.Flags().String(types.FlagEncryptionKey, "", "The file with the key used by --encrypt, created on the first start. Required with --encrypt and should not be on a disk files are stored on.")
+	cmd.Flags().Bool(types.FlagEncryptionKeyStrict, false, "Refuse to start if --encryption-key is on a disk files are stored on.")
+	cmd.Flags().Int64(types.FlagScrubRate, types.DefaultScrubRate, "The bandwidth in KiB/s at which stored files are re-hashed to find and repair corrupt files, 0 to turn it off.")
+	cmd.Flags().Int64(types.FlagTreeCacheSize, types.DefaultTreeCacheSize, "The memory in MiB used to cache merkle trees for proofs, 0 to turn it off.")
+	cmd.Flags().StringSlice(types.FlagIpfsBootstrap, nil, "Multiaddrs including the peer ID of the IPFS peers to bootstrap from instead of the public bootstrap peers.")
+	cmd.Flags().String(types.FlagIpfsSwarmKey, "", "The swarm.key file of a private IPFS swarm, only peers with the same key can connect.")
+	cmd.Flags().String(types.FlagDBBackend, "", "Key-value store of the archive and downtime databases (leveldb|badger|pebble). Existing databases are opened with the store they were created with, new ones use leveldb.")
 	return cmd
 }
 
@@ -111,6 +138,9 @@ func DataCmd() *cobra.Command {
 		CmdSetProviderIP(),
 		CmdSetProviderKeybase(),
 		CmdDumpDatabase(),
+		CmdShowContracts(),
+		CmdConvertTrees(),
+		CmdConvertDatabases(),
 	}
 
 	for _, c := range cmds {
@@ -250,8 +280,13 @@ func PruneCommand() *cobra.Command {
 			clientCtx := client.GetClientContextFromCmd(cmd)
 			serverCtx := utils.GetServerContextFromCmd(cmd)
 
+			backend, err := cmd.Flags().GetString(types.FlagDBBackend)
+			if err != nil {
+				return err
+			}
+
 			dbPath := utils.GetArchiveDBPath(clientCtx)
-			archivedb, err := archive.NewDoubleRefArchiveDB(dbPath)
+			archivedb, err := archive.NewDoubleRefArchiveDB(backend, dbPath)
 			if err != nil {
 				return err
 			}
@@ -260,7 +295,7 @@ func PruneCommand() *cobra.Command {
 			}()
 
 			downtimedbPath := utils.GetDowntimeDBPath(clientCtx)
-			downtimedb, err := archive.NewDowntimeDB(downtimedbPath)
+			downtimedb, err := archive.NewDowntimeDB(backend, downtimedbPath)
 			if err != nil {
 				return err
 			}
@@ -309,6 +344,28 @@ func PruneCommand() *cobra.Command {
 	cmd.Flags().String(types.FlagProviderName, "A Storage Provider", "The name to identify this provider in block explorers.")
 	cmd.Flags().Int64(types.FlagSleep, types.DefaultSleep, "The time, in milliseconds, before adding another proof msg to the queue.")
 	cmd.Flags().Bool(types.FlagDoReport, types.DefaultDoReport, "Should this provider report deals (uses gas).")
+	cmd.Flags().Bool(types.FlagRequireSignature, false, "Reject uploads that are not signed by the sender's key.")
+	cmd.Flags().Bool(types.FlagFullDownload, false, "Download whole files when checking other providers instead of probing a random chunk.")
+	cmd.Flags().Int64(types.FlagDownloadRate, 0, "The maximum bandwidth of all file downloads in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int64(types.FlagClientRate, 0, "The maximum bandwidth of file downloads per client IP in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxDownloads, 0, "The maximum number of concurrent file downloads, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxClientDownloads, 0, "The maximum number of concurrent file downloads per client IP, 0 for unlimited.")
+	cmd.Flags().String(types.FlagArchive, types.DefaultArchive, "Where files are stored (filesystem|s3|ipfs).")
+	cmd.Flags().String(types.FlagS3Endpoint, "", "The url of the S3 compatible object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Bucket, "", "The bucket to store files in, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Region, "us-east-1", "The region of the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Prefix, "", "The prefix of all objects in the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3AccessKey, "", "The access key of the object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3SecretKeyFile, "", "The file with the secret key of the object store, used with --archive=s3. Defaults to the AWS_SECRET_ACCESS_KEY environment variable.")
+	cmd.Flags().StringSlice(types.FlagDisks, nil, "Spread files over several disks given as path[:weight[:mode]] with mode rw, ro or drain, instead of the home directory.")
+	cmd.Flags().Bool(types.FlagEncrypt, false, "Encrypt stored files and merkle trees with the key at --encryption-key.")
+	cmd.Flags().String(types.FlagEncryptionKey, "", "The file with the key used by --encrypt, created on the first start. Required with --encrypt and should not be on a disk files are stored on.")
+	cmd.Flags().Bool(types.FlagEncryptionKeyStrict, false, "Refuse to start if --encryption-key is on a disk files are stored on.")
+	cmd.Flags().Int64(types.FlagScrubRate, types.DefaultScrubRate, "The bandwidth in KiB/s at which stored files are re-hashed to find and repair corrupt files, 0 to turn it off.")
+	cmd.Flags().Int64(types.FlagTreeCacheSize, types.DefaultTreeCacheSize, "The memory in MiB used to cache merkle trees for proofs, 0 to turn it off.")
+	cmd.Flags().StringSlice(types.FlagIpfsBootstrap, nil, "Multiaddrs including the peer ID of the IPFS peers to bootstrap from instead of the public bootstrap peers.")
+	cmd.Flags().String(types.FlagIpfsSwarmKey, "", "The swarm.key file of a private IPFS swarm, only peers with the same key can connect.")
+	cmd.Flags().String(types.FlagDBBackend, "", "Key-value store of the archive and downtime databases (leveldb|badger|pebble). Existing databases are opened with the store they were created with, new ones use leveldb.")
 
 	return cmd
 }
@@ -346,8 +403,13 @@ func MigrateCommand() *cobra.Command {
 			clientCtx := client.GetClientContextFromCmd(cmd)
 			serverCtx := utils.GetServerContextFromCmd(cmd)
 
+			backend, err := cmd.Flags().GetString(types.FlagDBBackend)
+			if err != nil {
+				return err
+			}
+
 			dbPath := utils.GetArchiveDBPath(clientCtx)
-			archivedb, err := archive.NewDoubleRefArchiveDB(dbPath)
+			archivedb, err := archive.NewDoubleRefArchiveDB(backend, dbPath)
 			if err != nil {
 				return err
 			}
@@ -356,7 +418,7 @@ func MigrateCommand() *cobra.Command {
 			}()
 
 			downtimedbPath := utils.GetDowntimeDBPath(clientCtx)
-			downtimedb, err := archive.NewDowntimeDB(downtimedbPath)
+			downtimedb, err := archive.NewDowntimeDB(backend, downtimedbPath)
 			if err != nil {
 				return err
 			}
@@ -419,6 +481,28 @@ func MigrateCommand() *cobra.Command {
 	cmd.Flags().String(types.FlagProviderName, "A Storage Provider", "The name to identify this provider in block explorers.")
 	cmd.Flags().Int64(types.FlagSleep, types.DefaultSleep, "The time, in milliseconds, before adding another proof msg to the queue.")
 	cmd.Flags().Bool(types.FlagDoReport, types.DefaultDoReport, "Should this provider report deals (uses gas).")
+	cmd.Flags().Bool(types.FlagRequireSignature, false, "Reject uploads that are not signed by the sender's key.")
+	cmd.Flags().Bool(types.FlagFullDownload, false, "Download whole files when checking other providers instead of probing a random chunk.")
+	cmd.Flags().Int64(types.FlagDownloadRate, 0, "The maximum bandwidth of all file downloads in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int64(types.FlagClientRate, 0, "The maximum bandwidth of file downloads per client IP in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxDownloads, 0, "The maximum number of concurrent file downloads, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxClientDownloads, 0, "The maximum number of concurrent file downloads per client IP, 0 for unlimited.")
+	cmd.Flags().String(types.FlagArchive, types.DefaultArchive, "Where files are stored (filesystem|s3|ipfs).")
+	cmd.Flags().String(types.FlagS3Endpoint, "", "The url of the S3 compatible object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Bucket, "", "The bucket to store files in, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Region, "us-east-1", "The region of the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Prefix, "", "The prefix of all objects in the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3AccessKey, "", "The access key of the object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3SecretKeyFile, "", "The file with the secret key of the object store, used with --archive=s3. Defaults to the AWS_SECRET_ACCESS_KEY environment variable.")
+	cmd.Flags().StringSlice(types.FlagDisks, nil, "Spread files over several disks given as path[:weight[:mode]] with mode rw, ro or drain, instead of the home directory.")
+	cmd.Flags().Bool(types.FlagEncrypt, false, "Encrypt stored files and merkle trees with the key at --encryption-key.")
+	cmd.Flags().String(types.FlagEncryptionKey, "", "The file with the key used by --encrypt, created on the first start. Required with --encrypt and should not be on a disk files are stored on.")
+	cmd.Flags().Bool(types.FlagEncryptionKeyStrict, false, "Refuse to start if --encryption-key is on a disk files are stored on.")
+	cmd.Flags().Int64(types.FlagScrubRate, types.DefaultScrubRate, "The bandwidth in KiB/s at which stored files are re-hashed to find and repair corrupt files, 0 to turn it off.")
+	cmd.Flags().Int64(types.FlagTreeCacheSize, types.DefaultTreeCacheSize, "The memory in MiB used to cache merkle trees for proofs, 0 to turn it off.")
+	cmd.Flags().StringSlice(types.FlagIpfsBootstrap, nil, "Multiaddrs including the peer ID of the IPFS peers to bootstrap from instead of the public bootstrap peers.")
+	cmd.Flags().String(types.FlagIpfsSwarmKey, "", "The swarm.key file of a private IPFS swarm, only peers with the same key can connect.")
+	cmd.Flags().String(types.FlagDBBackend, "", "Key-value store of the archive and downtime databases (leveldb|badger|pebble). Existing databases are opened with the store they were created with, new ones use leveldb.")
 	cmd.Flags().Bool(types.FlagPruneFirst, false, "Should the provider prune its state before migration?")
 
 	return cmd
@@ -457,8 +541,13 @@ func MigrateSequiaCommand() *cobra.Command {
 			clientCtx := client.GetClientContextFromCmd(cmd)
 			serverCtx := utils.GetServerContextFromCmd(cmd)
 
+			backend, err := cmd.Flags().GetString(types.FlagDBBackend)
+			if err != nil {
+				return err
+			}
+
 			dbPath := utils.GetArchiveDBPath(clientCtx)
-			archivedb, err := archive.NewDoubleRefArchiveDB(dbPath)
+			archivedb, err := archive.NewDoubleRefArchiveDB(backend, dbPath)
 			if err != nil {
 				return err
 			}
@@ -467,7 +556,7 @@ func MigrateSequiaCommand() *cobra.Command {
 			}()
 
 			downtimedbPath := utils.GetDowntimeDBPath(clientCtx)
-			downtimedb, err := archive.NewDowntimeDB(downtimedbPath)
+			downtimedb, err := archive.NewDowntimeDB(backend, downtimedbPath)
 			if err != nil {
 				return err
 			}
@@ -528,6 +617,28 @@ func MigrateSequiaCommand() *cobra.Command {
 	cmd.Flags().String(types.FlagProviderName, "A Storage Provider", "The name to identify this provider in block explorers.")
 	cmd.Flags().Int64(types.FlagSleep, types.DefaultSleep, "The time, in milliseconds, before adding another proof msg to the queue.")
 	cmd.Flags().Bool(types.FlagDoReport, types.DefaultDoReport, "Should this provider report deals (uses gas).")
+	cmd.Flags().Bool(types.FlagRequireSignature, false, "Reject uploads that are not signed by the sender's key.")
+	cmd.Flags().Bool(types.FlagFullDownload, false, "Download whole files when checking other providers instead of probing a random chunk.")
+	cmd.Flags().Int64(types.FlagDownloadRate, 0, "The maximum bandwidth of all file downloads in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int64(types.FlagClientRate, 0, "The maximum bandwidth of file downloads per client IP in KiB/s, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxDownloads, 0, "The maximum number of concurrent file downloads, 0 for unlimited.")
+	cmd.Flags().Int(types.FlagMaxClientDownloads, 0, "The maximum number of concurrent file downloads per client IP, 0 for unlimited.")
+	cmd.Flags().String(types.FlagArchive, types.DefaultArchive, "Where files are stored (filesystem|s3|ipfs).")
+	cmd.Flags().String(types.FlagS3Endpoint, "", "The url of the S3 compatible object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Bucket, "", "The bucket to store files in, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Region, "us-east-1", "The region of the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3Prefix, "", "The prefix of all objects in the bucket, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3AccessKey, "", "The access key of the object store, used with --archive=s3.")
+	cmd.Flags().String(types.FlagS3SecretKeyFile, "", "The file with the secret key of the object store, used with --archive=s3. Defaults to the AWS_SECRET_ACCESS_KEY environment variable.")
+	cmd.Flags().StringSlice(types.FlagDisks, nil, "Spread files over several disks given as path[:weight[:mode]] with mode rw, ro or drain, instead of the home directory.")
+	cmd.Flags().Bool(types.FlagEncrypt, false, "Encrypt stored files and merkle trees with the key at --encryption-key.")
+	cmd.Flags().String(types.FlagEncryptionKey, "", "The file with the key used by --encrypt, created on the first start. Required with --encrypt and should not be on a disk files are stored on.")
+	cmd.Flags().Bool(types.FlagEncryptionKeyStrict, false, "Refuse to start if --encryption-key is on a disk files are stored on.")
+	cmd.Flags().Int64(types.FlagScrubRate, types.DefaultScrubRate, "The bandwidth in KiB/s at which stored files are re-hashed to find and repair corrupt files, 0 to turn it off.")
+	cmd.Flags().Int64(types.FlagTreeCacheSize, types.DefaultTreeCacheSize, "The memory in MiB used to cache merkle trees for proofs, 0 to turn it off.")
+	cmd.Flags().StringSlice(types.FlagIpfsBootstrap, nil, "Multiaddrs including the peer ID of the IPFS peers to bootstrap from instead of the public bootstrap peers.")
+	cmd.Flags().String(types.FlagIpfsSwarmKey, "", "The swarm.key file of a private IPFS swarm, only peers with the same key can connect.")
+	cmd.Flags().String(types.FlagDBBackend, "", "Key-value store of the archive and downtime databases (leveldb|badger|pebble). Existing databases are opened with the store they were created with, new ones use leveldb.")
 	cmd.Flags().Bool(types.FlagPruneFirst, false, "Should the provider prune its state before migration?")
 
 	return cmd
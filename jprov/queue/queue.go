@@ -61,6 +61,19 @@ func (q *UploadQueue) PrepareMessage(maxMessageSize int) (messages []cosmosTypes
 	return
 }
 
+// Notify the first count uploads that they are about to be broadcast
+func (q *UploadQueue) MarkBroadcast(count int) {
+	if len(q.Queue) < count {
+		return
+	}
+
+	for _, u := range q.Queue[:count] {
+		if u.OnBroadcast != nil {
+			u.OnBroadcast()
+		}
+	}
+}
+
 // Update the upload queue with the parameter fields of count
 func (q *UploadQueue) UpdateQueue(count int, err error, res *cosmosTypes.TxResponse) {
 	if !q.Locked || len(q.Queue) == 0 || len(q.Queue) < count {
@@ -113,6 +126,8 @@ func (q *UploadQueue) listenOnce(cmd *cobra.Command, providerName string) {
 	clientCtx := client.GetClientContextFromCmd(cmd)
 	ctx.Logger.Debug(fmt.Sprintf("total no. of msgs in proof transaction is: %d", len(msgs)))
 
+	q.MarkBroadcast(len(msgs))
+
 	res, err := utils.SendTx(clientCtx, cmd.Flags(), fmt.Sprintf("Storage Provided by %s", providerName), msgs...)
 
 	q.UpdateQueue(len(msgs), err, res)
@@ -117,3 +117,24 @@ func TestPrepareMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestMarkBroadcast(t *testing.T) {
+	q, require := setupQueue(t)
+
+	uploads := setupUpload(3)
+	called := make([]bool, len(uploads))
+	for i, u := range uploads {
+		i := i
+		u.OnBroadcast = func() {
+			called[i] = true
+		}
+		q.Append(u)
+	}
+
+	q.MarkBroadcast(2)
+	require.Equal([]bool{true, true, false}, called)
+
+	// out of range counts are ignored
+	q.MarkBroadcast(4)
+	require.Equal([]bool{true, true, false}, called)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+)
+
+// Uploads reserve the space they need before the provider accepts any of
+// their bytes. An upload is only admitted if it fits on the local disk and in
+// the space the provider declared on chain, after subtracting what other
+// uploads in progress still need.
+
+// the free space on chain is cached so uploads don't each hit the RPC node
+const chainSpaceTTL = time.Minute
+
+var ErrInsufficientStorage = errors.New("provider does not have enough free space")
+
+type capacity struct {
+	diskFree  func() (int64, error)
+	chainFree func() (int64, error)
+	// bytes that upload sessions still expect to receive
+	pending func() (int64, error)
+
+	mu       sync.Mutex
+	reserved int64 // total size of all reservations
+	received int64 // bytes of reservations that are already on disk
+
+	chainSpace   int64
+	chainSpaceAt time.Time
+}
+
+func newCapacity(diskFree, chainFree, pending func() (int64, error)) *capacity {
+	return &capacity{
+		diskFree:  diskFree,
+		chainFree: chainFree,
+		pending:   pending,
+	}
+}
+
+// diskFreeSpace returns the space available to unprivileged users on the
+// filesystem of dir.
+func diskFreeSpace(dir string) func() (int64, error) {
+	return func() (int64, error) {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(dir, &stat)
+		if err != nil {
+			return 0, err
+		}
+		return int64(stat.Bavail) * int64(stat.Bsize), nil
+	}
+}
+
+// archiveFreeSpace returns the free space of the disks of a, or of the disk
+// of dir if a is not spread over several disks.
+func archiveFreeSpace(a archive.Archive, dir string) func() (int64, error) {
+	if disks, ok := archive.Unwrap(a).(interface{ FreeSpace() (int64, error) }); ok {
+		return disks.FreeSpace
+	}
+	return diskFreeSpace(dir)
+}
+
+// chainFreeSpace returns the declared total space of the provider minus the
+// space used by its contracts.
+func chainFreeSpace(queryClient storageTypes.QueryClient, address string) func() (int64, error) {
+	return func() (int64, error) {
+		res, err := queryClient.Freespace(context.Background(), &storageTypes.QueryFreespaceRequest{
+			Address: address,
+		})
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(res.Space, 10, 64)
+	}
+}
+
+func (c *capacity) cachedChainFree() (int64, error) {
+	if time.Since(c.chainSpaceAt) < chainSpaceTTL {
+		return c.chainSpace, nil
+	}
+
+	space, err := c.chainFree()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query free space: %w", err)
+	}
+
+	c.chainSpace = space
+	c.chainSpaceAt = time.Now()
+	return space, nil
+}
+
+// check returns ErrInsufficientStorage if size more bytes can't be reserved.
+// The caller must hold c.mu.
+func (c *capacity) check(size int64) error {
+	pending, err := c.pending()
+	if err != nil {
+		return err
+	}
+
+	disk, err := c.diskFree()
+	if err != nil {
+		return err
+	}
+	// received bytes are already taken out of the free disk space
+	disk -= c.reserved - c.received + pending
+
+	chain, err := c.cachedChainFree()
+	if err != nil {
+		return err
+	}
+	chain -= c.reserved + pending
+
+	available := min(disk, chain)
+	if size > available {
+		return fmt.Errorf("%w: %d bytes needed, %d bytes available", ErrInsufficientStorage, size, max(available, 0))
+	}
+
+	return nil
+}
+
+// Reserve reserves size bytes for an upload. The reservation must be released
+// once the upload is stored or failed.
+func (c *capacity) Reserve(size int64) (*reservation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.check(size)
+	if err != nil {
+		return nil, err
+	}
+
+	c.reserved += size
+	return &reservation{capacity: c, size: size}, nil
+}
+
+type reservation struct {
+	capacity *capacity
+	size     int64
+	read     int64
+}
+
+// add accounts n more bytes read for the upload to the reservation, which is
+// extended if they don't fit.
+func (r *reservation) add(n int64) error {
+	c := r.capacity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if need := r.read + n - r.size; need > 0 {
+		err := c.check(need)
+		if err != nil {
+			return err
+		}
+
+		r.size += need
+		c.reserved += need
+	}
+
+	r.read += n
+	c.received += n
+	return nil
+}
+
+// Release returns the reserved space. It is safe to call more than once.
+func (r *reservation) Release() {
+	c := r.capacity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reserved -= r.size
+	c.received -= r.read
+	r.size = 0
+	r.read = 0
+}
+
+// Body wraps an upload body so the bytes it delivers are accounted to the
+// reservation, which grows if the body is larger than reserved.
+func (r *reservation) Body(body io.ReadCloser) io.ReadCloser {
+	return &reservedBody{ReadCloser: body, reservation: r}
+}
+
+type reservedBody struct {
+	io.ReadCloser
+	reservation *reservation
+}
+
+func (b *reservedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if addErr := b.reservation.add(int64(n)); addErr != nil {
+			return 0, addErr
+		}
+	}
+	return n, err
+}
+
+func capacityErrorStatus(err error) int {
+	if errors.Is(err, ErrInsufficientStorage) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fixedSpace(space *int64) func() (int64, error) {
+	return func() (int64, error) {
+		return *space, nil
+	}
+}
+
+func TestCapacityReserve(t *testing.T) {
+	require := require.New(t)
+
+	disk, chain, pending := int64(100), int64(80), int64(10)
+	c := newCapacity(fixedSpace(&disk), fixedSpace(&chain), fixedSpace(&pending))
+
+	// the declared space on chain is the limit, minus pending sessions
+	_, err := c.Reserve(71)
+	require.ErrorIs(err, ErrInsufficientStorage)
+
+	first, err := c.Reserve(50)
+	require.NoError(err)
+
+	_, err = c.Reserve(21)
+	require.ErrorIs(err, ErrInsufficientStorage)
+
+	first.Release()
+	first.Release()
+
+	second, err := c.Reserve(70)
+	require.NoError(err)
+	second.Release()
+
+	// a full disk limits uploads even with space left on chain
+	disk = 30
+	_, err = c.Reserve(21)
+	require.ErrorIs(err, ErrInsufficientStorage)
+	_, err = c.Reserve(20)
+	require.NoError(err)
+}
+
+func TestCapacityReservedBody(t *testing.T) {
+	require := require.New(t)
+
+	disk, chain, pending := int64(100), int64(100), int64(0)
+	c := newCapacity(fixedSpace(&disk), fixedSpace(&chain), fixedSpace(&pending))
+
+	// bodies of unknown length grow their reservation
+	reservation, err := c.Reserve(0)
+	require.NoError(err)
+	body := reservation.Body(io.NopCloser(bytes.NewReader(make([]byte, 60))))
+	_, err = io.Copy(io.Discard, body)
+	require.NoError(err)
+
+	// what was received is on disk already and only counts on chain
+	disk -= 60
+	_, err = c.Reserve(41)
+	require.ErrorIs(err, ErrInsufficientStorage)
+
+	other, err := c.Reserve(0)
+	require.NoError(err)
+	body = other.Body(io.NopCloser(bytes.NewReader(make([]byte, 41))))
+	_, err = io.Copy(io.Discard, body)
+	require.ErrorIs(err, ErrInsufficientStorage)
+	other.Release()
+
+	reservation.Release()
+	_, err = c.Reserve(40)
+	require.NoError(err)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/julienschmidt/httprouter"
+	merkletree "github.com/wealdtech/go-merkletree"
+)
+
+// Chunks are served with the merkle proof of their leaf so clients can verify
+// every chunk against the merkle root of the contract as it arrives.
+
+var (
+	ErrChunkNotFound = errors.New("chunk index is past the end of the file")
+	ErrInvalidChunk  = errors.New("stored chunk does not match the merkle tree")
+)
+
+// provenChunk returns chunk index of fid along with its merkle proof, the
+// file is split in chunks of chunkSize.
+func (f *FileServer) provenChunk(fid string, tree *merkletree.MerkleTree, index, chunkSize int64) (*types.ChunkResponse, error) {
+	data, err := f.archive.GetPiece(fid, index, chunkSize)
+	if errors.Is(err, io.EOF) {
+		return nil, ErrChunkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	valid, proof, err := GenerateMerkleProof(*tree, index, chunkSize, data)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, ErrInvalidChunk
+	}
+
+	return &types.ChunkResponse{
+		FID:   fid,
+		Index: index,
+		Data:  data,
+		Proof: proof,
+	}, nil
+}
+
+func chunkErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, ErrChunkNotFound):
+		return http.StatusRequestedRangeNotSatisfiable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// downloadChunk responds with a single chunk of a file and its proof.
+func (f *FileServer) downloadChunk(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	fid := ps.ByName("file")
+
+	index, err := strconv.ParseInt(ps.ByName("index"), 10, 64)
+	if err != nil || index < 0 {
+		f.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid chunk index: %s", ps.ByName("index")))
+		return
+	}
+
+	tree, err := f.archive.RetrieveTree(fid)
+	if err != nil {
+		f.writeError(w, chunkErrorStatus(err), err)
+		return
+	}
+
+	tw, release, err := f.downloads.throttleChunks(w, r, false)
+	if err != nil {
+		f.writeTooManyDownloads(w, err)
+		return
+	}
+	defer release()
+	w = tw
+
+	chunk, err := f.provenChunk(fid, tree, index, f.fileChunkSize(fid))
+	if err != nil {
+		f.writeError(w, chunkErrorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(chunk)
+	if err != nil {
+		f.logger.Error(fmt.Sprintf("downloadChunk: %s", err.Error()))
+	}
+}
+
+// streamChunks streams all chunks of a file starting at the start query
+// parameter as newline delimited JSON, each with its proof.
+func (f *FileServer) streamChunks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	fid := ps.ByName("file")
+
+	var start int64
+	if s := r.URL.Query().Get("start"); len(s) > 0 {
+		var err error
+		start, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || start < 0 {
+			f.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid start index: %s", s))
+			return
+		}
+	}
+
+	tree, err := f.archive.RetrieveTree(fid)
+	if err != nil {
+		f.writeError(w, chunkErrorStatus(err), err)
+		return
+	}
+
+	tw, release, err := f.downloads.throttleChunks(w, r, true)
+	if err != nil {
+		f.writeTooManyDownloads(w, err)
+		return
+	}
+	defer release()
+	w = tw
+
+	chunkSize := f.fileChunkSize(fid)
+
+	// the first chunk is read before writing anything so errors get a status
+	chunk, err := f.provenChunk(fid, tree, start, chunkSize)
+	if err != nil {
+		f.writeError(w, chunkErrorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for index := start + 1; ; index++ {
+		err = encoder.Encode(chunk)
+		if err != nil {
+			// the client went away
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		chunk, err = f.provenChunk(fid, tree, index, chunkSize)
+		if errors.Is(err, ErrChunkNotFound) {
+			return
+		}
+		if err != nil {
+			// the status is sent already, the last line reports the error
+			f.logger.Error(fmt.Sprintf("streamChunks: %s chunk %d: %s", fid, index, err.Error()))
+			_ = encoder.Encode(types.ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+}
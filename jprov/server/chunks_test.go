@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+// verifyChunk checks a chunk the way a light client does
+func verifyChunk(t *testing.T, root []byte, chunk types.ChunkResponse) {
+	leaf := sha256.Sum256([]byte(fmt.Sprintf("%d%s", chunk.Index, hex.EncodeToString(chunk.Data))))
+	valid, err := merkletree.VerifyProofUsing(leaf[:], false, chunk.Proof, [][]byte{root}, sha3.New512())
+	require.NoError(t, err)
+	require.True(t, valid)
+}
+
+func TestDownloadChunks(t *testing.T) {
+	f, _ := setupUploadServer(t)
+	f.blockSize = 10
+
+	data := make([]byte, 35)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(t, err)
+	_, err = f.finishUpload(file, "jklc1test", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(t, err)
+	root := file.Tree.Root()
+
+	router := httprouter.New()
+	router.GET("/download/:file", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		f.downfil(w, r, ps)
+	})
+	router.GET("/download/:file/chunk/:index", f.downloadChunk)
+	router.GET("/download/:file/chunks", f.streamChunks)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	t.Run("single_chunk", func(t *testing.T) {
+		w := get(fmt.Sprintf("/download/%s/chunk/3", file.Fid))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var chunk types.ChunkResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&chunk))
+		require.Equal(t, data[30:], chunk.Data)
+		verifyChunk(t, root, chunk)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		require.Equal(t, http.StatusRequestedRangeNotSatisfiable, get(fmt.Sprintf("/download/%s/chunk/4", file.Fid)).Code)
+		require.Equal(t, http.StatusBadRequest, get(fmt.Sprintf("/download/%s/chunk/x", file.Fid)).Code)
+		require.Equal(t, http.StatusNotFound, get("/download/jklf1missing/chunk/0").Code)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := get(fmt.Sprintf("/download/%s/chunks?start=1", file.Fid))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var received []byte
+		index := int64(1)
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var chunk types.ChunkResponse
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &chunk))
+			require.Equal(t, index, chunk.Index)
+			verifyChunk(t, root, chunk)
+
+			received = append(received, chunk.Data...)
+			index++
+		}
+		require.Equal(t, data[10:], received)
+	})
+	t.Run("stored_chunk_size", func(t *testing.T) {
+		// the chunk size was changed after the file was stored
+		f.blockSize = 20
+		defer func() { f.blockSize = 10 }()
+
+		w := get(fmt.Sprintf("/download/%s/chunk/3", file.Fid))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var chunk types.ChunkResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&chunk))
+		require.Equal(t, data[30:], chunk.Data)
+		verifyChunk(t, root, chunk)
+	})
+
+	t.Run("reserved", func(t *testing.T) {
+		f.downloads = newDownloadLimiter(0, 0, 1, 1)
+		f.downloads.queueTimeout = 50 * time.Millisecond
+		defer func() { f.downloads = newDownloadLimiter(0, 0, 0, 0) }()
+
+		// the client already downloads a file, chunks don't wait for it
+		_, release, err := f.downloads.Acquire(context.Background(), "192.0.2.1")
+		require.NoError(t, err)
+		defer release()
+
+		paths := []string{"/download/%s/chunk/0", "/download/%s/chunks"}
+		for _, path := range paths {
+			w := get(fmt.Sprintf(path, file.Fid))
+			require.Equal(t, http.StatusOK, w.Code, path)
+		}
+
+		// only the reserved slots are limited
+		for i := 0; i < reservedDownloads; i++ {
+			release, err := f.downloads.AcquireReserved(context.Background())
+			require.NoError(t, err)
+			defer release()
+		}
+		for _, path := range paths {
+			w := get(fmt.Sprintf(path, file.Fid))
+			require.Equal(t, http.StatusTooManyRequests, w.Code, path)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFile(t *testing.T) {
+	f, _ := setupUploadServer(t)
+
+	data := []byte("hello, world\n")
+	file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(t, err)
+	_, err = f.finishUpload(file, "jklc1test", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(t, err)
+
+	etag := fmt.Sprintf("%q", file.Fid)
+
+	cases := map[string]struct {
+		method    string
+		header    map[string]string
+		fid       string
+		expStatus int
+		expBody   string
+		expLength string
+	}{
+		"full": {
+			method:    http.MethodGet,
+			expStatus: http.StatusOK,
+			expBody:   string(data),
+			expLength: "13",
+		},
+		"head": {
+			method:    http.MethodHead,
+			expStatus: http.StatusOK,
+			expLength: "13",
+		},
+		"range": {
+			method:    http.MethodGet,
+			header:    map[string]string{"Range": "bytes=7-11"},
+			expStatus: http.StatusPartialContent,
+			expBody:   "world",
+			expLength: "5",
+		},
+		"unsatisfiable_range": {
+			method:    http.MethodGet,
+			header:    map[string]string{"Range": "bytes=100-"},
+			expStatus: http.StatusRequestedRangeNotSatisfiable,
+		},
+		"not_modified": {
+			method:    http.MethodGet,
+			header:    map[string]string{"If-None-Match": etag},
+			expStatus: http.StatusNotModified,
+		},
+		"not_found": {
+			method:    http.MethodGet,
+			fid:       "jklf1missing",
+			expStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			fid := file.Fid
+			if len(c.fid) > 0 {
+				fid = c.fid
+			}
+
+			r := httptest.NewRequest(c.method, "/download/"+fid, nil)
+			for k, v := range c.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+
+			f.downfil(w, r, httprouter.Params{{Key: "file", Value: fid}})
+
+			require.Equal(t, c.expStatus, w.Code)
+			if c.expStatus >= http.StatusBadRequest {
+				return
+			}
+			require.Equal(t, etag, w.Header().Get("ETag"))
+			require.Equal(t, fmt.Sprint(f.blockSize), w.Header().Get(types.ChunkSizeHeader))
+			require.Equal(t, c.expBody, w.Body.String())
+			if len(c.expLength) > 0 {
+				require.Equal(t, c.expLength, w.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
@@ -1,15 +1,16 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"math/rand"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
@@ -30,11 +31,16 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/spf13/cobra"
 
-	badger "github.com/dgraph-io/badger/v4"
-
 	_ "net/http/pprof"
 )
 
+const (
+	// uploads whose contract was posted are stored this often before they
+	// are discarded, waiting storeRetryDelay longer every time
+	storeAttempts   = 3
+	storeRetryDelay = 100 * time.Millisecond
+)
+
 type FileServer struct {
 	config      *utils.Config
 	cmd         *cobra.Command
@@ -48,6 +54,12 @@ type FileServer struct {
 	queue       *queue.UploadQueue
 	logger      *slog.Logger
 	ipfsArchive *archive.IpfsArchive
+	sessions    *uploadSessionStore
+	jobs        *uploadJobs
+	auth        *uploadAuthenticator
+	capacity    *capacity
+	downloads   *downloadLimiter
+	scrubber    *scrubber // nil if scrubbing is turned off
 }
 
 func NewFileServer(
@@ -64,40 +76,96 @@ func NewFileServer(
 		return nil, err
 	}
 
+	requireSignature, err := cmd.Flags().GetBool(types.FlagRequireSignature)
+	if err != nil {
+		return nil, err
+	}
+
+	downloads, err := downloadLimiterFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	scrubRate, err := cmd.Flags().GetInt64(types.FlagScrubRate)
+	if err != nil {
+		return nil, err
+	}
+
+	treeCacheSize, err := cmd.Flags().GetInt64(types.FlagTreeCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	fileArchive, err := utils.NewArchive(cmd, sCtx.Config.BaseConfig.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	if treeCacheSize > 0 {
+		cache := archive.NewTreeCache(fileArchive, treeCacheSize<<20) // MiB
+		publishTreeCacheStats(cache)
+		fileArchive = cache
+	}
+
 	srvrCtx, err := newServerContext(cmd)
 	if err != nil {
 		return nil, err
 	}
 
-	err = os.MkdirAll(sCtx.Config.IpfsConfig.Directory, os.ModePerm)
+	ipfsArchive, err := utils.OpenIpfsArchive(cmd)
 	if err != nil {
-		return nil, errors.Join(errors.New("failed to create ipfs directory"), err)
+		return nil, err
 	}
 
-	options := badger.DefaultOptions(sCtx.Config.IpfsConfig.Directory)
-	db, err := badger.Open(options)
+	sessions, err := newUploadSessionStore(utils.GetUploadSessionsPath(clientCtx))
 	if err != nil {
 		return nil, err
 	}
-	ipfsArchive, err := archive.NewIpfsArchive(db, sCtx.Config.IpfsConfig.Port)
+
+	auth, err := newUploadAuthenticator(srvrCtx.address, requireSignature, accountPubKey(clientCtx), utils.GetUploadSignaturesPath(clientCtx))
 	if err != nil {
 		return nil, err
 	}
 
 	queue := queue.New()
 
+	queryClient := storageTypes.NewQueryClient(clientCtx)
+
+	var scrub *scrubber
+	if scrubRate > 0 {
+		scrub = newScrubber(
+			fileArchive,
+			archivedb,
+			blockSize,
+			sCtx.Config.BaseConfig.RootDir,
+			serverCtx.Logger,
+			scrubRate<<10, // KiB/s
+			chainMerkle(queryClient),
+			chainProviders(queryClient, srvrCtx.address),
+		)
+	}
+
 	return &FileServer{
 		config:      nil,
 		cmd:         cmd,
 		serverCtx:   srvrCtx,
-		archive:     archive.NewSingleCellArchive(sCtx.Config.BaseConfig.RootDir),
+		archive:     fileArchive,
 		archivedb:   archivedb,
 		downtimedb:  downtimedb,
 		blockSize:   blockSize,
-		queryClient: storageTypes.NewQueryClient(clientCtx),
+		queryClient: queryClient,
 		queue:       &queue,
 		logger:      serverCtx.Logger,
 		ipfsArchive: ipfsArchive,
+		sessions:    sessions,
+		jobs:        newUploadJobs(),
+		auth:        auth,
+		capacity: newCapacity(
+			archiveFreeSpace(fileArchive, sCtx.Config.BaseConfig.RootDir),
+			chainFreeSpace(queryClient, srvrCtx.address),
+			sessions.Pending,
+		),
+		downloads: downloads,
+		scrubber:  scrub,
 	}, nil
 }
 
@@ -119,70 +187,196 @@ func NewServerLogger(config config) (*slog.Logger, error) {
 	return NewCtxLogger(handler), nil
 }
 
-func (f *FileServer) saveFile(file multipart.File, handler *multipart.FileHeader, sender string, w *http.ResponseWriter) error {
-	fid, err := utils.MakeFID(file, file)
+func (f *FileServer) saveFile(file *utils.IngestedFile, sender string, async bool, w *http.ResponseWriter) error {
+	fid := file.Fid
+	tree := file.Tree
+
+	cid, err := buildCid(f.serverCtx.address, sender, fid)
 	if err != nil {
-		return err
+		return errors.Join(err, file.Discard())
 	}
 
-	tree, err := utils.CreateMerkleTree(f.blockSize, handler.Size, file, file)
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	if async {
+		return f.saveFileAsync(file, cid, sender, &wg, w)
+	}
+
+	msg, ctrErr := f.MakeContract(fid, sender, &wg, string(tree.Root()), fmt.Sprintf("%d", file.Size))
+	if ctrErr != nil {
+		f.logger.Error(fmt.Errorf("saveFile: CONTRACT ERROR: %w", ctrErr).Error())
+		return errors.Join(ctrErr, file.Discard())
+	}
+	wg.Wait()
+
+	dedup, err := f.finishUpload(file, cid, msg)
 	if err != nil {
+		f.logger.Error(fmt.Errorf("saveFile: %w", err).Error())
 		return err
 	}
 
-	err = f.archive.WriteTreeToDisk(fid, tree)
-	if err != nil {
+	if err = writeResponse(*w, *msg, fid, cid, dedup); err != nil {
+		f.logger.Error(fmt.Errorf("json Encode Error: %w", err).Error())
 		return err
 	}
 
-	_, err = f.archive.WriteFileToDisk(file, fid)
+	return nil
+}
+
+// saveFileAsync queues the contract and responds with a job that can be
+// polled instead of waiting for the transaction.
+func (f *FileServer) saveFileAsync(file *utils.IngestedFile, cid, sender string, wg *sync.WaitGroup, w *http.ResponseWriter) error {
+	msg, err := f.newContract(file.Fid, sender, wg, string(file.Tree.Root()), fmt.Sprintf("%d", file.Size))
 	if err != nil {
-		f.logger.Error(fmt.Errorf("saveFile: Write To Disk Error: %w", err).Error())
-		return err
+		f.logger.Error(fmt.Errorf("saveFile: CONTRACT ERROR: %w", err).Error())
+		return errors.Join(err, file.Discard())
 	}
 
-	cid, err := buildCid(f.serverCtx.address, sender, fid)
+	job, err := f.jobs.Add(file.Fid, cid)
 	if err != nil {
-		return err
+		return errors.Join(err, file.Discard())
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	msg.OnBroadcast = func() {
+		job.setStatus(types.UploadBroadcast)
+	}
+	f.queue.Queue = append(f.queue.Queue, msg)
 
-	msg, ctrErr := f.MakeContract(fid, sender, &wg, string(tree.Root()), fmt.Sprintf("%d", handler.Size))
-	if ctrErr != nil {
-		f.logger.Error(fmt.Errorf("saveFile: CONTRACT ERROR: %w", ctrErr).Error())
-		return ctrErr
+	go f.waitForContract(job, file, msg, wg)
+
+	return writeJobResponse(*w, http.StatusAccepted, job)
+}
+
+// finishUpload stores the staged file once its contract was processed by the
+// queue. If the contract failed or the file can't be stored the staged file is
+// removed, a stored file missing from the database is added when active deals
+// are recollected on the next start. Files the archive already holds intact are not written again,
+// dedup reports if only the contract was added.
+func (f *FileServer) finishUpload(file *utils.IngestedFile, cid string, msg *types.Upload) (dedup bool, err error) {
+	err = contractError(msg)
+	if err != nil {
+		return false, errors.Join(err, file.Discard())
 	}
-	wg.Wait()
 
-	if msg.Err != nil {
-		f.logger.Error(msg.Err.Error())
+	// other contracts might already keep this file, it must stay on disk then
+	stored := !f.archive.FileExist(file.Fid) // FileExist is true for missing files
+
+	if stored {
+		intact, err := f.verifyStoredFile(file)
+		if err != nil {
+			f.logger.Error(fmt.Sprintf("failed to verify stored file %s: %s", file.Fid, err.Error()))
+		}
+		dedup = intact
 	}
 
-	if err = writeResponse(*w, *msg, fid, cid); err != nil {
-		f.logger.Error(fmt.Errorf("json Encode Error: %w", err).Error())
-		return err
+	if dedup {
+		if discardErr := file.Discard(); discardErr != nil {
+			f.logger.Error(fmt.Sprintf("failed to discard duplicate of %s: %s", file.Fid, discardErr.Error()))
+		}
+		err = f.storeUpload(file, cid, false)
+		if err != nil {
+			f.logger.Error(fmt.Sprintf("contract %s was posted but not added to the database, it is added when active deals are recollected on the next start: %s", cid, err.Error()))
+			return false, err
+		}
+		f.updateMetadata(cid, uploadMetadata(msg, f.blockSize))
+		f.logger.Info(fmt.Sprintf("%s %s", file.Fid, "already stored, added contract to database"))
+		return true, nil
 	}
 
-	err = f.saveToDatabase(fid, cid)
+	err = f.storeUpload(file, cid, true)
+	if err != nil && len(file.Stage()) > 0 {
+		// nothing can commit the file later, the contract misses its proofs
+		f.logger.Error(fmt.Sprintf("contract %s was posted but %s could not be stored: %s", cid, file.Fid, err.Error()))
+		return false, errors.Join(err, file.Discard())
+	}
 	if err != nil {
-		return err
+		f.logger.Error(fmt.Sprintf("contract %s was posted but not added to the database, it is added when active deals are recollected on the next start: %s", cid, err.Error()))
+		return false, err
+	}
+	f.updateMetadata(cid, uploadMetadata(msg, f.blockSize))
+	f.logger.Info(fmt.Sprintf("%s %s", file.Fid, "Added to database"))
+
+	return false, nil
+}
+
+// storeUpload commits file if commit is set and records its contract cid.
+// The contract was posted already, failures are retried before giving up.
+func (f *FileServer) storeUpload(file *utils.IngestedFile, cid string, commit bool) (err error) {
+	for attempt := 0; attempt < storeAttempts; attempt++ {
+		time.Sleep(time.Duration(attempt) * storeRetryDelay)
+
+		if commit {
+			err = file.Commit()
+			if err != nil {
+				continue
+			}
+			commit = false
+		}
+		err = f.saveToDatabase(file.Fid, cid)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyStoredFile checks that the archive holds a file of the same size
+// and merkle tree as file under its fid. The data is not hashed again, the
+// scrubber finds copies that were damaged on disk.
+func (f *FileServer) verifyStoredFile(file *utils.IngestedFile) (intact bool, err error) {
+	tree, err := f.archive.RetrieveTree(file.Fid)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(tree.Root(), file.Tree.Root()) {
+		return false, nil
+	}
+
+	data, err := f.archive.RetrieveFile(file.Fid)
+	if err != nil {
+		return false, err
 	}
-	f.logger.Info(fmt.Sprintf("%s %s", fid, "Added to database"))
+	defer func() {
+		err = errors.Join(err, data.Close())
+	}()
+
+	size, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	return size == file.Size, nil
+}
 
+func contractError(msg *types.Upload) error {
+	if msg.Err != nil {
+		return msg.Err
+	}
+	if msg.Response == nil {
+		return errors.New("no response from transaction")
+	}
 	return nil
 }
 
+// saveToDatabase either saves both references of the contract or none.
 func (f *FileServer) saveToDatabase(fid string, cid string) error {
-	err := f.downtimedb.Set(cid, 0)
+	err := f.archivedb.SetContract(cid, fid)
+	if errors.Is(err, archive.ErrContractAlreadyExists) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return f.archivedb.SetContract(cid, fid)
+
+	err = f.downtimedb.Set(cid, 0)
+	if err != nil {
+		_, delErr := f.archivedb.DeleteContract(cid)
+		return errors.Join(err, delErr)
+	}
+	return nil
 }
 
-func writeResponse(w http.ResponseWriter, upload types.Upload, fid, cid string) error {
+func writeResponse(w http.ResponseWriter, upload types.Upload, fid, cid string, dedup bool) error {
 	if upload.Err != nil {
 		resp := types.ErrorResponse{
 			Error: upload.Err.Error(),
@@ -207,14 +401,27 @@ func writeResponse(w http.ResponseWriter, upload types.Upload, fid, cid string)
 	}
 
 	resp := types.UploadResponse{
-		CID: cid,
-		FID: fid,
+		CID:          cid,
+		FID:          fid,
+		Deduplicated: dedup,
 	}
 
 	return json.NewEncoder(w).Encode(resp)
 }
 
 func (f *FileServer) MakeContract(fid string, sender string, wg *sync.WaitGroup, merkleroot string, filesize string) (*types.Upload, error) {
+	k, err := f.newContract(fid, sender, wg, merkleroot, filesize)
+	if err != nil {
+		return nil, err
+	}
+
+	f.queue.Queue = append(f.queue.Queue, k)
+
+	return k, nil
+}
+
+// newContract creates the upload for a MsgPostContract without queueing it
+func (f *FileServer) newContract(fid string, sender string, wg *sync.WaitGroup, merkleroot string, filesize string) (*types.Upload, error) {
 	xRoot := hex.EncodeToString([]byte(merkleroot))
 
 	msg := storageTypes.NewMsgPostContract(
@@ -237,11 +444,7 @@ func (f *FileServer) MakeContract(fid string, sender string, wg *sync.WaitGroup,
 		Response: nil,
 	}
 
-	k := &u
-
-	f.queue.Queue = append(f.queue.Queue, k)
-
-	return k, nil
+	return &u, nil
 }
 
 func (f *FileServer) Init() error {
@@ -271,11 +474,40 @@ func (f *FileServer) RecollectActiveDeals() error {
 		if err != nil && !errors.Is(err, archive.ErrContractAlreadyExists) {
 			return err
 		}
+		f.updateMetadata(q.Cid, dealMetadata(q))
 	}
 
 	return nil
 }
 
+// migrateStorageLayout moves files that are still stored in the flat layout
+// to the sharded layout and rebalances disks while the provider is running.
+func (f *FileServer) migrateStorageLayout() {
+	// encrypted files are moved as they are
+	base := archive.Unwrap(f.archive)
+	migrator, ok := base.(interface{ MigrateFlatLayout() (int, error) })
+	if ok {
+		moved, err := migrator.MigrateFlatLayout()
+		if err != nil {
+			f.logger.Error(fmt.Sprintf("migrateStorageLayout: %s", err.Error()))
+		}
+		if moved > 0 {
+			f.logger.Info(fmt.Sprintf("moved %d files to the sharded storage layout", moved))
+		}
+	}
+
+	disks, ok := base.(*archive.MultiDiskArchive)
+	if ok {
+		moved, err := disks.Rebalance()
+		if err != nil {
+			f.logger.Error(fmt.Sprintf("migrateStorageLayout: failed to rebalance disks: %s", err.Error()))
+		}
+		if moved > 0 {
+			f.logger.Info(fmt.Sprintf("moved %d files between disks", moved))
+		}
+	}
+}
+
 func (f *FileServer) StartFileServer(cmd *cobra.Command) {
 	defer func() {
 		log.Printf("Closing database...\n")
@@ -312,6 +544,12 @@ func (f *FileServer) StartFileServer(cmd *cobra.Command) {
 	go f.StartProofServer(interval)
 	go NatCycle(cmd.Context())
 	go f.queue.StartListener(cmd, providerName)
+	go f.StartUploadSessionCleaner()
+	go f.migrateStorageLayout()
+	if f.scrubber != nil {
+		go f.scrubber.run()
+	}
+	go f.StartPinReconciler()
 
 	report, err := cmd.Flags().GetBool(types.FlagDoReport)
 	if err != nil {
@@ -18,6 +18,7 @@ func TestWriteResponse(t *testing.T) {
 		fid       string
 		cid       string
 		hasMsgErr bool
+		dedup     bool
 		expErr    bool
 	}{
 		"no_error_response": {
@@ -26,6 +27,13 @@ func TestWriteResponse(t *testing.T) {
 			hasMsgErr: false,
 			expErr:    false,
 		},
+		"deduplicated_response": {
+			fid:       "1",
+			cid:       "1",
+			hasMsgErr: false,
+			dedup:     true,
+			expErr:    false,
+		},
 	}
 
 	for name, c := range cases {
@@ -38,12 +46,13 @@ func TestWriteResponse(t *testing.T) {
 				upload.Err = errors.New("example error")
 			}
 
-			err := server.WriteResponse(rec, upload, c.fid, c.cid)
+			err := server.WriteResponse(rec, upload, c.fid, c.cid, c.dedup)
 			assert.NoError(t, err)
 
 			resp := types.UploadResponse{
-				CID: c.cid,
-				FID: c.fid,
+				CID:          c.cid,
+				FID:          c.fid,
+				Deduplicated: c.dedup,
 			}
 
 			expResult, err := json.Marshal(resp)
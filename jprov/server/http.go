@@ -2,17 +2,27 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/cosmos/cosmos-sdk/version"
+	ufsio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
 
 	"github.com/julienschmidt/httprouter"
 
 	"github.com/JackalLabs/jackal-provider/jprov/api"
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
 	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
 )
 
 func (f *FileServer) indexres(w http.ResponseWriter) {
@@ -46,7 +56,9 @@ func (f *FileServer) checkVersion(w http.ResponseWriter) {
 	}
 }
 
-func (f *FileServer) downfil(w http.ResponseWriter, ps httprouter.Params) {
+// downfil serves a stored file. Files never change, their fid is used as
+// ETag, and range requests are supported for partial downloads.
+func (f *FileServer) downfil(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	fid := string(ps.ByName("file"))
 	file, err := f.archive.RetrieveFile(fid)
 	if err != nil {
@@ -59,17 +71,70 @@ func (f *FileServer) downfil(w http.ResponseWriter, ps httprouter.Params) {
 		}
 	}()
 
-	written, err := io.Copy(w, file)
+	if r.Method == http.MethodGet {
+		tw, release, err := f.downloads.throttle(w, r)
+		if err != nil {
+			f.writeTooManyDownloads(w, err)
+			return
+		}
+		defer release()
+		w = tw
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("%q", fid))
+	w.Header().Set(types.ChunkSizeHeader, strconv.FormatInt(f.fileChunkSize(fid), 10))
+	http.ServeContent(w, r, fid, time.Time{}, file)
+}
+
+// ipfsGateway serves files of the ipfs archive by the cid of their root.
+// Only blocks stored by the provider are read, nothing is fetched from the
+// network.
+func (f *FileServer) ipfsGateway(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	c, err := cid.Decode(ps.ByName("cid"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	file, err := f.ipfsArchive.OpenCid(c)
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ufsio.ErrIsDir) {
+		http.Error(w, "directories are not supported", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		f.logger.Error(fmt.Sprintf("downfil: %s", err.Error()))
+		f.logger.Error(fmt.Sprintf("ipfsGateway: %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			f.logger.Error(fmt.Sprintf("ipfsGateway: %s", err.Error()))
+		}
+	}()
+
+	if r.Method == http.MethodGet {
+		tw, release, err := f.downloads.throttle(w, r)
+		if err != nil {
+			f.writeTooManyDownloads(w, err)
+			return
+		}
+		defer release()
+		w = tw
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", written))
+	// the content of a cid never changes
+	w.Header().Set("ETag", fmt.Sprintf("%q", c.String()))
+	w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	http.ServeContent(w, r, "", time.Time{}, file)
 }
 
 func (f *FileServer) GetRoutes(router *httprouter.Router) {
 	dfil := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		f.downfil(w, ps)
+		f.downfil(w, r, ps)
 	}
 
 	ires := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -80,6 +145,21 @@ func (f *FileServer) GetRoutes(router *httprouter.Router) {
 		f.checkVersion(w)
 	})
 	router.GET("/download/:file", dfil)
+	router.HEAD("/download/:file", dfil)
+	router.GET("/download/:file/chunk/:index", f.downloadChunk)
+	router.GET("/download/:file/chunks", f.streamChunks)
+	router.GET("/ipfs/:cid", f.ipfsGateway)
+	router.HEAD("/ipfs/:cid", f.ipfsGateway)
+
+	sess := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		f.uploadSessionStatus(w, ps)
+	}
+	router.GET("/upload/session/:id", sess)
+	router.HEAD("/upload/session/:id", sess)
+
+	router.GET("/upload/status/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		f.uploadStatus(w, ps)
+	})
 
 	api.BuildApi(f.cmd, f.queue, router, f.archivedb, f.downtimedb)
 
@@ -94,6 +174,20 @@ func (f *FileServer) PostRoutes(router *httprouter.Router) {
 	router.POST("/upload", upfil)
 	router.POST("/u", upfil)
 
+	router.POST("/upload/batch", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		f.fileUploadBatch(w, r)
+	})
+
+	router.POST("/upload/session", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		f.createUploadSession(w, r)
+	})
+	router.PATCH("/upload/session/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		f.patchUploadSession(w, r, ps)
+	})
+	router.POST("/upload/session/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		f.finalizeUploadSession(&w, r, ps)
+	})
+
 	router.POST("/attest", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		err := f.handleAttestRequest(&w, r)
 		if err != nil {
@@ -103,6 +197,7 @@ func (f *FileServer) PostRoutes(router *httprouter.Router) {
 }
 
 func PProfRoutes(router *httprouter.Router) {
+	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 	router.HandlerFunc(http.MethodGet, "/debug/pprof/", pprof.Index)
 	router.HandlerFunc(http.MethodGet, "/debug/pprof/cmdline", pprof.Cmdline)
 	router.HandlerFunc(http.MethodGet, "/debug/pprof/profile", pprof.Profile)
@@ -114,28 +209,156 @@ func PProfRoutes(router *httprouter.Router) {
 	router.Handler(http.MethodGet, "/debug/pprof/block", pprof.Handler("block"))
 }
 
+// maxFieldLength bounds the text values of the upload form, addresses and
+// signatures are far shorter
+const maxFieldLength = 256
+
+func readFormField(part io.Reader) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldLength))
+	return string(value), err
+}
+
+// uploadForm holds the fields of an upload form. Its files are staged in the
+// archive and must be committed or discarded.
+type uploadForm struct {
+	sender     string
+	signatures []string
+	timestamp  string
+	files      []*utils.IngestedFile
+}
+
+func (u *uploadForm) discard() error {
+	var err error
+	for _, file := range u.files {
+		err = errors.Join(err, file.Discard())
+	}
+	u.files = nil
+	return err
+}
+
+// readUploadParts streams the multipart form of an upload. File parts are
+// ingested into the archive as they arrive instead of being buffered first.
+func (f *FileServer) readUploadParts(r *http.Request, maxFiles int) (form *uploadForm, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form = &uploadForm{}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, form.discard())
+			form = nil
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return form, err
+		}
+
+		switch part.FormName() {
+		case "sender":
+			form.sender, err = readFormField(part)
+		case "signature":
+			var signature string
+			signature, err = readFormField(part)
+			form.signatures = append(form.signatures, signature)
+		case "timestamp":
+			form.timestamp, err = readFormField(part)
+		case "file":
+			if len(form.files) == maxFiles {
+				return form, fmt.Errorf("at most %d files can be uploaded per request", maxFiles)
+			}
+			var file *utils.IngestedFile
+			file, err = utils.IngestFile(f.archive, part, f.blockSize)
+			if file != nil {
+				form.files = append(form.files, file)
+			}
+		}
+		if err != nil {
+			return form, err
+		}
+	}
+
+	if len(form.files) == 0 {
+		return form, http.ErrMissingFile
+	}
+
+	if len(form.sender) == 0 {
+		form.sender = r.URL.Query().Get("sender")
+	}
+
+	return form, nil
+}
+
+// signature returns the upload signature of the i-th file of the form, or nil
+// if the form is not signed.
+func (u *uploadForm) signature(i int) (*uploadSignature, error) {
+	if len(u.signatures) == 0 {
+		return parseUploadSignature("", u.timestamp)
+	}
+	if len(u.signatures) != len(u.files) {
+		return nil, fmt.Errorf("%w: expected %d signatures, got %d", ErrInvalidSignature, len(u.files), len(u.signatures))
+	}
+	return parseUploadSignature(u.signatures[i], u.timestamp)
+}
+
+// readUploadForm reads the form of a single file upload.
+func (f *FileServer) readUploadForm(r *http.Request) (sender string, sig *uploadSignature, file *utils.IngestedFile, err error) {
+	form, err := f.readUploadParts(r, 1)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	sig, err = form.signature(0)
+	if err != nil {
+		return "", nil, nil, errors.Join(err, form.discard())
+	}
+
+	return form.sender, sig, form.files[0], nil
+}
+
 // This function returns the filename(to save in database) of the saved file
 // or an error if it occurs
 func (f *FileServer) fileUpload(w *http.ResponseWriter, r *http.Request) {
-	// ParseMultipartForm parses a request body as multipart/form-data
-	err := r.ParseMultipartForm(types.MaxFileSize) // MAX file size lives here
+	// reject uploads we have no room for before reading them, bodies of
+	// unknown length extend the reservation as they arrive
+	reservation, err := f.capacity.Reserve(max(r.ContentLength, 0))
+	if err != nil {
+		f.writeError(*w, capacityErrorStatus(err), err)
+		return
+	}
+	defer reservation.Release()
+
+	r.Body = http.MaxBytesReader(*w, reservation.Body(r.Body), types.MaxFileSize) // MAX file size lives here
+
+	sender, sig, file, err := f.readUploadForm(r)
 	if err != nil {
 		f.logger.Error("Error with parsing form!")
 		v := types.ErrorResponse{
 			Error: err.Error(),
 		}
-		(*w).WriteHeader(http.StatusInternalServerError)
+		(*w).WriteHeader(capacityErrorStatus(err))
 		err = json.NewEncoder(*w).Encode(v)
 		if err != nil {
 			f.logger.Error(err.Error())
 		}
 		return
 	}
-	sender := r.Form.Get("sender")
 
-	file, handler, err := r.FormFile("file") // Retrieve the file from form data
+	err = f.auth.Verify(sender, file, sig)
+	if err != nil {
+		f.writeError(*w, http.StatusUnauthorized, errors.Join(err, file.Discard()))
+		return
+	}
+
+	err = f.saveFile(file, sender, isAsync(r), w)
 	if err != nil {
-		f.logger.Error("Error with form file!")
 		v := types.ErrorResponse{
 			Error: err.Error(),
 		}
@@ -144,18 +367,193 @@ func (f *FileServer) fileUpload(w *http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			f.logger.Error(err.Error())
 		}
+	}
+}
+
+// UploadOffsetHeader carries the offset of a resumable upload chunk
+const UploadOffsetHeader = "Upload-Offset"
+
+func (f *FileServer) writeError(w http.ResponseWriter, status int, err error) {
+	v := types.ErrorResponse{
+		Error: err.Error(),
+	}
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		f.logger.Error(err.Error())
+	}
+}
+
+func (f *FileServer) writeSession(w http.ResponseWriter, status int, id string, offset, size int64) {
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.WriteHeader(status)
+
+	v := types.UploadSessionResponse{
+		ID:     id,
+		Offset: offset,
+		Size:   size,
+	}
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		f.logger.Error(err.Error())
+	}
+}
+
+func sessionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrOffsetMismatch), errors.Is(err, ErrSessionIncomplete), errors.Is(err, ErrSessionFinalizing):
+		return http.StatusConflict
+	case errors.Is(err, ErrSessionOverflow):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// createUploadSession starts a resumable upload. The form must contain the
+// sender and the total size of the file in bytes.
+func (f *FileServer) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	sender := r.FormValue("sender")
+	if len(sender) == 0 {
+		f.writeError(w, http.StatusBadRequest, errors.New("sender is empty"))
 		return
 	}
 
-	err = f.saveFile(file, handler, sender, w)
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
 	if err != nil {
-		v := types.ErrorResponse{
-			Error: err.Error(),
-		}
-		(*w).WriteHeader(http.StatusInternalServerError)
-		err = json.NewEncoder(*w).Encode(v)
-		if err != nil {
-			f.logger.Error(err.Error())
+		f.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid size: %w", err))
+		return
+	}
+	if size <= 0 || size > types.MaxFileSize {
+		f.writeError(w, http.StatusBadRequest, fmt.Errorf("size must be between 1 and %d bytes", int64(types.MaxFileSize)))
+		return
+	}
+
+	// once created the session itself counts as pending space
+	reservation, err := f.capacity.Reserve(size)
+	if err != nil {
+		f.writeError(w, capacityErrorStatus(err), err)
+		return
+	}
+	defer reservation.Release()
+
+	session, err := f.sessions.Create(sender, size)
+	if err != nil {
+		f.logger.Error(fmt.Sprintf("createUploadSession: %s", err.Error()))
+		f.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/upload/session/%s", session.ID))
+	f.writeSession(w, http.StatusCreated, session.ID, 0, session.Size)
+}
+
+// patchUploadSession appends the request body to the session at the offset
+// given in the Upload-Offset header.
+func (f *FileServer) patchUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil {
+		f.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s header: %w", UploadOffsetHeader, err))
+		return
+	}
+
+	newOffset, err := f.sessions.Append(id, offset, r.Body)
+	if err != nil {
+		if !errors.Is(err, ErrSessionNotFound) {
+			w.Header().Set(UploadOffsetHeader, strconv.FormatInt(newOffset, 10))
 		}
+		f.writeError(w, sessionErrorStatus(err), err)
+		return
+	}
+
+	session, _, err := f.sessions.Get(id)
+	if err != nil {
+		f.writeError(w, sessionErrorStatus(err), err)
+		return
+	}
+
+	f.writeSession(w, http.StatusOK, id, newOffset, session.Size)
+}
+
+func (f *FileServer) uploadSessionStatus(w http.ResponseWriter, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	session, offset, err := f.sessions.Get(id)
+	if err != nil {
+		f.writeError(w, sessionErrorStatus(err), err)
+		return
+	}
+
+	f.writeSession(w, http.StatusOK, id, offset, session.Size)
+}
+
+// finalizeUploadSession hands a completed session over to the regular upload
+// flow and removes the session once the contract has been posted.
+func (f *FileServer) finalizeUploadSession(w *http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+
+	done, err := f.sessions.BeginFinalize(id)
+	if err != nil {
+		f.writeError(*w, sessionErrorStatus(err), err)
+		return
+	}
+	defer done()
+
+	data, session, err := f.sessions.Open(id)
+	if err != nil {
+		f.writeError(*w, sessionErrorStatus(err), err)
+		return
+	}
+
+	// the session data is copied into the archive
+	reservation, err := f.capacity.Reserve(session.Size)
+	if err != nil {
+		f.writeError(*w, capacityErrorStatus(err), errors.Join(err, data.Close()))
+		return
+	}
+	defer reservation.Release()
+
+	file, err := utils.IngestFile(f.archive, data, f.blockSize)
+	if closeErr := data.Close(); closeErr != nil {
+		f.logger.Error(fmt.Sprintf("finalizeUploadSession: %s", closeErr.Error()))
+	}
+	if err != nil {
+		f.writeError(*w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sig, err := parseUploadSignature(r.FormValue("signature"), r.FormValue("timestamp"))
+	if err == nil {
+		err = f.auth.Verify(session.Sender, file, sig)
+	}
+	if err != nil {
+		f.writeError(*w, http.StatusUnauthorized, errors.Join(err, file.Discard()))
+		return
 	}
+
+	err = f.saveFile(file, session.Sender, isAsync(r), w)
+	if err != nil {
+		f.writeError(*w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = f.sessions.Delete(id)
+	if err != nil {
+		f.logger.Error(fmt.Sprintf("finalizeUploadSession: failed to remove session %s: %s", id, err.Error()))
+	}
+}
+
+var publishTreeCache sync.Once
+
+// publishTreeCacheStats shows the stats of cache at /debug/vars.
+func publishTreeCacheStats(cache *archive.TreeCache) {
+	publishTreeCache.Do(func() {
+		expvar.Publish("tree_cache", expvar.Func(func() any {
+			return cache.Stats()
+		}))
+	})
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+)
+
+const (
+	pinReconcileInterval = time.Hour
+	// how long pinning a file may take to fetch its missing blocks
+	pinFetchTimeout = 10 * time.Minute
+)
+
+// StartPinReconciler keeps the files of the ipfs archive in line with the
+// active deals of the provider.
+func (f *FileServer) StartPinReconciler() {
+	for {
+		err := f.runPinReconciler()
+		if err != nil {
+			f.logger.Error(fmt.Sprintf("pin reconciler: %s", err.Error()))
+		}
+
+		time.Sleep(pinReconcileInterval)
+	}
+}
+
+func (f *FileServer) runPinReconciler() error {
+	files, err := f.ipfsArchive.Files()
+	if err != nil {
+		return err
+	}
+
+	// listing all deals is expensive and not needed without files
+	deals := make([]storageTypes.LegacyActiveDeals, 0)
+	if len(files) > 0 {
+		deals, err = f.QueryOnlyMyActiveDeals()
+		if err != nil {
+			return errors.Join(errors.New("failed to collect active deals"), err)
+		}
+	}
+
+	pinned, deleted, removed, err := f.reconcilePins(context.Background(), deals)
+	f.logger.Info(fmt.Sprintf("pinned %d ipfs files, deleted %d and removed %d unused blocks", pinned, deleted, removed))
+	return err
+}
+
+// reconcilePins pins the files of the ipfs archive that belong to deals and
+// deletes the files that neither a deal nor a contract of the database
+// needs, e.g. once a deal ended. The blocks no file uses anymore are
+// removed afterwards.
+func (f *FileServer) reconcilePins(ctx context.Context, deals []storageTypes.LegacyActiveDeals) (pinned, deleted, removed int, err error) {
+	files, err := f.ipfsArchive.Files()
+	if err != nil {
+		return
+	}
+
+	needed := dealFids(deals)
+	for fid := range files {
+		if needed[fid] {
+			err := f.pin(ctx, fid)
+			if err != nil {
+				f.logger.Error(fmt.Sprintf("failed to pin %x: %s", fid, err.Error()))
+				continue
+			}
+			pinned++
+			continue
+		}
+
+		// contracts are in the database before their deal is on chain
+		_, err = f.archivedb.GetContracts(fid)
+		if err == nil {
+			continue
+		} else if !errors.Is(err, archive.ErrFidNotFound) {
+			return
+		}
+
+		err = f.ipfsArchive.Delete(fid)
+		if err != nil {
+			return
+		}
+		deleted++
+	}
+
+	removed, err = f.ipfsArchive.CollectGarbage(ctx)
+	return
+}
+
+func (f *FileServer) pin(ctx context.Context, fid string) error {
+	ctx, cancel := context.WithTimeout(ctx, pinFetchTimeout)
+	defer cancel()
+	return f.ipfsArchive.Pin(ctx, fid)
+}
+
+// dealFids returns the fids that the deals need. Files moved to ipfs by the
+// ipfs upgrade are stored by the root of their merkle tree.
+func dealFids(deals []storageTypes.LegacyActiveDeals) map[string]bool {
+	fids := make(map[string]bool, 2*len(deals))
+	for _, deal := range deals {
+		fids[deal.Fid] = true
+		if merkle, err := hex.DecodeString(deal.Merkle); err == nil {
+			fids[string(merkle)] = true
+		}
+	}
+	return fids
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	badger "github.com/dgraph-io/badger/v4"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func setupIpfsServer(t *testing.T) *FileServer {
+	f, _ := setupUploadServer(t)
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	f.ipfsArchive, err = archive.NewIpfsArchive(db, archive.IpfsPeerConfig{Offline: true})
+	require.NoError(t, err)
+	return f
+}
+
+func TestIpfsGateway(t *testing.T) {
+	f := setupIpfsServer(t)
+	data := bytes.Repeat([]byte("jackal "), 1000)
+	_, err := f.ipfsArchive.WriteFileToDisk(bytes.NewReader(data), "jklf1a")
+	require.NoError(t, err)
+	files, err := f.ipfsArchive.Files()
+	require.NoError(t, err)
+	root := files["jklf1a"].String()
+
+	router := httprouter.New()
+	router.GET("/ipfs/:cid", f.ipfsGateway)
+	router.HEAD("/ipfs/:cid", f.ipfsGateway)
+
+	cases := map[string]struct {
+		method  string
+		cid     string
+		rangeHd string
+		status  int
+		body    []byte
+	}{
+		"file": {
+			method: http.MethodGet,
+			cid:    root,
+			status: http.StatusOK,
+			body:   data,
+		},
+		"range": {
+			method:  http.MethodGet,
+			cid:     root,
+			rangeHd: "bytes=7-12",
+			status:  http.StatusPartialContent,
+			body:    data[7:13],
+		},
+		"head": {
+			method: http.MethodHead,
+			cid:    root,
+			status: http.StatusOK,
+			body:   []byte{},
+		},
+		"invalid_cid": {
+			method: http.MethodGet,
+			cid:    "jklf1a",
+			status: http.StatusBadRequest,
+		},
+		"missing": {
+			method: http.MethodGet,
+			cid:    "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/ipfs/"+tc.cid, nil)
+			if tc.rangeHd != "" {
+				req.Header.Set("Range", tc.rangeHd)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, tc.status, w.Code)
+			if tc.body != nil {
+				require.Equal(t, string(tc.body), w.Body.String())
+				require.Equal(t, `"`+root+`"`, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestReconcilePins(t *testing.T) {
+	require := require.New(t)
+
+	f := setupIpfsServer(t)
+	write := func(fid string, data string) {
+		_, err := f.ipfsArchive.WriteFileToDisk(bytes.NewReader([]byte(data)), fid)
+		require.NoError(err)
+	}
+	write("jklf1deal", "deal")
+	write("jklf1contract", "contract")
+	write("jklf1ended", "ended")
+	// stored by the ipfs upgrade under the root of its merkle tree
+	merkle := []byte{0xca, 0xfe}
+	write(string(merkle), "upgraded")
+	require.NoError(f.archivedb.SetContract("jklc1contract", "jklf1contract"))
+
+	deals := []storageTypes.LegacyActiveDeals{
+		{Fid: "jklf1deal", Merkle: "00"},
+		{Fid: "jklf1other", Merkle: hex.EncodeToString(merkle)},
+	}
+	pinned, deleted, removed, err := f.reconcilePins(context.Background(), deals)
+	require.NoError(err)
+	require.Equal(2, pinned)
+	require.Equal(1, deleted)
+	require.Zero(removed) // released when the file was deleted
+
+	files, err := f.ipfsArchive.Files()
+	require.NoError(err)
+	require.Len(files, 3)
+	require.NotContains(files, "jklf1ended")
+	require.True(f.ipfsArchive.FileExist("jklf1ended")) // FileExist is true for missing files
+	require.False(f.ipfsArchive.FileExist("jklf1contract"))
+}
+
+func TestFinishUploadIpfs(t *testing.T) {
+	require := require.New(t)
+
+	f := setupIpfsServer(t)
+	f.archive = f.ipfsArchive
+	data := []byte("hello, world\n")
+
+	file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	dedup, err := f.finishUpload(file, "jklc1first", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(err)
+	require.False(dedup)
+
+	file, err = utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	dedup, err = f.finishUpload(file, "jklc1second", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(err)
+	require.True(dedup)
+
+	// a failed contract must not delete the file of the others
+	f.archivedb = failingArchiveDB{f.archivedb}
+	file, err = utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	_, err = f.finishUpload(file, "jklc1third", &types.Upload{Response: &sdk.TxResponse{}})
+	require.Error(err)
+
+	stored, err := f.archive.RetrieveFile(file.Fid)
+	require.NoError(err)
+	got, err := io.ReadAll(stored)
+	require.NoError(err)
+	require.NoError(stored.Close())
+	require.Equal(data, got)
+}
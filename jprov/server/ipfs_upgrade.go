@@ -67,7 +67,7 @@ func (f *FileServer) migrateToIpfs(activeDeal storageTypes.LegacyActiveDeals) er
 	if err != nil {
 		return err
 	}
-	err = f.ipfsArchive.WriteTreeToDisk(merkle, activeDeal.Signee, startBlock, t)
+	err = f.ipfsArchive.WriteV2TreeToDisk(merkle, activeDeal.Signee, startBlock, t)
 	if err != nil {
 		return err
 	}
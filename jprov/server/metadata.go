@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+)
+
+// updateMetadata changes the metadata of cid. The metadata only saves
+// queries, failing to update it is logged and otherwise ignored.
+func (f *FileServer) updateMetadata(cid string, update func(meta *archive.ContractMetadata)) {
+	err := f.archivedb.UpdateMetadata(cid, update)
+	if err != nil && !errors.Is(err, archive.ErrContractNotFound) {
+		f.logger.Error(fmt.Sprintf("failed to update metadata of %s: %s", cid, err.Error()))
+	}
+}
+
+// uploadMetadata records the terms of the contract that was posted for an
+// upload and the chunk size its merkle tree was built with.
+func uploadMetadata(msg *types.Upload, chunkSize int64) func(meta *archive.ContractMetadata) {
+	return func(meta *archive.ContractMetadata) {
+		meta.ChunkSize = chunkSize
+
+		contract, ok := msg.Message.(*storageTypes.MsgPostContract)
+		if !ok {
+			return
+		}
+		meta.Signee = contract.Signee
+		meta.Merkle = contract.Merkle
+		setInt(&meta.FileSize, contract.Filesize)
+	}
+}
+
+// dealMetadata records the terms of an active deal.
+func dealMetadata(deal storageTypes.LegacyActiveDeals) func(meta *archive.ContractMetadata) {
+	return func(meta *archive.ContractMetadata) {
+		meta.Signee = deal.Signee
+		meta.Merkle = deal.Merkle
+		setInt(&meta.FileSize, deal.Filesize)
+		setInt(&meta.StartBlock, deal.Startblock)
+		setInt(&meta.EndBlock, deal.Endblock)
+	}
+}
+
+// setInt parses value into n, n is left as it is if value isn't a number.
+func setInt(n *int64, value string) {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		*n = parsed
+	}
+}
+
+// recordProof saves result as the last proof of cid.
+func (f *FileServer) recordProof(cid string, result archive.ProofResult) {
+	result.Time = time.Now()
+	f.updateMetadata(cid, func(meta *archive.ContractMetadata) {
+		meta.LastProof = &result
+	})
+}
+
+// chunkSize returns the chunk size the file of cid was stored with.
+func (f *FileServer) chunkSize(cid string) int64 {
+	meta, err := f.archivedb.GetMetadata(cid)
+	if err != nil || meta.ChunkSize == 0 {
+		return f.blockSize
+	}
+	return meta.ChunkSize
+}
+
+// fileChunkSize returns the chunk size fid was stored with.
+func (f *FileServer) fileChunkSize(fid string) int64 {
+	cids, err := f.archivedb.GetContracts(fid)
+	if err != nil || len(cids) == 0 {
+		return f.blockSize
+	}
+	return f.chunkSize(cids[0])
+}
+
+// provenUntil returns the block up to which the last proof of meta keeps its
+// contract verified on chain, zero if that isn't known. Proof windows start at
+// the start block of the contract, a proof counts for the window it was
+// posted in and the next one. Attestations don't record their block.
+func provenUntil(meta archive.ContractMetadata, proofWindow int64) int64 {
+	proof := meta.LastProof
+	if proof == nil || !proof.Success() || proof.Height == 0 || meta.StartBlock == 0 || proofWindow <= 0 {
+		return 0
+	}
+	window := (proof.Height - meta.StartBlock) / proofWindow
+	until := meta.StartBlock + (window+2)*proofWindow
+	if meta.EndBlock > 0 {
+		// the chain has to tell if the contract ended
+		until = min(until, meta.EndBlock)
+	}
+	return until
+}
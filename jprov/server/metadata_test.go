@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContractMetadata(t *testing.T) {
+	require := require.New(t)
+	const cid = "jklc1test"
+
+	f, _ := setupUploadServer(t)
+	file, err := utils.IngestFile(f.archive, bytes.NewReader([]byte("hello, world\n")), f.blockSize)
+	require.NoError(err)
+
+	msg := types.Upload{
+		Message: &storageTypes.MsgPostContract{
+			Signee:   "jkl1signee",
+			Merkle:   "abcd",
+			Filesize: "13",
+			Fid:      file.Fid,
+		},
+		Response: &sdk.TxResponse{TxHash: "hash"},
+	}
+	_, err = f.finishUpload(file, cid, &msg)
+	require.NoError(err)
+
+	meta, err := f.archivedb.GetMetadata(cid)
+	require.NoError(err)
+	require.Equal(archive.ContractMetadata{
+		Cid:       cid,
+		Fid:       file.Fid,
+		Signee:    "jkl1signee",
+		FileSize:  13,
+		Merkle:    "abcd",
+		ChunkSize: f.blockSize,
+	}, meta)
+
+	// the deal adds its blocks, values that aren't numbers are skipped
+	f.updateMetadata(cid, dealMetadata(storageTypes.LegacyActiveDeals{
+		Cid:        cid,
+		Signee:     "jkl1signee",
+		Merkle:     "abcd",
+		Filesize:   "13",
+		Startblock: "100",
+		Endblock:   "",
+	}))
+	meta, err = f.archivedb.GetMetadata(cid)
+	require.NoError(err)
+	require.EqualValues(100, meta.StartBlock)
+	require.Zero(meta.EndBlock)
+	require.EqualValues(13, meta.FileSize)
+	require.Equal(f.blockSize, meta.ChunkSize)
+
+	f.recordProof(cid, archive.ProofResult{Chunk: 3, Height: 120})
+	meta, err = f.archivedb.GetMetadata(cid)
+	require.NoError(err)
+	require.NotNil(meta.LastProof)
+	require.True(meta.LastProof.Success())
+	require.EqualValues(3, meta.LastProof.Chunk)
+	require.EqualValues(120, meta.LastProof.Height)
+	require.False(meta.LastProof.Time.IsZero())
+
+	// proofs use the chunk size the file was stored with
+	f.blockSize = 2048
+	require.EqualValues(1024, f.chunkSize(cid))
+	require.EqualValues(2048, f.chunkSize("jklc1missing"))
+
+	// updates of unknown contracts are ignored
+	f.updateMetadata("jklc1missing", dealMetadata(storageTypes.LegacyActiveDeals{}))
+	_, err = f.archivedb.GetMetadata("jklc1missing")
+	require.ErrorIs(err, archive.ErrContractNotFound)
+}
+
+func TestProvenUntil(t *testing.T) {
+	const start, window = 1000, 50
+	proof := func(height int64) *archive.ProofResult {
+		return &archive.ProofResult{Height: height}
+	}
+
+	cases := map[string]struct {
+		meta     archive.ContractMetadata
+		expUntil int64
+	}{
+		"window_start": {
+			meta:     archive.ContractMetadata{StartBlock: start, LastProof: proof(start + 2*window)},
+			expUntil: start + 4*window,
+		},
+		"window_end": {
+			meta:     archive.ContractMetadata{StartBlock: start, LastProof: proof(start + 3*window - 1)},
+			expUntil: start + 4*window,
+		},
+		"ends_before": {
+			meta:     archive.ContractMetadata{StartBlock: start, EndBlock: start + 3*window, LastProof: proof(start + 2*window)},
+			expUntil: start + 3*window,
+		},
+		"no_proof": {
+			meta: archive.ContractMetadata{StartBlock: start},
+		},
+		"failed_proof": {
+			meta: archive.ContractMetadata{StartBlock: start, LastProof: &archive.ProofResult{Height: start, Error: "failed"}},
+		},
+		"attested": {
+			meta: archive.ContractMetadata{StartBlock: start, LastProof: &archive.ProofResult{Attested: true}},
+		},
+		"unknown_start": {
+			meta: archive.ContractMetadata{LastProof: proof(start)},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			until := provenUntil(c.meta, window)
+			require.Equal(t, c.expUntil, until)
+			if until == 0 || c.meta.EndBlock > 0 {
+				return
+			}
+
+			// the chain agrees on every block after the proof
+			deal := storageTypes.ActiveDeals{Startblock: fmt.Sprint(start), LastProof: c.meta.LastProof.Height}
+			for height := c.meta.LastProof.Height; height < until+2*window; height++ {
+				require.Equal(t, deal.IsVerified(height, window), height < until, height)
+			}
+		})
+	}
+}
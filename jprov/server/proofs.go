@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -36,12 +37,12 @@ import (
 )
 
 func GetMerkleTree(ctx client.Context, filename string) (*merkletree.MerkleTree, error) {
-	rawTree, err := os.ReadFile(utils.GetStoragePathForTree(ctx.HomeDir, filename))
+	rawTree, err := os.ReadFile(filepath.Join(archive.FindFileDir(ctx.HomeDir, filename), utils.GetTreeFileName(filename)))
 	if err != nil {
 		return &merkletree.MerkleTree{}, fmt.Errorf("unable to find merkle tree for: %s", filename)
 	}
 
-	return merkletree.ImportMerkleTree(rawTree, sha3.New512())
+	return archive.DecodeTree(rawTree)
 }
 
 func GenerateMerkleProof(tree merkletree.MerkleTree, index, blockSize int64, item []byte) (valid bool, proof *merkletree.Proof, err error) {
@@ -232,7 +233,15 @@ func requestAttestation(clientCtx client.Context, cid string, hashList string, i
 	return nil
 }
 
-func (f *FileServer) postProof(cid string, blockSize, block int64) error {
+func (f *FileServer) postProof(cid string, blockSize, block int64) (err error) {
+	result := archive.ProofResult{Chunk: block}
+	defer func() {
+		if err != nil {
+			result.Error = err.Error()
+		}
+		f.recordProof(cid, result)
+	}()
+
 	fid, err := f.archivedb.GetFid(cid)
 	if err != nil {
 		return err
@@ -248,6 +257,7 @@ func (f *FileServer) postProof(cid string, blockSize, block int64) error {
 	err = requestAttestation(f.serverCtx.cosmosCtx, cid, hashlist, item, f.queue) // request attestation, if we get it, skip all the posting
 	if err == nil {
 		fmt.Println("successfully got attestation.")
+		result.Attested = true
 		return nil
 	}
 
@@ -276,14 +286,17 @@ func (f *FileServer) postProof(cid string, blockSize, block int64) error {
 
 	if u.Err != nil {
 		f.logger.Error(fmt.Sprintf("Posting Error: %s", u.Err.Error()))
+		result.Error = u.Err.Error()
 		return nil
 	}
 
 	if u.Response.Code != 0 {
 		f.logger.Error(fmt.Errorf("contract Response error: %s", u.Response.RawLog).Error())
+		result.Error = u.Response.RawLog
 		return nil
 	}
 
+	result.Height = u.Response.Height
 	return nil
 }
 
@@ -379,25 +392,38 @@ func (f *FileServer) Prove(deal storageTypes.LegacyActiveDeals) error {
 		return fmt.Errorf("failed to parse block number: %s", deal.Blocktoprove)
 	}
 
-	return f.postProof(deal.Cid, f.blockSize, dex.Int64())
+	return f.postProof(deal.Cid, f.chunkSize(deal.Cid), dex.Int64())
 }
 
+// handleContracts proves every contract that isn't verified. Contracts whose
+// recorded proof still counts are not queried from the chain.
 func (f *FileServer) handleContracts() error {
+	height, proofWindow, err := f.queryProofWindow()
+	if err != nil {
+		// every contract is queried
+		f.logger.Error(fmt.Sprintf("failed to query the proof window: %s", err.Error()))
+	}
+
 	iter := f.archivedb.NewIterator()
 	defer iter.Release()
 
 	for iter.Next() {
 		cid := string(iter.Key())
 		fid := string(iter.Value())
-		if strings.HasPrefix(cid, "jklf") { // skip cid reference
+
+		f.logger.Info(fmt.Sprintf("CID: %s FID: %s", cid, fid))
+
+		meta, err := f.archivedb.GetMetadata(cid)
+		if err == nil && height < provenUntil(meta, proofWindow) {
+			f.logger.Debug(fmt.Sprintf("%s is proven until block %d", cid, provenUntil(meta, proofWindow)))
 			continue
 		}
 
-		f.logger.Info(fmt.Sprintf("CID: %s FID: %s", cid, fid))
 		resp, respErr := f.QueryActiveDeal(cid)
 
 		switch state, err := types.ContractState(resp, respErr); state {
 		case types.Verified:
+			f.updateMetadata(cid, dealMetadata(resp.ActiveDeals))
 			err := f.DeleteDowntime(cid)
 			if err != nil {
 				f.logger.Error(fmt.Sprintf("error when unmarking downtime cid: %s: %v", cid, err))
@@ -409,6 +435,7 @@ func (f *FileServer) handleContracts() error {
 				return err
 			}
 		case types.NotVerified:
+			f.updateMetadata(cid, dealMetadata(resp.ActiveDeals))
 			err := f.DeleteDowntime(cid)
 			if err != nil {
 				f.logger.Error(fmt.Sprintf("error when unmarking downtime cid: %s: %v", cid, err))
@@ -11,17 +11,10 @@ import (
 
 func (f *FileServer) allFilesAtStorage() ([]string, error) {
 	fids := make([]string, 0)
-	dirs, err := os.ReadDir(utils.GetStorageRootDir(f.serverCtx.cosmosCtx.HomeDir))
-	if err != nil {
-		return nil, err
-	}
-
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			fids = append(fids, dir.Name())
-		}
-	}
-
+	err := archive.WalkStorage(f.serverCtx.cosmosCtx.HomeDir, func(fid string, _ bool) error {
+		fids = append(fids, fid)
+		return nil
+	})
 	return fids, err
 }
 
@@ -4,6 +4,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/cosmos/cosmos-sdk/client/rpc"
 	query "github.com/cosmos/cosmos-sdk/types/query"
 
 	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
@@ -140,3 +141,17 @@ func (f *FileServer) QueryActiveDeal(cid string) (*storageTypes.QueryActiveDealR
 	req := storageTypes.QueryActiveDealRequest{Cid: cid}
 	return f.queryClient.ActiveDeals(f.cmd.Context(), &req)
 }
+
+// queryProofWindow returns the current height of the chain and the length of
+// its proof windows.
+func (f *FileServer) queryProofWindow() (height, proofWindow int64, err error) {
+	params, err := f.queryClient.Params(f.cmd.Context(), &storageTypes.QueryParamsRequest{})
+	if err != nil {
+		return 0, 0, err
+	}
+	height, err = rpc.GetChainHeight(f.serverCtx.cosmosCtx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return height, params.Params.ProofWindow, nil
+}
@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"sync"
 	"time"
 
@@ -50,6 +52,8 @@ type Reporter struct {
 	Context   context.Context
 	LastCount int64
 	Rand      *rand.Rand
+	// FullDownload checks files by downloading them instead of probing
+	FullDownload bool
 }
 
 func InitReporter(cmd *cobra.Command) *Reporter {
@@ -58,11 +62,17 @@ func InitReporter(cmd *cobra.Command) *Reporter {
 
 	randy := rand.New(rand.NewSource(time.Now().UnixNano()))
 
+	fullDownload, err := cmd.Flags().GetBool(types.FlagFullDownload)
+	if err != nil {
+		fullDownload = false
+	}
+
 	r := Reporter{
-		ClientCtx: clientCtx,
-		LastCount: 0,
-		Context:   cmd.Context(),
-		Rand:      randy,
+		ClientCtx:    clientCtx,
+		LastCount:    0,
+		Context:      cmd.Context(),
+		Rand:         randy,
+		FullDownload: fullDownload,
 	}
 
 	allowance := feegrant.BasicAllowance{
@@ -116,6 +126,32 @@ func InitReporter(cmd *cobra.Command) *Reporter {
 	return &r
 }
 
+// checkFile checks that the provider at ipAddress stores the file of deal. A
+// random chunk is probed unless full downloads are enabled or the provider
+// doesn't support probes. utils.ErrProviderUnavailable is returned when the
+// provider can't answer, the file must not be reported then.
+func (r Reporter) checkFile(ipAddress string, deal storageTypes.LegacyActiveDeals) error {
+	if r.FullDownload {
+		_, err := utils.TestDownloadFileFromURL(ipAddress, deal.Fid)
+		return err
+	}
+
+	filesize, err := strconv.ParseInt(deal.Filesize, 10, 64)
+	if err != nil {
+		return err
+	}
+	root, err := hex.DecodeString(deal.Merkle)
+	if err != nil {
+		return err
+	}
+
+	err = utils.ProbeFileFromURL(ipAddress, deal.Fid, filesize, root, r.Rand.Int63n)
+	if errors.Is(err, utils.ErrProbeUnsupported) {
+		_, err = utils.TestDownloadFileFromURL(ipAddress, deal.Fid)
+	}
+	return err
+}
+
 func (r Reporter) Report(cmd *cobra.Command) error {
 	fmt.Println("Attempting to report bad actors...")
 	defer fmt.Println("Done report!")
@@ -177,7 +213,11 @@ func (r Reporter) Report(cmd *cobra.Command) error {
 
 		ipAddress := res.GetProviders().Ip
 
-		_, err = utils.TestDownloadFileFromURL(ipAddress, deal.Fid)
+		err = r.checkFile(ipAddress, deal)
+		if errors.Is(err, utils.ErrProviderUnavailable) {
+			fmt.Printf("skipping %s: %s\n", deal.Cid, err.Error())
+			continue
+		}
 		if err != nil {
 			msg := storageTypes.NewMsgRequestReportForm( // Creating Report
 				address,
@@ -287,11 +327,15 @@ func (r Reporter) AttestReport(queue *queue.UploadQueue) error {
 				ipAddress := providerRes.GetProviders().Ip
 
 				fmt.Printf("trying to downloading file from %s...\n", ipAddress)
-				_, err = utils.TestDownloadFileFromURL(ipAddress, ad.Fid)
+				err = r.checkFile(ipAddress, ad)
 				if err == nil {
 					fmt.Println("successfully downloaded file.")
 					break
 				}
+				if errors.Is(err, utils.ErrProviderUnavailable) {
+					fmt.Printf("provider is unavailable, not attesting to %s yet.\n", report.Cid)
+					continue
+				}
 				fmt.Println("failed to download file.")
 
 				msg := storageTypes.NewMsgReport( // Creating Report
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFileWithoutProbes(t *testing.T) {
+	data := []byte("hello, world\n")
+	deal := storageTypes.LegacyActiveDeals{
+		Fid:      "jklf1test",
+		Filesize: "13",
+		Merkle:   "abcd",
+	}
+
+	cases := map[string]struct {
+		status int
+		expErr error
+		fails  bool
+	}{
+		"download": {status: http.StatusOK},
+		"missing":  {status: http.StatusNotFound, fails: true},
+		"busy":     {status: http.StatusTooManyRequests, expErr: utils.ErrProviderUnavailable},
+		"failing":  {status: http.StatusBadGateway, expErr: utils.ErrProviderUnavailable},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			// providers without probes only answer GET, HEAD is not allowed
+			var downloads atomic.Int32
+			router := httprouter.New()
+			router.GET("/download/:file", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+				downloads.Add(1)
+				w.WriteHeader(c.status)
+				_, _ = w.Write(data)
+			})
+			peer := httptest.NewServer(router)
+			defer peer.Close()
+
+			r := Reporter{Rand: rand.New(rand.NewSource(1))}
+			err := r.checkFile(peer.URL, deal)
+			switch {
+			case c.expErr != nil:
+				require.ErrorIs(err, c.expErr)
+			case c.fails:
+				require.Error(err)
+			default:
+				require.NoError(err)
+			}
+			require.EqualValues(1, downloads.Load())
+		})
+	}
+}
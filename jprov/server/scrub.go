@@ -0,0 +1,349 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+	merkletree "github.com/wealdtech/go-merkletree"
+)
+
+// The scrubber re-hashes stored files in the background at a limited rate and
+// compares them to the merkle root of their contracts, or to their own tree
+// if the contracts are gone. Corrupt files are copied to the quarantine
+// folder and downloaded again from other providers that store them, so the
+// next proof can still be posted. The stored copy is only replaced once a
+// downloaded copy matches the merkle root.
+
+const (
+	// pause between two passes over all files
+	scrubPassInterval = time.Hour
+	// files that could not be repaired are retried this often
+	scrubRetryInterval = 5 * time.Minute
+	quarantineDir      = "quarantine"
+)
+
+var ErrRepairFailed = errors.New("no provider could repair the file")
+
+type scrubber struct {
+	archive       archive.Archive
+	archivedb     archive.ArchiveDB
+	blockSize     int64
+	quarantineDir string
+	logger        *slog.Logger
+	bandwidth     *bandwidth
+
+	// merkle returns the hex encoded merkle root of the contracts, or an
+	// empty string if none of them is active
+	merkle func(cids []string) (string, error)
+	// providers returns the addresses of the other providers storing fid
+	providers func(fid string) ([]string, error)
+
+	// merkle roots of files that were quarantined but not repaired yet
+	pending   map[string]string
+	lastRetry time.Time
+}
+
+func newScrubber(
+	a archive.Archive,
+	archivedb archive.ArchiveDB,
+	blockSize int64,
+	rootDir string,
+	logger *slog.Logger,
+	rate int64,
+	merkle func(cids []string) (string, error),
+	providers func(fid string) ([]string, error),
+) *scrubber {
+	return &scrubber{
+		archive:       a,
+		archivedb:     archivedb,
+		blockSize:     blockSize,
+		quarantineDir: filepath.Join(rootDir, quarantineDir),
+		logger:        logger,
+		bandwidth:     newBandwidth(rate),
+		merkle:        merkle,
+		providers:     providers,
+		pending:       make(map[string]string),
+	}
+}
+
+// chainMerkle returns the merkle root of the first active contract.
+func chainMerkle(queryClient storageTypes.QueryClient) func(cids []string) (string, error) {
+	return func(cids []string) (string, error) {
+		for _, cid := range cids {
+			resp, err := queryClient.ActiveDeals(context.Background(), &storageTypes.QueryActiveDealRequest{Cid: cid})
+			state, err := types.ContractState(resp, err)
+			if err != nil {
+				return "", err
+			}
+			if state != types.NotFound && len(resp.ActiveDeals.Merkle) > 0 {
+				return resp.ActiveDeals.Merkle, nil
+			}
+		}
+		return "", nil
+	}
+}
+
+// chainProviders returns the providers that store fid according to the chain,
+// except the provider at address.
+func chainProviders(queryClient storageTypes.QueryClient, address string) func(fid string) ([]string, error) {
+	return func(fid string) ([]string, error) {
+		self, err := queryClient.Providers(context.Background(), &storageTypes.QueryProviderRequest{Address: address})
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := queryClient.FindFile(context.Background(), &storageTypes.QueryFindFileRequest{Fid: fid})
+		if err != nil {
+			return nil, err
+		}
+
+		var ips []string
+		err = json.Unmarshal([]byte(res.ProviderIps), &ips)
+		if err != nil {
+			return nil, err
+		}
+
+		providers := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			if ip != self.Providers.Ip {
+				providers = append(providers, ip)
+			}
+		}
+		return providers, nil
+	}
+}
+
+// files returns the contracts of every stored file.
+func (s *scrubber) files() (map[string][]string, error) {
+	iter := s.archivedb.NewIterator()
+	defer iter.Release()
+
+	files := make(map[string][]string)
+	for iter.Next() {
+		cid := string(iter.Key())
+		fid := string(iter.Value())
+		files[fid] = append(files[fid], cid)
+	}
+	return files, iter.Error()
+}
+
+// run scrubs all files over and over.
+func (s *scrubber) run() {
+	for {
+		checked, corrupt, err := s.pass()
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("scrubber: %s", err.Error()))
+		}
+		s.logger.Info(fmt.Sprintf("scrubbed %d files, %d were corrupt", checked, corrupt))
+
+		next := time.Now().Add(scrubPassInterval)
+		for time.Now().Before(next) {
+			time.Sleep(scrubRetryInterval)
+			s.retry()
+		}
+	}
+}
+
+// pass checks every stored file once.
+func (s *scrubber) pass() (checked, corrupt int, err error) {
+	files, err := s.files()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for fid, cids := range files {
+		if _, ok := s.pending[fid]; ok {
+			// quarantined already, retry repairs it
+			continue
+		}
+
+		ok, err := s.check(fid, cids)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("scrubber: failed to check %s: %s", fid, err.Error()))
+		} else {
+			checked++
+		}
+		if !ok {
+			corrupt++
+		}
+
+		if time.Since(s.lastRetry) > scrubRetryInterval {
+			s.retry()
+		}
+	}
+	return checked, corrupt, nil
+}
+
+// retry repairs the files that could not be repaired before.
+func (s *scrubber) retry() {
+	s.lastRetry = time.Now()
+	for fid, merkle := range s.pending {
+		_, err := s.archivedb.GetContracts(fid)
+		if errors.Is(err, archive.ErrFidNotFound) {
+			// the contracts ended in the meantime
+			delete(s.pending, fid)
+			continue
+		}
+
+		err = s.repair(fid, merkle)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("scrubber: %s: %s", fid, err.Error()))
+		}
+	}
+}
+
+// check hashes the stored copy of fid and repairs it if it does not match.
+// ok is false if the file was corrupt or missing.
+func (s *scrubber) check(fid string, cids []string) (ok bool, err error) {
+	merkle, err := s.merkle(cids)
+	if err != nil {
+		return true, err
+	}
+
+	stored, treeErr := s.archive.RetrieveTree(fid)
+	if len(merkle) == 0 && treeErr == nil {
+		merkle = hex.EncodeToString(stored.Root())
+	}
+
+	tree, err := s.hash(fid)
+	if errors.Is(err, os.ErrNotExist) {
+		if len(merkle) == 0 {
+			return false, fmt.Errorf("%s is missing and its merkle root is unknown", fid)
+		}
+		s.logger.Error(fmt.Sprintf("scrubber: %s is missing", fid))
+		return false, s.repair(fid, merkle)
+	}
+	corrupt := errors.Is(err, archive.ErrCorruptFile)
+	if err != nil && !corrupt {
+		return true, err
+	}
+	if len(merkle) == 0 {
+		return true, fmt.Errorf("no merkle root to check %s against", fid)
+	}
+
+	if !corrupt && hex.EncodeToString(tree.Root()) == merkle {
+		if treeErr == nil && hex.EncodeToString(stored.Root()) == merkle {
+			return true, nil
+		}
+		// the file is fine but its tree is not
+		s.logger.Info(fmt.Sprintf("scrubber: rewriting the merkle tree of %s", fid))
+		return true, s.archive.WriteTreeToDisk(fid, tree)
+	}
+
+	s.logger.Error(fmt.Sprintf("scrubber: %s is corrupt, copying it to %s", fid, s.quarantineDir))
+	err = s.quarantine(fid)
+	if err != nil {
+		return false, err
+	}
+	return false, s.repair(fid, merkle)
+}
+
+// hash computes the merkle tree of the stored copy of fid.
+func (s *scrubber) hash(fid string) (tree *merkletree.MerkleTree, err error) {
+	file, err := s.archive.RetrieveFile(fid)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+
+	hasher := utils.NewFileHasher(s.chunkSize(fid))
+	_, err = io.Copy(hasher, &throttledReader{Reader: file, limit: s.bandwidth})
+	if err != nil {
+		return nil, err
+	}
+	return hasher.MerkleTree()
+}
+
+// chunkSize returns the chunk size fid was stored with.
+func (s *scrubber) chunkSize(fid string) int64 {
+	cids, err := s.archivedb.GetContracts(fid)
+	if err != nil {
+		return s.blockSize
+	}
+	for _, cid := range cids {
+		meta, err := s.archivedb.GetMetadata(cid)
+		if err == nil && meta.ChunkSize > 0 {
+			return meta.ChunkSize
+		}
+	}
+	return s.blockSize
+}
+
+// quarantine copies the stored copy of fid to the quarantine folder, it is
+// served until repair replaces it. Encrypted files are kept encrypted.
+func (s *scrubber) quarantine(fid string) (err error) {
+	src, err := archive.Unwrap(s.archive).RetrieveFile(fid)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, src.Close())
+	}()
+
+	err = os.MkdirAll(s.quarantineDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(filepath.Join(s.quarantineDir, fmt.Sprintf("%s-%d.jkl", fid, time.Now().Unix())))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return errors.Join(err, dst.Close())
+}
+
+// repair downloads fid from another provider into staging and replaces the
+// stored copy once the download matches merkle. It is retried later if no
+// provider has a matching copy.
+func (s *scrubber) repair(fid, merkle string) error {
+	s.pending[fid] = merkle
+
+	providers, err := s.providers(fid)
+	if err != nil {
+		return err
+	}
+
+	for _, url := range providers {
+		file, err := utils.DownloadFileFromURL(s.archive, url, fid, s.chunkSize(fid))
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("scrubber: failed to get %s from %s: %s", fid, url, err.Error()))
+			continue
+		}
+
+		if hex.EncodeToString(file.Tree.Root()) != merkle {
+			s.logger.Error(fmt.Sprintf("scrubber: %s from %s does not match its contract", fid, url))
+			err = file.Discard()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// committing replaces the stored copy
+		err = file.Commit()
+		if err != nil {
+			return errors.Join(err, file.Discard())
+		}
+
+		delete(s.pending, fid)
+		s.logger.Info(fmt.Sprintf("scrubber: repaired %s from %s", fid, url))
+		return nil
+	}
+
+	return fmt.Errorf("%s: %w", fid, ErrRepairFailed)
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/stretchr/testify/require"
+)
+
+const scrubCid = "jklc1scrub"
+
+// setupScrubber stores data under a contract and returns a scrubber for it
+// along with a peer serving the original data.
+func setupScrubber(t *testing.T, data []byte) (*scrubber, string, string) {
+	f, rootDir := setupUploadServer(t)
+
+	file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(t, err)
+	require.NoError(t, file.Commit())
+	require.NoError(t, f.archivedb.SetContract(scrubCid, file.Fid))
+	merkle := hex.EncodeToString(file.Tree.Root())
+
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/download/"+file.Fid {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(peer.Close)
+
+	s := newScrubber(f.archive, f.archivedb, f.blockSize, rootDir, f.logger, 0,
+		func(cids []string) (string, error) {
+			return merkle, nil
+		},
+		func(fid string) ([]string, error) {
+			return []string{peer.URL}, nil
+		},
+	)
+	return s, file.Fid, rootDir
+}
+
+func readStoredFile(t *testing.T, a archive.Archive, fid string) []byte {
+	file, err := a.RetrieveFile(fid)
+	require.NoError(t, err)
+	data := new(bytes.Buffer)
+	_, err = data.ReadFrom(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	return data.Bytes()
+}
+
+func TestScrubber(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world\n"), 500)
+
+	cases := map[string]struct {
+		corrupt       func(t *testing.T, rootDir, fid string)
+		noPeers       bool
+		expOk         bool
+		expErr        error
+		expQuarantine bool
+	}{
+		"healthy": {
+			expOk: true,
+		},
+		"corrupt_file": {
+			corrupt: func(t *testing.T, rootDir, fid string) {
+				path := archive.NewSingleCellPathFactory(rootDir).FilePath(fid)
+				require.NoError(t, os.WriteFile(path, bytes.ToUpper(data), archive.FilePerm))
+			},
+			expQuarantine: true,
+		},
+		"missing_file": {
+			corrupt: func(t *testing.T, rootDir, fid string) {
+				require.NoError(t, os.Remove(archive.NewSingleCellPathFactory(rootDir).FilePath(fid)))
+			},
+		},
+		"corrupt_tree": {
+			corrupt: func(t *testing.T, rootDir, fid string) {
+				path := archive.NewSingleCellPathFactory(rootDir).TreePath(fid)
+				require.NoError(t, os.WriteFile(path, []byte("garbage"), archive.FilePerm))
+			},
+			expOk: true,
+		},
+		"no_peers": {
+			corrupt: func(t *testing.T, rootDir, fid string) {
+				path := archive.NewSingleCellPathFactory(rootDir).FilePath(fid)
+				require.NoError(t, os.WriteFile(path, bytes.ToUpper(data), archive.FilePerm))
+			},
+			noPeers:       true,
+			expErr:        ErrRepairFailed,
+			expQuarantine: true,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			s, fid, rootDir := setupScrubber(t, data)
+			if c.corrupt != nil {
+				c.corrupt(t, rootDir, fid)
+			}
+			peers := s.providers
+			if c.noPeers {
+				s.providers = func(fid string) ([]string, error) {
+					return nil, nil
+				}
+			}
+
+			ok, err := s.check(fid, []string{scrubCid})
+			require.Equal(c.expOk, ok)
+			if c.expErr != nil {
+				require.ErrorIs(err, c.expErr)
+				require.Contains(s.pending, fid)
+
+				// the stored copy is kept until it can be replaced
+				require.Equal(bytes.ToUpper(data), readStoredFile(t, s.archive, fid))
+				checked, _, err := s.pass()
+				require.NoError(err)
+				require.Zero(checked)
+				quarantined, _ := os.ReadDir(filepath.Join(rootDir, quarantineDir))
+				require.Len(quarantined, 1)
+
+				// the peer is back
+				s.providers = peers
+				s.retry()
+			} else {
+				require.NoError(err)
+			}
+			require.Empty(s.pending)
+
+			quarantined, _ := os.ReadDir(filepath.Join(rootDir, quarantineDir))
+			if c.expQuarantine {
+				require.Len(quarantined, 1)
+			} else {
+				require.Empty(quarantined)
+			}
+
+			require.Equal(data, readStoredFile(t, s.archive, fid))
+			ok, err = s.check(fid, []string{scrubCid})
+			require.NoError(err)
+			require.True(ok)
+		})
+	}
+}
+
+func TestScrubberChunkSize(t *testing.T) {
+	require := require.New(t)
+	data := bytes.Repeat([]byte("hello, world\n"), 500)
+
+	s, _, _ := setupScrubber(t, nil)
+
+	// the file was stored with a chunk size other than the current one
+	file, err := utils.IngestFile(s.archive, bytes.NewReader(data), 100)
+	require.NoError(err)
+	require.NoError(file.Commit())
+	require.NoError(s.archivedb.SetContract("jklc1chunks", file.Fid))
+	require.NoError(s.archivedb.UpdateMetadata("jklc1chunks", func(meta *archive.ContractMetadata) {
+		meta.ChunkSize = 100
+	}))
+	merkle := hex.EncodeToString(file.Tree.Root())
+	s.merkle = func(cids []string) (string, error) {
+		return merkle, nil
+	}
+
+	ok, err := s.check(file.Fid, []string{"jklc1chunks"})
+	require.NoError(err)
+	require.True(ok)
+}
+
+func TestScrubberEncrypted(t *testing.T) {
+	require := require.New(t)
+	data := bytes.Repeat([]byte("hello, world\n"), 10000)
+
+	f, rootDir := setupUploadServer(t)
+	encrypted, err := archive.NewEncryptedArchive(f.archive, bytes.Repeat([]byte{1}, 32))
+	require.NoError(err)
+	f.archive = encrypted
+
+	file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	require.NoError(file.Commit())
+	merkle := hex.EncodeToString(file.Tree.Root())
+
+	s := newScrubber(f.archive, f.archivedb, f.blockSize, rootDir, f.logger, 0,
+		func(cids []string) (string, error) {
+			return merkle, nil
+		},
+		func(fid string) ([]string, error) {
+			return nil, nil
+		},
+	)
+
+	ok, err := s.check(file.Fid, []string{scrubCid})
+	require.NoError(err)
+	require.True(ok)
+
+	// flip a bit of the stored ciphertext
+	path := archive.NewSingleCellPathFactory(rootDir).FilePath(file.Fid)
+	raw, err := os.ReadFile(path)
+	require.NoError(err)
+	raw[len(raw)/2] ^= 1
+	require.NoError(os.WriteFile(path, raw, archive.FilePerm))
+
+	ok, err = s.check(file.Fid, []string{scrubCid})
+	require.ErrorIs(err, ErrRepairFailed)
+	require.False(ok)
+
+	// the copy in quarantine is still encrypted
+	quarantined, err := os.ReadDir(filepath.Join(rootDir, quarantineDir))
+	require.NoError(err)
+	require.Len(quarantined, 1)
+	stored, err := os.ReadFile(filepath.Join(rootDir, quarantineDir, quarantined[0].Name()))
+	require.NoError(err)
+	require.Equal(raw, stored)
+}
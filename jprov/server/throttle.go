@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/spf13/cobra"
+)
+
+// Downloads of whole files are throttled so public traffic can't saturate the
+// uplink of the provider. Chunk downloads, which other providers use to probe
+// files when attesting, get slots of their own so they are never queued behind
+// whole files, and single chunks aren't paced. The proof system is never
+// throttled.
+
+const (
+	// downloads wait this long for a free slot before they are rejected
+	downloadQueueTimeout = 10 * time.Second
+	// clients that have not downloaded anything for this long are forgotten
+	downloadClientTTL = time.Minute
+	// writes are split so a single write never holds the bandwidth for long
+	throttledWriteSize = 32 << 10
+	// chunk downloads reserved on top of the limit of downloads
+	reservedDownloads = 16
+)
+
+var ErrTooManyDownloads = errors.New("too many downloads, try again later")
+
+// bandwidth is a token bucket limiting a rate of bytes per second. A nil
+// bandwidth is unlimited.
+type bandwidth struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidth(bytesPerSecond int64) *bandwidth {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidth{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// sending them.
+func (b *bandwidth) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	// at most one second worth of bytes can be sent in a burst
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type downloadClient struct {
+	bandwidth *bandwidth
+	active    int
+	lastSeen  time.Time
+}
+
+type downloadLimiter struct {
+	bandwidth    *bandwidth
+	clientRate   int64
+	maxPerClient int
+	slots        chan struct{} // nil if the number of downloads is unlimited
+	reserved     chan struct{} // slots of chunk downloads, nil if slots is nil
+	mu           sync.Mutex
+	clients      map[string]*downloadClient
+	queueTimeout time.Duration
+}
+
+// newDownloadLimiter creates a limiter for a total rate and a rate per client
+// in bytes per second, and a maximum number of concurrent downloads in total
+// and per client. Zero means unlimited.
+func newDownloadLimiter(rate, clientRate int64, maxDownloads, maxPerClient int) *downloadLimiter {
+	l := downloadLimiter{
+		bandwidth:    newBandwidth(rate),
+		clientRate:   clientRate,
+		maxPerClient: maxPerClient,
+		clients:      make(map[string]*downloadClient),
+		queueTimeout: downloadQueueTimeout,
+	}
+	if maxDownloads > 0 {
+		l.slots = make(chan struct{}, maxDownloads)
+		l.reserved = make(chan struct{}, reservedDownloads)
+	}
+	return &l
+}
+
+func (l *downloadLimiter) client(addr string) *downloadClient {
+	now := time.Now()
+	for k, c := range l.clients {
+		if c.active == 0 && now.Sub(c.lastSeen) > downloadClientTTL {
+			delete(l.clients, k)
+		}
+	}
+
+	c, ok := l.clients[addr]
+	if !ok {
+		c = &downloadClient{bandwidth: newBandwidth(l.clientRate)}
+		l.clients[addr] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// Acquire admits a download of the client at addr. Clients over their own
+// limit are rejected right away, otherwise the download waits for a free slot.
+// The returned release func must be called once the download is done.
+func (l *downloadLimiter) Acquire(ctx context.Context, addr string) (c *downloadClient, release func(), err error) {
+	l.mu.Lock()
+	c = l.client(addr)
+	if l.maxPerClient > 0 && c.active >= l.maxPerClient {
+		l.mu.Unlock()
+		return nil, nil, ErrTooManyDownloads
+	}
+	c.active++
+	l.mu.Unlock()
+
+	leave := func() {
+		l.mu.Lock()
+		c.active--
+		c.lastSeen = time.Now()
+		l.mu.Unlock()
+	}
+
+	if l.slots == nil {
+		return c, leave, nil
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-timer.C:
+		leave()
+		return nil, nil, ErrTooManyDownloads
+	case <-ctx.Done():
+		leave()
+		return nil, nil, ctx.Err()
+	}
+
+	return c, func() {
+		<-l.slots
+		leave()
+	}, nil
+}
+
+// throttledWriter paces the body of a download to the bandwidth of the
+// provider and of the client.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	limits []*bandwidth
+}
+
+func (w *throttledWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		n := min(len(p), throttledWriteSize)
+
+		var wait time.Duration
+		for _, b := range w.limits {
+			wait = max(wait, b.reserve(n))
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+				return written, w.ctx.Err()
+			}
+		}
+
+		n, err = w.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush sends buffered data to the client, streamed responses flush after
+// every line.
+func (w *throttledWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// throttle limits the download of r. If it is admitted, the returned writer
+// must be used for the body and release must be called when it is done.
+func (l *downloadLimiter) throttle(w http.ResponseWriter, r *http.Request) (tw http.ResponseWriter, release func(), err error) {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	c, release, err := l.Acquire(r.Context(), addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &throttledWriter{
+		ResponseWriter: w,
+		ctx:            r.Context(),
+		limits:         []*bandwidth{l.bandwidth, c.bandwidth},
+	}, release, nil
+}
+
+// AcquireReserved admits a chunk download on the reserved slots, it doesn't
+// count against the limits of whole files or of the client. The returned
+// release func must be called once the download is done.
+func (l *downloadLimiter) AcquireReserved(ctx context.Context) (release func(), err error) {
+	if l.reserved == nil {
+		return func() {}, nil
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.reserved <- struct{}{}:
+	case <-timer.C:
+		return nil, ErrTooManyDownloads
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return func() { <-l.reserved }, nil
+}
+
+// throttleChunks limits a chunk download of r like throttle, but on the
+// reserved slots. Streams of chunks are still paced to the bandwidth of the
+// provider and of the client, a single chunk is sent right away.
+func (l *downloadLimiter) throttleChunks(w http.ResponseWriter, r *http.Request, paced bool) (tw http.ResponseWriter, release func(), err error) {
+	release, err = l.AcquireReserved(r.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	if !paced {
+		return w, release, nil
+	}
+
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	l.mu.Lock()
+	c := l.client(addr)
+	l.mu.Unlock()
+
+	return &throttledWriter{
+		ResponseWriter: w,
+		ctx:            r.Context(),
+		limits:         []*bandwidth{l.bandwidth, c.bandwidth},
+	}, release, nil
+}
+
+func downloadLimiterFromFlags(cmd *cobra.Command) (*downloadLimiter, error) {
+	rate, err := cmd.Flags().GetInt64(types.FlagDownloadRate)
+	if err != nil {
+		return nil, err
+	}
+	clientRate, err := cmd.Flags().GetInt64(types.FlagClientRate)
+	if err != nil {
+		return nil, err
+	}
+	maxDownloads, err := cmd.Flags().GetInt(types.FlagMaxDownloads)
+	if err != nil {
+		return nil, err
+	}
+	maxPerClient, err := cmd.Flags().GetInt(types.FlagMaxClientDownloads)
+	if err != nil {
+		return nil, err
+	}
+
+	// rates are configured in KiB/s
+	return newDownloadLimiter(rate<<10, clientRate<<10, maxDownloads, maxPerClient), nil
+}
+
+func (f *FileServer) writeTooManyDownloads(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(downloadQueueTimeout.Seconds())))
+	f.writeError(w, http.StatusTooManyRequests, err)
+}
+
+// throttledReader paces reads to a bandwidth.
+type throttledReader struct {
+	io.Reader
+	limit *bandwidth
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttledWriteSize {
+		p = p[:throttledWriteSize]
+	}
+	n, err := r.Reader.Read(p)
+	time.Sleep(r.limit.reserve(n))
+	return n, err
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLimiterConcurrency(t *testing.T) {
+	require := require.New(t)
+
+	l := newDownloadLimiter(0, 0, 2, 1)
+	l.queueTimeout = 50 * time.Millisecond
+	ctx := context.Background()
+
+	_, releaseA, err := l.Acquire(ctx, "10.0.0.1")
+	require.NoError(err)
+
+	// a client over its own limit is rejected without waiting
+	_, _, err = l.Acquire(ctx, "10.0.0.1")
+	require.ErrorIs(err, ErrTooManyDownloads)
+
+	_, releaseB, err := l.Acquire(ctx, "10.0.0.2")
+	require.NoError(err)
+
+	// all slots are taken, the download times out in the queue
+	_, _, err = l.Acquire(ctx, "10.0.0.3")
+	require.ErrorIs(err, ErrTooManyDownloads)
+
+	// queued downloads get the next free slot
+	done := make(chan error)
+	go func() {
+		_, release, err := l.Acquire(ctx, "10.0.0.3")
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	releaseA()
+	require.NoError(<-done)
+
+	releaseB()
+	_, releaseA, err = l.Acquire(ctx, "10.0.0.1")
+	require.NoError(err)
+	releaseA()
+}
+
+func TestThrottledWriter(t *testing.T) {
+	require := require.New(t)
+
+	// 64 KiB/s with a full bucket of one second
+	rate := int64(64 << 10)
+	l := newDownloadLimiter(rate, 0, 0, 0)
+
+	r := httptest.NewRequest("GET", "/download/jklf1test", nil)
+	rec := httptest.NewRecorder()
+	w, release, err := l.throttle(rec, r)
+	require.NoError(err)
+	defer release()
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, rate+rate/4))
+	require.NoError(err)
+	require.EqualValues(rate+rate/4, n)
+	require.EqualValues(rate+rate/4, rec.Body.Len())
+
+	// the burst is sent right away, the rest is paced
+	require.GreaterOrEqual(time.Since(start), 200*time.Millisecond)
+}
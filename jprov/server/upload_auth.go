@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/cosmos/cosmos-sdk/client"
+	cryptotypes "github.com/cosmos/cosmos-sdk/crypto/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// signatures are only accepted if their timestamp is this close to our clock
+const uploadSignatureWindow = 5 * time.Minute
+
+var (
+	ErrMissingSignature  = errors.New("upload must be signed by the sender")
+	ErrInvalidSignature  = errors.New("invalid upload signature")
+	ErrSignatureExpired  = errors.New("upload signature timestamp is out of range")
+	ErrSignatureReplayed = errors.New("upload signature was already used")
+)
+
+// uploadSignature is the proof that the sender authorized an upload.
+type uploadSignature struct {
+	signature []byte
+	timestamp int64
+}
+
+// parseUploadSignature parses the base64 signature and unix timestamp sent
+// with an upload. It returns nil if the upload is not signed.
+func parseUploadSignature(signature, timestamp string) (*uploadSignature, error) {
+	if len(signature) == 0 && len(timestamp) == 0 {
+		return nil, nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidSignature, err)
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidSignature, err)
+	}
+
+	return &uploadSignature{signature: sig, timestamp: ts}, nil
+}
+
+// UploadSignBytes returns the bytes a sender signs to authorize the upload of
+// a file to the provider.
+func UploadSignBytes(fid string, size int64, timestamp int64, provider string) []byte {
+	return []byte(fmt.Sprintf("%s,%d,%d,%s", fid, size, timestamp, provider))
+}
+
+// uploadAuthenticator verifies upload signatures against the public key of
+// the sender's account.
+type uploadAuthenticator struct {
+	provider string
+	required bool
+	pubKey   func(address string) (cryptotypes.PubKey, error)
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// path keeps the used signatures across restarts, they are only kept in
+	// memory if it is empty
+	path string
+}
+
+func newUploadAuthenticator(
+	provider string,
+	required bool,
+	pubKey func(address string) (cryptotypes.PubKey, error),
+	path string,
+) (*uploadAuthenticator, error) {
+	a := &uploadAuthenticator{
+		provider: provider,
+		required: required,
+		pubKey:   pubKey,
+		seen:     make(map[string]time.Time),
+		path:     path,
+	}
+	if len(path) == 0 {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &a.seen)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to read used upload signatures from %s", path), err)
+	}
+	return a, nil
+}
+
+// accountPubKey looks up the public key of an account on chain
+func accountPubKey(clientCtx client.Context) func(address string) (cryptotypes.PubKey, error) {
+	return func(address string) (cryptotypes.PubKey, error) {
+		addr, err := sdk.AccAddressFromBech32(address)
+		if err != nil {
+			return nil, err
+		}
+
+		account, err := clientCtx.AccountRetriever.GetAccount(clientCtx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return account.GetPubKey(), nil
+	}
+}
+
+// Verify checks that sig authorizes the upload of file by sender. Unsigned
+// uploads are accepted unless signatures are required.
+func (a *uploadAuthenticator) Verify(sender string, file *utils.IngestedFile, sig *uploadSignature) error {
+	if sig == nil {
+		if a.required {
+			return ErrMissingSignature
+		}
+		return nil
+	}
+
+	now := time.Now()
+	signed := time.Unix(sig.timestamp, 0)
+	if now.Sub(signed) > uploadSignatureWindow || signed.Sub(now) > uploadSignatureWindow {
+		return ErrSignatureExpired
+	}
+
+	pubKey, err := a.pubKey(sender)
+	if err != nil {
+		return errors.Join(ErrInvalidSignature, err)
+	}
+	// accounts only have a public key once they sent a transaction
+	if pubKey == nil {
+		return errors.Join(ErrInvalidSignature, fmt.Errorf("no public key found for %s", sender))
+	}
+
+	msg := UploadSignBytes(file.Fid, file.Size, sig.timestamp, a.provider)
+	if !pubKey.VerifySignature(msg, sig.signature) {
+		return ErrInvalidSignature
+	}
+
+	return a.markUsed(sender+","+string(msg), signed, now)
+}
+
+// markUsed records a signed message so it can't be used again while its
+// timestamp is valid.
+func (a *uploadAuthenticator) markUsed(key string, signed time.Time, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for k, t := range a.seen {
+		if now.Sub(t) > uploadSignatureWindow {
+			delete(a.seen, k)
+		}
+	}
+
+	if _, ok := a.seen[key]; ok {
+		return ErrSignatureReplayed
+	}
+	a.seen[key] = signed
+
+	err := a.save()
+	if err != nil {
+		delete(a.seen, key)
+		return errors.Join(errors.New("failed to record upload signature"), err)
+	}
+	return nil
+}
+
+// save writes the used signatures to a.path, the old file is replaced at
+// once so a crash doesn't lose them. The caller must hold a.mu.
+func (a *uploadAuthenticator) save() error {
+	if len(a.path) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(a.seen)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	err = errors.Join(err, file.Sync(), file.Close())
+	if err == nil {
+		err = os.Rename(file.Name(), a.path)
+	}
+	if err != nil {
+		return errors.Join(err, os.Remove(file.Name()))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	cryptotypes "github.com/cosmos/cosmos-sdk/crypto/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadAuthenticator(t *testing.T) {
+	const provider = "jkl1provider"
+
+	key := secp256k1.GenPrivKey()
+	file := &utils.IngestedFile{Fid: "jklf1test", Size: 42}
+
+	sign := func(fid string, timestamp int64) *uploadSignature {
+		sig, err := key.Sign(UploadSignBytes(fid, file.Size, timestamp, provider))
+		require.NoError(t, err)
+		return &uploadSignature{signature: sig, timestamp: timestamp}
+	}
+
+	now := time.Now().Unix()
+
+	cases := map[string]struct {
+		required bool
+		sig      *uploadSignature
+		expErr   error
+	}{
+		"unsigned_optional": {},
+		"unsigned_required": {
+			required: true,
+			expErr:   ErrMissingSignature,
+		},
+		"valid": {
+			required: true,
+			sig:      sign(file.Fid, now),
+		},
+		"other_file": {
+			sig:    sign("jklf1other", now),
+			expErr: ErrInvalidSignature,
+		},
+		"expired": {
+			sig:    sign(file.Fid, now-int64(2*uploadSignatureWindow/time.Second)),
+			expErr: ErrSignatureExpired,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			auth, err := newUploadAuthenticator(provider, c.required, func(string) (cryptotypes.PubKey, error) {
+				return key.PubKey(), nil
+			}, "")
+			require.NoError(t, err)
+
+			err = auth.Verify("jkl1sender", file, c.sig)
+			if c.expErr != nil {
+				require.ErrorIs(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestUploadAuthenticatorReplay(t *testing.T) {
+	require := require.New(t)
+
+	key := secp256k1.GenPrivKey()
+	file := &utils.IngestedFile{Fid: "jklf1test", Size: 42}
+	pubKey := func(string) (cryptotypes.PubKey, error) {
+		return key.PubKey(), nil
+	}
+	path := filepath.Join(t.TempDir(), "upload_signatures.json")
+	auth, err := newUploadAuthenticator("jkl1provider", true, pubKey, path)
+	require.NoError(err)
+
+	timestamp := time.Now().Unix()
+	raw, err := key.Sign(UploadSignBytes(file.Fid, file.Size, timestamp, "jkl1provider"))
+	require.NoError(err)
+
+	sig, err := parseUploadSignature(base64.StdEncoding.EncodeToString(raw), strconv.FormatInt(timestamp, 10))
+	require.NoError(err)
+
+	require.NoError(auth.Verify("jkl1sender", file, sig))
+	require.ErrorIs(auth.Verify("jkl1sender", file, sig), ErrSignatureReplayed)
+
+	// used signatures are remembered after a restart
+	auth, err = newUploadAuthenticator("jkl1provider", true, pubKey, path)
+	require.NoError(err)
+	require.ErrorIs(auth.Verify("jkl1sender", file, sig), ErrSignatureReplayed)
+
+	// but not by a provider that only keeps them in memory
+	auth, err = newUploadAuthenticator("jkl1provider", true, pubKey, "")
+	require.NoError(err)
+	require.NoError(auth.Verify("jkl1sender", file, sig))
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+)
+
+// maxBatchFiles bounds the number of files of a single batch upload
+const maxBatchFiles = 1000
+
+var ErrDuplicateBatchFile = errors.New("file was already uploaded in this batch")
+
+type batchUpload struct {
+	file   *utils.IngestedFile
+	cid    string
+	msg    *types.Upload
+	result types.UploadBatchResult
+}
+
+func (b *batchUpload) fail(err error) {
+	b.result.Error = errors.Join(err, b.file.Discard()).Error()
+	b.msg = nil
+}
+
+// fileUploadBatch stores all files of the form for one sender. Their
+// contracts are queued together so they are posted in as few transactions as
+// the message size allows.
+func (f *FileServer) fileUploadBatch(w http.ResponseWriter, r *http.Request) {
+	reservation, err := f.capacity.Reserve(max(r.ContentLength, 0))
+	if err != nil {
+		f.writeError(w, capacityErrorStatus(err), err)
+		return
+	}
+	defer reservation.Release()
+
+	r.Body = http.MaxBytesReader(w, reservation.Body(r.Body), types.MaxFileSize)
+
+	form, err := f.readUploadParts(r, maxBatchFiles)
+	if err != nil {
+		f.writeError(w, capacityErrorStatus(err), err)
+		return
+	}
+
+	results := f.saveBatch(form)
+
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		f.logger.Error(fmt.Sprintf("fileUploadBatch: %s", err.Error()))
+	}
+}
+
+// saveBatch posts the contracts of all files of the form and stores the files
+// whose contract succeeded.
+func (f *FileServer) saveBatch(form *uploadForm) []types.UploadBatchResult {
+	uploads := make([]*batchUpload, len(form.files))
+	seen := make(map[string]bool)
+
+	for i, file := range form.files {
+		u := &batchUpload{file: file}
+		u.result.FID = file.Fid
+		uploads[i] = u
+
+		// the same contract twice would fail the whole transaction
+		if seen[file.Fid] {
+			u.fail(ErrDuplicateBatchFile)
+			continue
+		}
+		seen[file.Fid] = true
+
+		sig, err := form.signature(i)
+		if err == nil {
+			err = f.auth.Verify(form.sender, file, sig)
+		}
+		if err != nil {
+			u.fail(err)
+			continue
+		}
+
+		u.cid, err = buildCid(f.serverCtx.address, form.sender, file.Fid)
+		if err != nil {
+			u.fail(err)
+			continue
+		}
+		u.result.CID = u.cid
+
+		u.msg, err = f.newContract(file.Fid, form.sender, nil, string(file.Tree.Root()), fmt.Sprintf("%d", file.Size))
+		if err != nil {
+			u.fail(err)
+			continue
+		}
+	}
+
+	msgs := make([]*types.Upload, 0, len(uploads))
+	for _, u := range uploads {
+		if u.msg != nil {
+			msgs = append(msgs, u.msg)
+		}
+	}
+	f.postContracts(msgs)
+
+	results := make([]types.UploadBatchResult, len(uploads))
+	for i, u := range uploads {
+		if u.msg != nil {
+			dedup, err := f.finishUpload(u.file, u.cid, u.msg)
+			if err != nil {
+				f.logger.Error(fmt.Sprintf("saveBatch: %s: %s", u.file.Fid, err.Error()))
+				u.result.Error = err.Error()
+			}
+			u.result.Deduplicated = dedup
+		}
+		results[i] = u.result
+	}
+
+	return results
+}
+
+// postContracts queues msgs and waits until they were posted. A transaction
+// fails as a whole, so the contracts of a failed transaction are posted again
+// in halves until the contracts that failed it are found.
+func (f *FileServer) postContracts(msgs []*types.Upload) {
+	f.queueContracts(msgs)
+	f.retryContracts(failedContracts(msgs))
+}
+
+// retryContracts posts failed again in halves. Each half that fails again is
+// split on its own, until every contract that fails is posted alone.
+func (f *FileServer) retryContracts(failed []*types.Upload) {
+	if len(failed) < 2 {
+		return
+	}
+
+	first, second := failed[:len(failed)/2], failed[len(failed)/2:]
+	f.queueContracts(first)
+	f.queueContracts(second)
+
+	f.retryContracts(failedContracts(first))
+	f.retryContracts(failedContracts(second))
+}
+
+// queueContracts queues msgs and waits until they were posted, results of
+// earlier attempts are reset.
+func (f *FileServer) queueContracts(msgs []*types.Upload) {
+	var wg sync.WaitGroup
+	for _, msg := range msgs {
+		msg.Callback = &wg
+		msg.Err = nil
+		msg.Response = nil
+	}
+	wg.Add(len(msgs))
+	f.queue.Queue = append(f.queue.Queue, msgs...)
+	wg.Wait()
+}
+
+func failedContracts(msgs []*types.Upload) []*types.Upload {
+	var failed []*types.Upload
+	for _, msg := range msgs {
+		if contractError(msg) != nil {
+			failed = append(failed, msg)
+		}
+	}
+	return failed
+}
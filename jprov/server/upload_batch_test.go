@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/queue"
+	cryptotypes "github.com/cosmos/cosmos-sdk/crypto/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/bech32"
+	storageTypes "github.com/jackalLabs/canine-chain/v3/x/storage/types"
+	"github.com/stretchr/testify/require"
+)
+
+func newBatchRequest(t *testing.T, sender string, signatures []string, files ...[]byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	require.NoError(t, writer.WriteField("sender", sender))
+	for _, sig := range signatures {
+		require.NoError(t, writer.WriteField("signature", sig))
+	}
+	for i, data := range files {
+		part, err := writer.CreateFormFile("file", fmt.Sprintf("file%d", i))
+		require.NoError(t, err)
+		_, err = part.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/upload/batch", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestReadUploadParts(t *testing.T) {
+	require := require.New(t)
+
+	f, rootDir := setupUploadServer(t)
+
+	r := newBatchRequest(t, "jkl1sender", nil, []byte("first"), []byte("second"))
+
+	form, err := f.readUploadParts(r, maxBatchFiles)
+	require.NoError(err)
+	require.Equal("jkl1sender", form.sender)
+	require.Len(form.files, 2)
+	require.EqualValues(5, form.files[0].Size)
+	require.EqualValues(6, form.files[1].Size)
+
+	sig, err := form.signature(1)
+	require.NoError(err)
+	require.Nil(sig)
+
+	require.NoError(form.discard())
+
+	// files of a rejected form are not left behind
+	r = newBatchRequest(t, "jkl1sender", nil, []byte("first"), []byte("second"), []byte("third"))
+
+	_, err = f.readUploadParts(r, 2)
+	require.Error(err)
+
+	staged, err := os.ReadDir(filepath.Join(rootDir, "staging"))
+	require.NoError(err)
+	require.Empty(staged)
+}
+
+func TestUploadFormSignatures(t *testing.T) {
+	f, _ := setupUploadServer(t)
+
+	r := newBatchRequest(t, "jkl1sender", []string{"c2ln"}, []byte("first"), []byte("second"))
+
+	form, err := f.readUploadParts(r, maxBatchFiles)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, form.discard())
+	}()
+
+	// every file needs its own signature
+	_, err = form.signature(0)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func testAddress(t *testing.T, b byte) string {
+	address, err := bech32.ConvertAndEncode(storageTypes.AddressPrefix, bytes.Repeat([]byte{b}, 20))
+	require.NoError(t, err)
+	return address
+}
+
+// processQueue posts everything queued in one transaction like the queue
+// listener, reject returns the error of the transaction. It returns the
+// number of transactions.
+func processQueue(t *testing.T, q *queue.UploadQueue, reject func(fids []string) error) *atomic.Int32 {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var txs atomic.Int32
+	go func() {
+		for ctx.Err() == nil {
+			if len(q.Queue) == 0 {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+
+			q.Locked = true
+			count := len(q.Queue)
+			fids := make([]string, count)
+			for i, u := range q.Queue[:count] {
+				fids[i] = u.Message.(*storageTypes.MsgPostContract).Fid
+			}
+			txs.Add(1)
+			q.UpdateQueue(count, reject(fids), &sdk.TxResponse{})
+			q.Queue = q.Queue[count:]
+			q.Locked = false
+		}
+	}()
+	return &txs
+}
+
+func TestSaveBatch(t *testing.T) {
+	files := [][]byte{[]byte("first"), []byte("second"), []byte("third"), []byte("fourth")}
+	errTx := errors.New("transaction failed")
+
+	cases := map[string]struct {
+		// bad files fail every transaction they are part of
+		bad    []int
+		files  [][]byte
+		failTx bool
+		expErr []int
+		maxTxs int32
+	}{
+		"success": {
+			files:  files,
+			maxTxs: 1,
+		},
+		"bad_contract": {
+			files:  files,
+			bad:    []int{2},
+			expErr: []int{2},
+			maxTxs: 1 + 2 + 2,
+		},
+		"bad_contracts": {
+			files:  files,
+			bad:    []int{0, 3},
+			expErr: []int{0, 3},
+			maxTxs: 1 + 2 + 4,
+		},
+		"failed_transaction": {
+			files:  files,
+			failTx: true,
+			expErr: []int{0, 1, 2, 3},
+			maxTxs: 1 + 2 + 4,
+		},
+		"duplicate_file": {
+			files:  [][]byte{[]byte("first"), []byte("first")},
+			expErr: []int{1},
+			maxTxs: 1,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			f, rootDir := setupUploadServer(t)
+			f.serverCtx = &serverContext{address: testAddress(t, 1)}
+			auth, err := newUploadAuthenticator(f.serverCtx.address, false, func(string) (cryptotypes.PubKey, error) {
+				return nil, nil
+			}, "")
+			require.NoError(err)
+			f.auth = auth
+			f.queue = &queue.UploadQueue{}
+
+			form, err := f.readUploadParts(newBatchRequest(t, testAddress(t, 2), nil, c.files...), maxBatchFiles)
+			require.NoError(err)
+
+			bad := make(map[string]bool)
+			for _, i := range c.bad {
+				bad[form.files[i].Fid] = true
+			}
+			txs := processQueue(t, f.queue, func(fids []string) error {
+				if c.failTx || slices.ContainsFunc(fids, func(fid string) bool { return bad[fid] }) {
+					return errTx
+				}
+				return nil
+			})
+
+			results := f.saveBatch(form)
+			require.Len(results, len(c.files))
+			for i, result := range results {
+				require.Equal(form.files[i].Fid, result.FID)
+				if slices.Contains(c.expErr, i) {
+					require.NotEmpty(result.Error, i)
+					continue
+				}
+				require.Empty(result.Error, i)
+				require.NotEmpty(result.CID)
+
+				fid, err := f.archivedb.GetFid(result.CID)
+				require.NoError(err)
+				require.Equal(result.FID, fid)
+				require.False(f.archive.FileExist(result.FID)) // FileExist is true for missing files
+			}
+			require.LessOrEqual(txs.Load(), c.maxTxs)
+
+			staged, err := os.ReadDir(filepath.Join(rootDir, "staging"))
+			require.NoError(err)
+			require.Empty(staged)
+		})
+	}
+}
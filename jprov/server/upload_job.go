@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/julienschmidt/httprouter"
+)
+
+// finished jobs are kept around this long so clients can poll their status
+const uploadJobTTL = time.Hour
+
+var ErrJobNotFound = errors.New("upload job not found")
+
+type uploadJob struct {
+	id  string
+	cid string
+	fid string
+
+	mu       sync.Mutex
+	status   string
+	txHash   string
+	err      error
+	dedup    bool
+	finished time.Time
+}
+
+func (j *uploadJob) setStatus(status string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+}
+
+func (j *uploadJob) setDeduplicated(dedup bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.dedup = dedup
+}
+
+func (j *uploadJob) finish(status string, txHash string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+	j.txHash = txHash
+	j.err = err
+	j.finished = time.Now()
+}
+
+func (j *uploadJob) expired(now time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finished.IsZero() && now.Sub(j.finished) > uploadJobTTL
+}
+
+func (j *uploadJob) response() types.UploadStatusResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	resp := types.UploadStatusResponse{
+		ID:     j.id,
+		Status: j.status,
+		CID:    j.cid,
+		FID:    j.fid,
+		TxHash: j.txHash,
+
+		Deduplicated: j.dedup,
+	}
+	if j.err != nil {
+		resp.Error = j.err.Error()
+	}
+	return resp
+}
+
+// uploadJobs tracks contracts of asynchronous uploads in memory.
+type uploadJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*uploadJob
+}
+
+func newUploadJobs() *uploadJobs {
+	return &uploadJobs{jobs: make(map[string]*uploadJob)}
+}
+
+func (u *uploadJobs) Add(fid, cid string) (*uploadJob, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := uploadJob{
+		id:     id,
+		cid:    cid,
+		fid:    fid,
+		status: types.UploadQueued,
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	for k, j := range u.jobs {
+		if j.expired(now) {
+			delete(u.jobs, k)
+		}
+	}
+	u.jobs[id] = &job
+
+	return &job, nil
+}
+
+func (u *uploadJobs) Get(id string) (*uploadJob, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	job, ok := u.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// waitForContract waits for the contract of an asynchronous upload to be
+// processed by the queue, stores the file and records the outcome in the job.
+func (f *FileServer) waitForContract(job *uploadJob, file *utils.IngestedFile, msg *types.Upload, wg *sync.WaitGroup) {
+	wg.Wait()
+
+	var txHash string
+	if msg.Response != nil {
+		txHash = msg.Response.TxHash
+	}
+
+	dedup, err := f.finishUpload(file, job.cid, msg)
+	if err != nil {
+		f.logger.Error(fmt.Sprintf("async upload %s: %s", job.id, err.Error()))
+		job.finish(types.UploadFailed, txHash, err)
+		return
+	}
+
+	// a tx that is not in a block yet was only broadcast in sync mode
+	status := types.UploadCommitted
+	if msg.Response.Height == 0 {
+		status = types.UploadBroadcast
+	}
+	job.setDeduplicated(dedup)
+	job.finish(status, txHash, nil)
+}
+
+func writeJobResponse(w http.ResponseWriter, status int, job *uploadJob) error {
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(job.response())
+}
+
+func (f *FileServer) uploadStatus(w http.ResponseWriter, ps httprouter.Params) {
+	job, err := f.jobs.Get(ps.ByName("id"))
+	if err != nil {
+		f.writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	err = writeJobResponse(w, http.StatusOK, job)
+	if err != nil {
+		f.logger.Error(err.Error())
+	}
+}
+
+// isAsync reports whether the client asked for the upload to return before
+// its contract is posted.
+func isAsync(r *http.Request) bool {
+	async, err := strconv.ParseBool(r.URL.Query().Get("async"))
+	return err == nil && async
+}
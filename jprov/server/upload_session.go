@@ -0,0 +1,336 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+)
+
+// Resumable upload sessions are stored on disk so they survive a restart.
+//
+// <home>/uploads
+//	/ <session id>
+//		/ session.json *sender and declared size
+//		/ data.part    *bytes received so far, its size is the current offset
+
+const (
+	uploadSessionMeta = "session.json"
+	uploadSessionData = "data.part"
+
+	// sessions that have not received any data for this long are removed
+	uploadSessionTTL = 24 * time.Hour
+)
+
+var (
+	ErrSessionNotFound   = errors.New("upload session not found")
+	ErrOffsetMismatch    = errors.New("upload offset does not match session offset")
+	ErrSessionIncomplete = errors.New("upload session is not complete")
+	ErrSessionOverflow   = errors.New("chunk exceeds declared upload size")
+	ErrSessionFinalizing = errors.New("upload session is already being finalized")
+)
+
+type uploadSession struct {
+	ID      string    `json:"id"`
+	Sender  string    `json:"sender"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type uploadSessionStore struct {
+	rootDir string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	// finalizing holds the sessions whose file is being stored
+	finalizing map[string]bool
+}
+
+func newUploadSessionStore(rootDir string) (*uploadSessionStore, error) {
+	err := os.MkdirAll(rootDir, os.ModePerm)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create upload session directory"), err)
+	}
+
+	return &uploadSessionStore{
+		rootDir:    rootDir,
+		locks:      make(map[string]*sync.Mutex),
+		finalizing: make(map[string]bool),
+	}, nil
+}
+
+func (s *uploadSessionStore) sessionDir(id string) string {
+	return filepath.Join(s.rootDir, id)
+}
+
+func (s *uploadSessionStore) dataPath(id string) string {
+	return filepath.Join(s.sessionDir(id), uploadSessionData)
+}
+
+func (s *uploadSessionStore) metaPath(id string) string {
+	return filepath.Join(s.sessionDir(id), uploadSessionMeta)
+}
+
+// lock returns the mutex guarding session id so chunks of the same session
+// are never appended concurrently.
+func (s *uploadSessionStore) lock(id string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	return l
+}
+
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create starts a new session for a file of size bytes owned by sender.
+func (s *uploadSessionStore) Create(sender string, size int64) (*uploadSession, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+
+	session := uploadSession{
+		ID:      id,
+		Sender:  sender,
+		Size:    size,
+		Created: time.Now(),
+	}
+
+	err = os.Mkdir(s.sessionDir(id), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(s.metaPath(id), meta, 0o600)
+	if err != nil {
+		return nil, errors.Join(err, os.RemoveAll(s.sessionDir(id)))
+	}
+
+	file, err := os.Create(s.dataPath(id))
+	if err != nil {
+		return nil, errors.Join(err, os.RemoveAll(s.sessionDir(id)))
+	}
+
+	return &session, file.Close()
+}
+
+// Get returns the session and the number of bytes received so far.
+func (s *uploadSessionStore) Get(id string) (session *uploadSession, offset int64, err error) {
+	// ids are hex strings, anything else could escape the upload directory
+	if _, err := hex.DecodeString(id); err != nil || len(id) == 0 {
+		return nil, 0, ErrSessionNotFound
+	}
+
+	meta, err := os.ReadFile(s.metaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	session = &uploadSession{}
+	err = json.Unmarshal(meta, session)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return session, stat.Size(), nil
+}
+
+// Append writes data at offset and returns the new offset of the session.
+// The offset must be equal to the current offset of the session.
+func (s *uploadSessionStore) Append(id string, offset int64, data io.Reader) (newOffset int64, err error) {
+	l := s.lock(id)
+	l.Lock()
+	defer l.Unlock()
+
+	session, current, err := s.Get(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset != current {
+		return current, ErrOffsetMismatch
+	}
+
+	file, err := os.OpenFile(s.dataPath(id), os.O_WRONLY, archive.FilePerm)
+	if err != nil {
+		return current, err
+	}
+	defer func() {
+		err = errors.Join(err, file.Close())
+	}()
+
+	_, err = file.Seek(current, io.SeekStart)
+	if err != nil {
+		return current, err
+	}
+
+	// read one byte past the remaining size to detect oversized chunks
+	remaining := session.Size - current
+	written, err := io.Copy(file, io.LimitReader(data, remaining+1))
+	if err != nil {
+		// keep whatever made it to disk, the client resumes from the new offset
+		return current + written, err
+	}
+
+	if written > remaining {
+		return current, errors.Join(ErrSessionOverflow, file.Truncate(current))
+	}
+
+	return current + written, nil
+}
+
+// Open returns the completed data of the session. The caller must close it.
+func (s *uploadSessionStore) Open(id string) (*os.File, *uploadSession, error) {
+	session, offset, err := s.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if offset != session.Size {
+		return nil, nil, ErrSessionIncomplete
+	}
+
+	file, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, session, nil
+}
+
+// BeginFinalize marks session id as being finalized until done is called, so
+// its file is only stored and its contract only posted once.
+func (s *uploadSessionStore) BeginFinalize(id string) (done func(), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finalizing[id] {
+		return nil, ErrSessionFinalizing
+	}
+	s.finalizing[id] = true
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.finalizing, id)
+	}, nil
+}
+
+// Delete removes the session and all data received for it.
+func (s *uploadSessionStore) Delete(id string) error {
+	l := s.lock(id)
+	l.Lock()
+	defer l.Unlock()
+
+	err := os.RemoveAll(s.sessionDir(id))
+
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+
+	return err
+}
+
+// CleanExpired removes sessions that have not received data within ttl.
+func (s *uploadSessionStore) CleanExpired(ttl time.Duration) (removed int, err error) {
+	dirs, err := os.ReadDir(s.rootDir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		stat, statErr := os.Stat(s.dataPath(dir.Name()))
+		if errors.Is(statErr, os.ErrNotExist) {
+			// leftovers of a failed Create, or one that is still running
+			stat, statErr = os.Stat(s.sessionDir(dir.Name()))
+		}
+		if statErr != nil {
+			err = errors.Join(err, statErr)
+			continue
+		}
+
+		if time.Since(stat.ModTime()) < ttl {
+			continue
+		}
+
+		if rmErr := s.Delete(dir.Name()); rmErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to remove upload session %s: %w", dir.Name(), rmErr))
+			continue
+		}
+		removed++
+	}
+
+	return removed, err
+}
+
+// Pending returns the number of bytes all sessions still expect to receive.
+func (s *uploadSessionStore) Pending() (int64, error) {
+	dirs, err := os.ReadDir(s.rootDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var pending int64
+	for _, dir := range dirs {
+		// sessions that can't be read are never completed and get cleaned up
+		session, offset, err := s.Get(dir.Name())
+		if err != nil {
+			continue
+		}
+		pending += session.Size - offset
+	}
+
+	return pending, nil
+}
+
+// StartUploadSessionCleaner periodically removes abandoned upload sessions.
+func (f *FileServer) StartUploadSessionCleaner() {
+	for {
+		removed, err := f.sessions.CleanExpired(uploadSessionTTL)
+		if err != nil {
+			f.logger.Error(fmt.Sprintf("failed to clean upload sessions: %s", err.Error()))
+		}
+		if removed > 0 {
+			f.logger.Info(fmt.Sprintf("removed %d expired upload sessions", removed))
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSessionResume(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	store, err := newUploadSessionStore(dir)
+	require.NoError(err)
+
+	data := []byte("hello, world\n")
+
+	session, err := store.Create("sender", int64(len(data)))
+	require.NoError(err)
+
+	offset, err := store.Append(session.ID, 0, bytes.NewReader(data[:5]))
+	require.NoError(err)
+	require.EqualValues(5, offset)
+
+	// wrong offset is rejected and reports the current one
+	offset, err = store.Append(session.ID, 0, bytes.NewReader(data[5:]))
+	require.ErrorIs(err, ErrOffsetMismatch)
+	require.EqualValues(5, offset)
+
+	_, _, err = store.Open(session.ID)
+	require.ErrorIs(err, ErrSessionIncomplete)
+
+	// a new store over the same directory picks up where we left off
+	store, err = newUploadSessionStore(dir)
+	require.NoError(err)
+
+	restored, offset, err := store.Get(session.ID)
+	require.NoError(err)
+	require.EqualValues(5, offset)
+	require.Equal("sender", restored.Sender)
+
+	_, err = store.Append(session.ID, 5, bytes.NewReader(append(data[5:], 'x')))
+	require.ErrorIs(err, ErrSessionOverflow)
+
+	offset, err = store.Append(session.ID, 5, bytes.NewReader(data[5:]))
+	require.NoError(err)
+	require.EqualValues(len(data), offset)
+
+	file, _, err := store.Open(session.ID)
+	require.NoError(err)
+	res, err := io.ReadAll(file)
+	require.NoError(err)
+	require.NoError(file.Close())
+	require.Equal(data, res)
+
+	require.NoError(store.Delete(session.ID))
+	_, _, err = store.Get(session.ID)
+	require.ErrorIs(err, ErrSessionNotFound)
+}
+
+func TestUploadSessionFinalize(t *testing.T) {
+	require := require.New(t)
+
+	store, err := newUploadSessionStore(t.TempDir())
+	require.NoError(err)
+
+	done, err := store.BeginFinalize("first")
+	require.NoError(err)
+
+	// a session is only finalized once at a time
+	_, err = store.BeginFinalize("first")
+	require.ErrorIs(err, ErrSessionFinalizing)
+
+	otherDone, err := store.BeginFinalize("second")
+	require.NoError(err)
+	otherDone()
+
+	done()
+	done, err = store.BeginFinalize("first")
+	require.NoError(err)
+	done()
+}
+
+func TestUploadSessionInvalidID(t *testing.T) {
+	store, err := newUploadSessionStore(t.TempDir())
+	require.NoError(t, err)
+
+	_, _, err = store.Get("../storage")
+	require.ErrorIs(t, err, ErrSessionNotFound)
+}
+
+func TestUploadSessionCleanExpired(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	store, err := newUploadSessionStore(dir)
+	require.NoError(err)
+
+	stale, err := store.Create("sender", 10)
+	require.NoError(err)
+	fresh, err := store.Create("sender", 10)
+	require.NoError(err)
+
+	old := time.Now().Add(-2 * uploadSessionTTL)
+	require.NoError(os.Chtimes(filepath.Join(dir, stale.ID, uploadSessionData), old, old))
+
+	removed, err := store.CleanExpired(uploadSessionTTL)
+	require.NoError(err)
+	require.Equal(1, removed)
+
+	_, _, err = store.Get(stale.ID)
+	require.ErrorIs(err, ErrSessionNotFound)
+	_, _, err = store.Get(fresh.ID)
+	require.NoError(err)
+}
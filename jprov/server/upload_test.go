@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/archive/kv"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/stretchr/testify/require"
+)
+
+var errInjected = errors.New("injected failure")
+
+type failingCommitArchive struct {
+	archive.Archive
+}
+
+func (a failingCommitArchive) CommitFile(stage string, fid string) error {
+	return errInjected
+}
+
+type failingArchiveDB struct {
+	archive.ArchiveDB
+}
+
+func (d failingArchiveDB) SetContract(cid string, fid string) error {
+	return errInjected
+}
+
+func setupUploadServer(t *testing.T) (*FileServer, string) {
+	rootDir := t.TempDir()
+
+	archivedb, err := archive.NewDoubleRefArchiveDB(kv.LevelDB, filepath.Join(rootDir, "archivedb"))
+	require.NoError(t, err)
+	downtimedb, err := archive.NewDowntimeDB(kv.LevelDB, filepath.Join(rootDir, "downtimedb"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = archivedb.Close()
+		_ = downtimedb.Close()
+	})
+
+	f := &FileServer{
+		archive:    archive.NewSingleCellArchive(rootDir),
+		archivedb:  archivedb,
+		downtimedb: downtimedb,
+		blockSize:  1024,
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		downloads:  newDownloadLimiter(0, 0, 0, 0),
+	}
+	return f, rootDir
+}
+
+func TestFinishUpload(t *testing.T) {
+	const cid = "jklc1test"
+	data := []byte("hello, world\n")
+
+	cases := map[string]struct {
+		msg    types.Upload
+		setup  func(f *FileServer)
+		expErr bool
+		// the contract was posted, a stored file is added to the database
+		// when active deals are recollected
+		expStored bool
+	}{
+		"success": {
+			msg:       types.Upload{Response: &sdk.TxResponse{TxHash: "hash"}},
+			expStored: true,
+		},
+		"tx_error": {
+			msg:    types.Upload{Err: errInjected},
+			expErr: true,
+		},
+		"no_tx_response": {
+			msg:    types.Upload{},
+			expErr: true,
+		},
+		"commit_error": {
+			msg: types.Upload{Response: &sdk.TxResponse{TxHash: "hash"}},
+			setup: func(f *FileServer) {
+				f.archive = failingCommitArchive{f.archive}
+			},
+			expErr: true,
+		},
+		"archivedb_error": {
+			msg: types.Upload{Response: &sdk.TxResponse{TxHash: "hash"}},
+			setup: func(f *FileServer) {
+				f.archivedb = failingArchiveDB{f.archivedb}
+			},
+			expErr:    true,
+			expStored: true,
+		},
+		"downtimedb_error": {
+			msg: types.Upload{Response: &sdk.TxResponse{TxHash: "hash"}},
+			setup: func(f *FileServer) {
+				require.NoError(t, f.downtimedb.Close())
+			},
+			expErr:    true,
+			expStored: true,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			f, rootDir := setupUploadServer(t)
+			if c.setup != nil {
+				c.setup(f)
+			}
+
+			file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+			require.NoError(err)
+
+			_, err = f.finishUpload(file, cid, &c.msg)
+
+			staged, readErr := os.ReadDir(filepath.Join(rootDir, "staging"))
+			require.NoError(readErr)
+			_, fidErr := f.archivedb.GetFid(cid)
+			_, statErr := os.Stat(filepath.Join(rootDir, "storage", file.Fid))
+
+			require.Empty(staged)
+			if c.expStored {
+				require.NoError(statErr)
+			} else {
+				require.ErrorIs(statErr, os.ErrNotExist)
+			}
+
+			if c.expErr {
+				require.Error(err)
+				require.ErrorIs(fidErr, archive.ErrContractNotFound)
+				return
+			}
+
+			require.NoError(err)
+			require.NoError(fidErr)
+			_, err = f.downtimedb.Get(cid)
+			require.NoError(err)
+		})
+	}
+}
+
+// flakyArchiveDB fails to add the first failures contracts.
+type flakyArchiveDB struct {
+	archive.ArchiveDB
+	failures int
+}
+
+func (d *flakyArchiveDB) SetContract(cid string, fid string) error {
+	if d.failures > 0 {
+		d.failures--
+		return errInjected
+	}
+	return d.ArchiveDB.SetContract(cid, fid)
+}
+
+func TestFinishUploadRetries(t *testing.T) {
+	require := require.New(t)
+
+	f, _ := setupUploadServer(t)
+	f.archivedb = &flakyArchiveDB{ArchiveDB: f.archivedb, failures: storeAttempts - 1}
+
+	file, err := utils.IngestFile(f.archive, bytes.NewReader([]byte("hello, world\n")), f.blockSize)
+	require.NoError(err)
+	_, err = f.finishUpload(file, "jklc1test", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(err)
+
+	fid, err := f.archivedb.GetFid("jklc1test")
+	require.NoError(err)
+	require.Equal(file.Fid, fid)
+}
+
+func TestFinishUploadKeepsStoredFile(t *testing.T) {
+	require := require.New(t)
+
+	f, rootDir := setupUploadServer(t)
+	data := []byte("hello, world\n")
+
+	file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	dedup, err := f.finishUpload(file, "jklc1first", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(err)
+	require.False(dedup)
+
+	// a second contract for the same file fails after the data was committed
+	f.archivedb = failingArchiveDB{f.archivedb}
+	file, err = utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	_, err = f.finishUpload(file, "jklc1second", &types.Upload{Response: &sdk.TxResponse{}})
+	require.Error(err)
+
+	stored, err := os.ReadFile(filepath.Join(rootDir, "storage", file.Fid, file.Fid+".jkl"))
+	require.NoError(err)
+	require.Equal(data, stored)
+}
+
+func TestFinishUploadDeduplicates(t *testing.T) {
+	require := require.New(t)
+
+	f, rootDir := setupUploadServer(t)
+	data := []byte("hello, world\n")
+	path := filepath.Join(rootDir, "storage")
+
+	file, err := utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	_, err = f.finishUpload(file, "jklc1first", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(err)
+
+	file, err = utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	dedup, err := f.finishUpload(file, "jklc1second", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(err)
+	require.True(dedup)
+
+	cids, err := f.archivedb.GetContracts(file.Fid)
+	require.NoError(err)
+	require.Equal([]string{"jklc1first", "jklc1second"}, cids)
+
+	staged, err := os.ReadDir(filepath.Join(rootDir, "staging"))
+	require.NoError(err)
+	require.Empty(staged)
+
+	// a truncated copy is replaced by the upload instead, damaged data of the
+	// right size is left to the scrubber
+	filePath := filepath.Join(path, file.Fid, file.Fid+".jkl")
+	require.NoError(os.WriteFile(filePath, []byte("hello"), 0o600))
+
+	file, err = utils.IngestFile(f.archive, bytes.NewReader(data), f.blockSize)
+	require.NoError(err)
+	dedup, err = f.finishUpload(file, "jklc1third", &types.Upload{Response: &sdk.TxResponse{}})
+	require.NoError(err)
+	require.False(dedup)
+
+	stored, err := os.ReadFile(filePath)
+	require.NoError(err)
+	require.Equal(data, stored)
+}
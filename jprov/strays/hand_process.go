@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
 	"github.com/JackalLabs/jackal-provider/jprov/crypto"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
 	"github.com/JackalLabs/jackal-provider/jprov/utils"
 	"github.com/cosmos/cosmos-sdk/client"
 	txns "github.com/cosmos/cosmos-sdk/client/tx"
@@ -86,6 +89,13 @@ func (h *LittleHand) Process(ctx *utils.Context, m *StrayManager) { // process t
 	ctx.Logger.Info(fmt.Sprintf("Getting info for %s", h.Stray.Cid))
 	arr := h.SearchFile(ctx, h.Stray.Fid)
 
+	// a file we still have was stored with the configured chunk size
+	chunkSize, err := h.Cmd.Flags().GetInt64(types.FlagChunkSize)
+	if err != nil {
+		ctx.Logger.Error(err.Error())
+		return
+	}
+
 	if len(arr) == 0 {
 		/**
 		If there are no providers with the file, we check if it's on our provider's filesystem. (We cannot claim
@@ -110,11 +120,12 @@ func (h *LittleHand) Process(ctx *utils.Context, m *StrayManager) { // process t
 				continue
 			}
 
-			err := h.DownloadFileFromURL(prov, h.Stray.Fid, h.Stray.Cid)
+			downloaded, err := h.DownloadFileFromURL(prov, h.Stray.Fid, h.Stray.Cid)
 			if err != nil {
 				ctx.Logger.Error(err.Error())
 				continue
 			}
+			chunkSize = downloaded
 			found = true // If we can successfully download the file, stop there.
 		}
 
@@ -126,7 +137,7 @@ func (h *LittleHand) Process(ctx *utils.Context, m *StrayManager) { // process t
 
 	ctx.Logger.Info(fmt.Sprintf("Attempting to claim %s on chain", h.Stray.Cid))
 
-	err := h.ClaimStray(m)
+	err = h.ClaimStray(m)
 	if err != nil {
 		ctx.Logger.Error(fmt.Errorf("failed to claim stray: %w", err).Error())
 		return
@@ -137,6 +148,26 @@ func (h *LittleHand) Process(ctx *utils.Context, m *StrayManager) { // process t
 		ctx.Logger.Error(err.Error())
 		return
 	}
+
+	err = h.Database.UpdateMetadata(h.Stray.Cid, h.strayMetadata(chunkSize))
+	if err != nil {
+		ctx.Logger.Error(fmt.Errorf("failed to save metadata of %s: %w", h.Stray.Cid, err).Error())
+	}
+}
+
+// strayMetadata records the terms of the claimed stray, its file is stored
+// with chunkSize.
+func (h *LittleHand) strayMetadata(chunkSize int64) func(meta *archive.ContractMetadata) {
+	return func(meta *archive.ContractMetadata) {
+		meta.Signee = h.Stray.Signee
+		meta.Merkle = h.Stray.Merkle
+		meta.EndBlock = h.Stray.End
+		fileSize, err := strconv.ParseInt(h.Stray.Filesize, 10, 64)
+		if err == nil {
+			meta.FileSize = fileSize
+		}
+		meta.ChunkSize = chunkSize
+	}
 }
 
 func indexPrivKey(key string, index byte) (*cryptotypes.PrivKey, error) {
@@ -56,7 +56,10 @@ func NewStrayManager(
 	}
 	ip := provs.Providers.Address // Our IP address
 
-	archive := archive.NewSingleCellArchive(ctx.Config.BaseConfig.RootDir)
+	archive, err := utils.NewArchive(cmd, ctx.Config.BaseConfig.RootDir)
+	if err != nil {
+		return nil, err
+	}
 
 	return &StrayManager{
 		Address:       addr,
@@ -1,20 +1,49 @@
 package types
 
 const (
-	FlagThreads       = "threads"
-	FlagInterval      = "interval"
-	FlagMaxMisses     = "max-misses"
-	FlagChunkSize     = "chunk-size"
-	FlagStrayInterval = "stray-interval"
-	FlagMessageSize   = "max-msg-size"
-	FlagPort          = "port"
-	FlagGasCap        = "gas-cap"
-	FlagMaxFileSize   = "max-file-size"
-	FlagQueueInterval = "queue-interval"
-	FlagProviderName  = "moniker"
-	FlagSleep         = "sleep"
-	FlagDoReport      = "do-report"
-	FlagPruneFirst    = "prune"
+	FlagThreads             = "threads"
+	FlagInterval            = "interval"
+	FlagMaxMisses           = "max-misses"
+	FlagChunkSize           = "chunk-size"
+	FlagStrayInterval       = "stray-interval"
+	FlagMessageSize         = "max-msg-size"
+	FlagPort                = "port"
+	FlagGasCap              = "gas-cap"
+	FlagMaxFileSize         = "max-file-size"
+	FlagQueueInterval       = "queue-interval"
+	FlagProviderName        = "moniker"
+	FlagSleep               = "sleep"
+	FlagDoReport            = "do-report"
+	FlagPruneFirst          = "prune"
+	FlagRequireSignature    = "require-signature"
+	FlagFullDownload        = "report-full-download"
+	FlagDownloadRate        = "download-rate"
+	FlagClientRate          = "download-rate-per-ip"
+	FlagMaxDownloads        = "max-downloads"
+	FlagMaxClientDownloads  = "max-downloads-per-ip"
+	FlagArchive             = "archive"
+	FlagS3Endpoint          = "s3-endpoint"
+	FlagS3Bucket            = "s3-bucket"
+	FlagS3Region            = "s3-region"
+	FlagS3Prefix            = "s3-prefix"
+	FlagS3AccessKey         = "s3-access-key"
+	FlagS3SecretKeyFile     = "s3-secret-key-file"
+	FlagDisks               = "disks"
+	FlagEncrypt             = "encrypt"
+	FlagEncryptionKey       = "encryption-key"
+	FlagEncryptionKeyStrict = "encryption-key-strict"
+	FlagScrubRate           = "scrub-rate"
+	FlagTreeCacheSize       = "tree-cache-size"
+	FlagIpfsBootstrap       = "ipfs-bootstrap"
+	FlagIpfsSwarmKey        = "ipfs-swarm-key"
+	FlagDBBackend           = "db-backend"
+)
+
+// storage backends for FlagArchive
+const (
+	ArchiveFilesystem  = "filesystem"
+	ArchiveObjectStore = "s3"
+	ArchiveIpfs        = "ipfs"
 )
 
 const (
@@ -30,4 +59,7 @@ const (
 	DefaultQueueInterval = 4
 	DefaultSleep         = 250
 	DefaultDoReport      = true
+	DefaultArchive       = ArchiveFilesystem
+	DefaultScrubRate     = 4096
+	DefaultTreeCacheSize = 256
 )
@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
+	merkletree "github.com/wealdtech/go-merkletree"
 )
 
 const (
@@ -23,6 +24,53 @@ type IndexResponse struct {
 type UploadResponse struct {
 	CID string `json:"cid"`
 	FID string `json:"fid"`
+	// Deduplicated is set if the provider already stored the file
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+// UploadBatchResult is the outcome of a single file of a batch upload
+type UploadBatchResult struct {
+	CID          string `json:"cid,omitempty"`
+	FID          string `json:"fid"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type UploadSessionResponse struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+const (
+	UploadQueued    = "queued"
+	UploadBroadcast = "broadcast"
+	UploadCommitted = "committed"
+	UploadFailed    = "failed"
+)
+
+type UploadStatusResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	CID    string `json:"cid"`
+	FID    string `json:"fid"`
+	TxHash string `json:"tx_hash,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+// ChunkSizeHeader is sent along with downloads, it is the chunk size the
+// merkle tree of the file was built with.
+const ChunkSizeHeader = "X-Chunk-Size"
+
+// ChunkResponse is a chunk of a file with the merkle proof of the chunk
+// against the merkle root of the file's contract.
+type ChunkResponse struct {
+	FID   string            `json:"fid"`
+	Index int64             `json:"index"`
+	Data  []byte            `json:"data"`
+	Proof *merkletree.Proof `json:"proof"`
 }
 
 type ErrorResponse struct {
@@ -45,6 +93,8 @@ type Upload struct {
 	Callback *sync.WaitGroup `json:"callback"`
 	Err      error           `json:"error"`
 	Response *sdk.TxResponse `json:"response"`
+	// OnBroadcast is called by the queue right before the message is broadcast
+	OnBroadcast func() `json:"-"`
 }
 
 type AttestRequest struct {
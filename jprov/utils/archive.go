@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/spf13/cobra"
+)
+
+// EnvS3SecretKey holds the secret key of the object store if it isn't read
+// from a file.
+const EnvS3SecretKey = "AWS_SECRET_ACCESS_KEY"
+
+// ErrKeyOnDataDisk is returned with the strict encryption key flag if the
+// encryption key would be stored on a disk that also holds files, whoever
+// gets the disk could read them. Otherwise it is only logged.
+var ErrKeyOnDataDisk = errors.New("the encryption key must not be on a disk files are stored on")
+
+// NewArchive creates the archive selected with the archive flag of cmd.
+// Files are stored under rootDir unless they are spread over several disks,
+// go to an object store or to ipfs. Everything is encrypted before it is
+// stored if the encrypt flag is set.
+func NewArchive(cmd *cobra.Command, rootDir string) (archive.Archive, error) {
+	a, err := newBackend(cmd, rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt, err := cmd.Flags().GetBool(types.FlagEncrypt)
+	if err != nil || !encrypt {
+		return a, err
+	}
+	keyFile, err := cmd.Flags().GetString(types.FlagEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("--%s is required with --%s", types.FlagEncryptionKey, types.FlagEncrypt)
+	}
+	dataDirs, err := dataDirs(cmd, rootDir)
+	if err != nil {
+		return nil, err
+	}
+	strict, err := cmd.Flags().GetBool(types.FlagEncryptionKeyStrict)
+	if err != nil {
+		return nil, err
+	}
+	err = checkKeyLocation(keyFile, dataDirs)
+	if errors.Is(err, ErrKeyOnDataDisk) && !strict {
+		GetServerContextFromCmd(cmd).Logger.Warn(err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := archive.LoadOrCreateKey(keyFile, GetEncryptionKeyCheckPath(rootDir))
+	if err != nil {
+		return nil, err
+	}
+	return archive.NewEncryptedArchive(a, key)
+}
+
+func newBackend(cmd *cobra.Command, rootDir string) (archive.Archive, error) {
+	backend, err := cmd.Flags().GetString(types.FlagArchive)
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case types.ArchiveFilesystem:
+		disks, err := cmd.Flags().GetStringSlice(types.FlagDisks)
+		if err != nil {
+			return nil, err
+		}
+		if len(disks) == 0 {
+			return archive.NewHybridCellArchive(rootDir), nil
+		}
+		return newMultiDiskArchive(disks, rootDir)
+	case types.ArchiveObjectStore:
+		config, err := objectStoreConfigFromFlags(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return archive.NewObjectStoreArchive(rootDir, config)
+	case types.ArchiveIpfs:
+		return OpenIpfsArchive(cmd)
+	default:
+		return nil, fmt.Errorf("unknown archive %q (must be '%s', '%s' or '%s')", backend, types.ArchiveFilesystem, types.ArchiveObjectStore, types.ArchiveIpfs)
+	}
+}
+
+// dataDirs returns the directories files are stored in on the local disks.
+func dataDirs(cmd *cobra.Command, rootDir string) ([]string, error) {
+	// uploads are staged in rootDir by all archives
+	dirs := []string{rootDir}
+
+	backend, err := cmd.Flags().GetString(types.FlagArchive)
+	if err != nil {
+		return nil, err
+	}
+	switch backend {
+	case types.ArchiveFilesystem:
+		disks, err := cmd.Flags().GetStringSlice(types.FlagDisks)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range disks {
+			config, err := archive.ParseDiskConfig(d)
+			if err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, config.Root)
+		}
+	case types.ArchiveIpfs:
+		config, err := ipfsConfigFromCmd(cmd)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, config.Directory)
+	}
+	return dirs, nil
+}
+
+// checkKeyLocation returns ErrKeyOnDataDisk if keyFile is on the same device
+// as one of dataDirs. The key file doesn't have to exist yet.
+func checkKeyLocation(keyFile string, dataDirs []string) error {
+	keyDevice, err := device(keyFile)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dataDirs {
+		dataDevice, err := device(dir)
+		if err != nil {
+			return err
+		}
+		if keyDevice == dataDevice {
+			return fmt.Errorf("%w: %s is on the same disk as %s", ErrKeyOnDataDisk, keyFile, dir)
+		}
+	}
+	return nil
+}
+
+// device returns the id of the device path is stored on, or the closest
+// existing parent of path would be.
+func device(path string) (uint64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return 0, fmt.Errorf("failed to find the device of %s", path)
+			}
+			return uint64(stat.Dev), nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, os.ErrNotExist) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
+
+var (
+	ipfsArchivesMu sync.Mutex
+	ipfsArchives   = make(map[string]*archive.IpfsArchive)
+)
+
+// OpenIpfsArchive opens the ipfs archive configured in the server context of
+// cmd and its ipfs flags. The database can only be opened once, the archive
+// is shared by everyone who opens the same directory.
+func OpenIpfsArchive(cmd *cobra.Command) (*archive.IpfsArchive, error) {
+	config, err := ipfsConfigFromCmd(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	ipfsArchivesMu.Lock()
+	defer ipfsArchivesMu.Unlock()
+
+	if a, ok := ipfsArchives[config.Directory]; ok {
+		return a, nil
+	}
+
+	peerConfig, err := ipfsPeerConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(config.Directory, os.ModePerm)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create ipfs directory"), err)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(config.Directory))
+	if err != nil {
+		return nil, err
+	}
+	a, err := archive.NewIpfsArchive(db, peerConfig)
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	ipfsArchives[config.Directory] = a
+	return a, nil
+}
+
+func ipfsConfigFromCmd(cmd *cobra.Command) (IpfsConfig, error) {
+	config := GetServerContextFromCmd(cmd).Config.IpfsConfig
+
+	if cmd.Flags().Changed(types.FlagIpfsBootstrap) {
+		peers, err := cmd.Flags().GetStringSlice(types.FlagIpfsBootstrap)
+		if err != nil {
+			return config, err
+		}
+		config.BootstrapPeers = peers
+	}
+
+	if cmd.Flags().Changed(types.FlagIpfsSwarmKey) {
+		swarmKey, err := cmd.Flags().GetString(types.FlagIpfsSwarmKey)
+		if err != nil {
+			return config, err
+		}
+		config.SwarmKeyFile = swarmKey
+	}
+
+	return config, nil
+}
+
+func ipfsPeerConfig(config IpfsConfig) (peerConfig archive.IpfsPeerConfig, err error) {
+	peerConfig.Port = config.Port
+
+	peerConfig.Key, err = archive.LoadOrCreatePeerKey(config.KeyFile)
+	if err != nil {
+		return peerConfig, errors.Join(errors.New("failed to load ipfs peer key"), err)
+	}
+
+	for _, addr := range config.BootstrapPeers {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return peerConfig, fmt.Errorf("invalid bootstrap peer %q: %w", addr, err)
+		}
+		peerConfig.BootstrapPeers = append(peerConfig.BootstrapPeers, *info)
+	}
+
+	if config.SwarmKeyFile != "" {
+		peerConfig.SwarmKey, err = archive.LoadSwarmKey(config.SwarmKeyFile)
+		if err != nil {
+			return peerConfig, err
+		}
+	}
+
+	return peerConfig, nil
+}
+
+// newMultiDiskArchive creates an archive of disks. Files stored in rootDir
+// before --disks was set are still served, rootDir is added as a read-only
+// disk unless it is one of disks.
+func newMultiDiskArchive(disks []string, rootDir string) (*archive.MultiDiskArchive, error) {
+	configs := make([]archive.DiskConfig, 0, len(disks)+1)
+	listed := false
+	for _, d := range disks {
+		config, err := archive.ParseDiskConfig(d)
+		if err != nil {
+			return nil, err
+		}
+		listed = listed || filepath.Clean(config.Root) == filepath.Clean(rootDir)
+		configs = append(configs, config)
+	}
+
+	_, err := os.Stat(filepath.Join(rootDir, "storage"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil && !listed {
+		configs = append(configs, archive.DiskConfig{Root: rootDir, Weight: 1, Mode: archive.DiskReadOnly})
+	}
+	return archive.NewMultiDiskArchive(configs)
+}
+
+func objectStoreConfigFromFlags(cmd *cobra.Command) (config archive.ObjectStoreConfig, err error) {
+	flags := map[string]*string{
+		types.FlagS3Endpoint:  &config.Endpoint,
+		types.FlagS3Bucket:    &config.Bucket,
+		types.FlagS3Region:    &config.Region,
+		types.FlagS3Prefix:    &config.Prefix,
+		types.FlagS3AccessKey: &config.AccessKey,
+	}
+	for flag, value := range flags {
+		*value, err = cmd.Flags().GetString(flag)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	config.SecretKey, err = objectStoreSecretKey(cmd)
+	return config, err
+}
+
+// objectStoreSecretKey reads the secret key from the file given with the
+// secret key flag or from the environment, arguments are visible to every
+// user of the machine.
+func objectStoreSecretKey(cmd *cobra.Command) (string, error) {
+	secretKeyFile, err := cmd.Flags().GetString(types.FlagS3SecretKeyFile)
+	if err != nil {
+		return "", err
+	}
+	if secretKeyFile == "" {
+		return os.Getenv(EnvS3SecretKey), nil
+	}
+
+	data, err := os.ReadFile(secretKeyFile)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to read the object store secret key"), err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
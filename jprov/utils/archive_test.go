@@ -0,0 +1,116 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func archiveCmd(t *testing.T, args ...string) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	cmd.Flags().String(types.FlagArchive, types.DefaultArchive, "")
+	cmd.Flags().StringSlice(types.FlagDisks, nil, "")
+	cmd.Flags().Bool(types.FlagEncrypt, false, "")
+	cmd.Flags().String(types.FlagEncryptionKey, "", "")
+	cmd.Flags().Bool(types.FlagEncryptionKeyStrict, false, "")
+	cmd.Flags().String(types.FlagS3SecretKeyFile, "", "")
+	require.NoError(t, cmd.Flags().Parse(args))
+	return cmd
+}
+
+func TestNewArchiveKeepsHomeStorage(t *testing.T) {
+	require := require.New(t)
+
+	home := t.TempDir()
+	_, err := archive.NewHybridCellArchive(home).WriteFileToDisk(bytes.NewReader([]byte("old")), "jklf1old")
+	require.NoError(err)
+
+	disk := t.TempDir()
+	cmd := archiveCmd(t, "--disks="+disk)
+
+	a, err := utils.NewArchive(cmd, home)
+	require.NoError(err)
+
+	// files stored before --disks was set are still served
+	file, err := a.RetrieveFile("jklf1old")
+	require.NoError(err)
+	data, err := io.ReadAll(file)
+	require.NoError(err)
+	require.NoError(file.Close())
+	require.Equal("old", string(data))
+
+	// new files only go to the listed disks
+	_, err = a.WriteFileToDisk(bytes.NewReader([]byte("new")), "jklf1new")
+	require.NoError(err)
+	require.False(archive.NewHybridCellArchive(disk).FileExist("jklf1new")) // FileExist is true for missing files
+	require.True(archive.NewHybridCellArchive(home).FileExist("jklf1new"))
+}
+
+func TestNewArchiveEncryptionKey(t *testing.T) {
+	home := t.TempDir()
+
+	_, err := utils.NewArchive(archiveCmd(t, "--encrypt"), home)
+	require.ErrorContains(t, err, types.FlagEncryptionKey)
+
+	// a key next to the files doesn't protect them, which is only allowed
+	// without the strict flag
+	keyFile := filepath.Join(t.TempDir(), "storage_key")
+	_, err = utils.NewArchive(archiveCmd(t, "--encrypt", "--encryption-key="+keyFile, "--encryption-key-strict"), home)
+	require.ErrorIs(t, err, utils.ErrKeyOnDataDisk)
+	require.NoFileExists(t, keyFile)
+
+	a, err := utils.NewArchive(archiveCmd(t, "--encrypt", "--encryption-key="+keyFile), home)
+	require.NoError(t, err)
+	require.FileExists(t, keyFile)
+	require.IsType(t, &archive.EncryptedArchive{}, a)
+
+	// the files can't be read with a new key
+	require.NoError(t, os.Remove(keyFile))
+	_, err = utils.NewArchive(archiveCmd(t, "--encrypt", "--encryption-key="+keyFile), home)
+	require.ErrorIs(t, err, archive.ErrEncryptionKeyMissing)
+	require.NoFileExists(t, keyFile)
+
+	home = t.TempDir()
+	other, err := os.MkdirTemp("/dev/shm", "key")
+	if err != nil {
+		t.Skip("no second disk for the key:", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(other) })
+	keyFile = filepath.Join(other, "storage_key")
+	a, err = utils.NewArchive(archiveCmd(t, "--encrypt", "--encryption-key="+keyFile, "--encryption-key-strict"), home)
+	if errors.Is(err, utils.ErrKeyOnDataDisk) {
+		t.Skip("/dev/shm is on the disk of the test files")
+	}
+	require.NoError(t, err)
+	require.FileExists(t, keyFile)
+	require.IsType(t, &archive.EncryptedArchive{}, a)
+}
+
+func TestObjectStoreSecretKey(t *testing.T) {
+	require := require.New(t)
+
+	t.Setenv(utils.EnvS3SecretKey, "from-env")
+	secretKey, err := utils.ObjectStoreSecretKey(archiveCmd(t))
+	require.NoError(err)
+	require.Equal("from-env", secretKey)
+
+	keyFile := filepath.Join(t.TempDir(), "s3_secret")
+	require.NoError(os.WriteFile(keyFile, []byte("from-file\n"), 0o600))
+	secretKey, err = utils.ObjectStoreSecretKey(archiveCmd(t, "--s3-secret-key-file="+keyFile))
+	require.NoError(err)
+	require.Equal("from-file", secretKey)
+
+	_, err = utils.ObjectStoreSecretKey(archiveCmd(t, "--s3-secret-key-file="+keyFile+".missing"))
+	require.ErrorIs(err, os.ErrNotExist)
+}
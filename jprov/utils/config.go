@@ -86,6 +86,7 @@ func DefaultIpfsConfig(home string) IpfsConfig {
 	return IpfsConfig{
 		Directory: filepath.Join(home, "ipfs-storage"),
 		Port:      4005,
+		KeyFile:   filepath.Join(home, "config", "ipfs_key"),
 	}
 }
 
@@ -94,6 +95,15 @@ type IpfsConfig struct {
 	// *this directory is locked so no other process have access.
 	Directory string
 	Port      int
+	// The private key of the peer, created if it does not exist.
+	// The peer ID stays the same as long as the key is kept.
+	KeyFile string
+	// Multiaddrs including the peer ID of the peers to bootstrap from.
+	// The public IPFS bootstrap peers are used if empty, unless SwarmKeyFile is set.
+	BootstrapPeers []string
+	// The pre-shared key of a private swarm in the swarm.key format of go-ipfs.
+	// Leave empty to join the public IPFS network.
+	SwarmKeyFile string
 }
 
 type BaseConfig struct {
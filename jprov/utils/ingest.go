@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
+)
+
+// FileHasher computes the fid and the merkle tree leaves of a file while it is
+// written to it. The results are identical to MakeFID and CreateMerkleTree.
+type FileHasher struct {
+	fid       hash.Hash
+	blockSize int64
+	block     []byte
+	leaves    [][]byte
+	size      int64
+}
+
+var _ io.Writer = &FileHasher{}
+
+func NewFileHasher(blockSize int64) *FileHasher {
+	return &FileHasher{
+		fid:       sha256.New(),
+		blockSize: blockSize,
+		block:     make([]byte, 0, blockSize),
+		leaves:    make([][]byte, 0),
+	}
+}
+
+func (h *FileHasher) Write(p []byte) (n int, err error) {
+	// hash.Hash never returns an error
+	_, _ = h.fid.Write(p)
+
+	n = len(p)
+	h.size += int64(n)
+
+	for len(p) > 0 {
+		space := h.blockSize - int64(len(h.block))
+		if int64(len(p)) < space {
+			h.block = append(h.block, p...)
+			return n, nil
+		}
+
+		h.block = append(h.block, p[:space]...)
+		p = p[space:]
+
+		err = h.flush()
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// flush hashes the buffered block into the next leaf
+func (h *FileHasher) flush() error {
+	leaf := sha256.New()
+	_, err := io.WriteString(leaf, strconv.Itoa(len(h.leaves)))
+	if err != nil {
+		return err
+	}
+
+	_, err = hex.NewEncoder(leaf).Write(h.block)
+	if err != nil {
+		return err
+	}
+
+	h.leaves = append(h.leaves, leaf.Sum(nil))
+	h.block = h.block[:0]
+	return nil
+}
+
+// Size returns the number of bytes written so far.
+func (h *FileHasher) Size() int64 {
+	return h.size
+}
+
+// FID returns the fid of all data written so far.
+func (h *FileHasher) FID() (string, error) {
+	return MakeFid(h.fid.Sum(nil))
+}
+
+// MerkleTree returns the merkle tree of all data written so far.
+// No more data should be written after calling MerkleTree.
+func (h *FileHasher) MerkleTree() (*merkletree.MerkleTree, error) {
+	if len(h.block) > 0 {
+		err := h.flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	leaves := h.leaves
+	// CreateMerkleTree always allocates fileSize/blockSize+1 leaves so files
+	// that end at a block boundary have an empty trailing leaf
+	if h.size%h.blockSize == 0 {
+		leaves = append(leaves, nil)
+	}
+
+	return merkletree.NewUsing(leaves, sha3.New512(), false)
+}
+
+// IngestedFile is a file staged in the archive along with its fid and merkle tree.
+type IngestedFile struct {
+	Fid  string
+	Tree *merkletree.MerkleTree
+	Size int64
+	// ChunkSize is the size of the pieces Tree was built from
+	ChunkSize int64
+
+	archive archive.Archive
+	stage   string
+}
+
+// IngestFile reads data exactly once, staging it in the archive while
+// computing its fid and merkle tree. The file must be committed or discarded.
+func IngestFile(a archive.Archive, data io.Reader, blockSize int64) (*IngestedFile, error) {
+	hasher := NewFileHasher(blockSize)
+
+	stage, written, err := a.StageFile(io.TeeReader(data, hasher))
+	if err != nil {
+		return nil, err
+	}
+
+	ingested := IngestedFile{
+		Size:      written,
+		ChunkSize: blockSize,
+		archive:   a,
+		stage:     stage,
+	}
+
+	ingested.Fid, err = hasher.FID()
+	if err != nil {
+		return nil, errors.Join(err, ingested.Discard())
+	}
+
+	ingested.Tree, err = hasher.MerkleTree()
+	if err != nil {
+		return nil, errors.Join(err, ingested.Discard())
+	}
+
+	return &ingested, nil
+}
+
+// Commit moves the staged file to its fid and writes its merkle tree. The
+// tree is written once the file is in place, archives that spread files over
+// several disks keep it on the disk of the file. A failed Commit can be
+// called again, the file is only moved once.
+func (i *IngestedFile) Commit() error {
+	if len(i.stage) > 0 {
+		err := i.archive.CommitFile(i.stage, i.Fid)
+		if err != nil {
+			return err
+		}
+		i.stage = ""
+	}
+
+	return i.archive.WriteTreeToDisk(i.Fid, i.Tree)
+}
+
+// Stage returns the name the file is staged under in the archive, it is
+// empty once the file was committed or discarded.
+func (i *IngestedFile) Stage() string {
+	return i.stage
+}
+
+// Discard removes the staged file. It is a no-op after Commit.
+func (i *IngestedFile) Discard() error {
+	if len(i.stage) == 0 {
+		return nil
+	}
+
+	err := i.archive.DiscardFile(i.stage)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	i.stage = ""
+	return nil
+}
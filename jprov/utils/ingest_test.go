@@ -0,0 +1,92 @@
+package utils_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileHasherMatchesLegacy(t *testing.T) {
+	var blockSize int64 = 1024
+
+	cases := map[string]int64{
+		"empty":          0,
+		"single_partial": 100,
+		"block_boundary": 3 * blockSize,
+		"trailing_block": 3*blockSize + 7,
+	}
+
+	for name, size := range cases {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, size)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+
+			reader := bytes.NewReader(data)
+			expFid, err := utils.MakeFID(reader, reader)
+			require.NoError(t, err)
+			expTree, err := utils.CreateMerkleTree(blockSize, size, reader, reader)
+			require.NoError(t, err)
+
+			hasher := utils.NewFileHasher(blockSize)
+			// odd write sizes so blocks are split across writes
+			_, err = io.CopyBuffer(hasher, bytes.NewReader(data), make([]byte, 333))
+			require.NoError(t, err)
+
+			fid, err := hasher.FID()
+			require.NoError(t, err)
+			tree, err := hasher.MerkleTree()
+			require.NoError(t, err)
+
+			require.Equal(t, expFid, fid)
+			require.Equal(t, expTree.Root(), tree.Root())
+			require.Equal(t, size, hasher.Size())
+		})
+	}
+}
+
+func TestIngestFile(t *testing.T) {
+	require := require.New(t)
+
+	rootDir := t.TempDir()
+	a := archive.NewSingleCellArchive(rootDir)
+
+	data := []byte("hello, world\n")
+
+	file, err := utils.IngestFile(a, bytes.NewReader(data), 5)
+	require.NoError(err)
+	require.EqualValues(len(data), file.Size)
+
+	// nothing is visible before commit
+	_, err = a.RetrieveFile(file.Fid)
+	require.ErrorIs(err, os.ErrNotExist)
+
+	require.NoError(file.Commit())
+
+	stored, err := os.ReadFile(filepath.Join(rootDir, "storage", file.Fid, file.Fid+".jkl"))
+	require.NoError(err)
+	require.Equal(data, stored)
+
+	tree, err := a.RetrieveTree(file.Fid)
+	require.NoError(err)
+	require.Equal(file.Tree.Root(), tree.Root())
+
+	staged, err := os.ReadDir(filepath.Join(rootDir, "staging"))
+	require.NoError(err)
+	require.Empty(staged)
+
+	discarded, err := utils.IngestFile(a, bytes.NewReader(data), 5)
+	require.NoError(err)
+	require.NoError(discarded.Discard())
+
+	staged, err = os.ReadDir(filepath.Join(rootDir, "staging"))
+	require.NoError(err)
+	require.Empty(staged)
+}
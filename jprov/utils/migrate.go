@@ -205,19 +205,15 @@ func cleanOld(homeDir, fid string) error {
 	return nil
 }
 
-// DiscoverFids reads all directory entry of the storage and returns fids
+// DiscoverFids returns the fids of the flat storage layout, the only one
+// that can still hold legacy files
 func DiscoverFids(homeDir string) (fids []string, err error) {
-	dirs, err := os.ReadDir(GetStorageRootDir(homeDir))
-	if err != nil {
-		return
-	}
-
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			fids = append(fids, dir.Name())
+	err = archive.WalkStorage(homeDir, func(fid string, sharded bool) error {
+		if !sharded {
+			fids = append(fids, fid)
 		}
-	}
-
+		return nil
+	})
 	return
 }
 
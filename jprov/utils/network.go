@@ -2,9 +2,20 @@ package utils
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	merkletree "github.com/wealdtech/go-merkletree"
+	"github.com/wealdtech/go-merkletree/sha3"
 )
 
 func TestDownloadFileFromURL(url string, fid string) (int64, error) {
@@ -29,6 +40,9 @@ func TestDownloadFileFromURL(url string, fid string) (int64, error) {
 	}
 	defer resp.Body.Close()
 
+	if unavailable(resp.StatusCode) {
+		return 0, ErrProviderUnavailable
+	}
 	if resp.StatusCode != 200 {
 		return 0, fmt.Errorf("failed to find file on network")
 	}
@@ -41,3 +55,151 @@ func TestDownloadFileFromURL(url string, fid string) (int64, error) {
 
 	return size, nil
 }
+
+// DownloadFileFromURL downloads fid from the provider at url and ingests it
+// into a. The file is checked against fid but not committed, so the caller
+// can check it further before it is stored. Its merkle tree is built with
+// the chunk size the provider stored it with, or blockSize if the provider
+// doesn't tell.
+func DownloadFileFromURL(a archive.Archive, url string, fid string, blockSize int64) (file *IngestedFile, err error) {
+	cli := http.Client{}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/download/%s", url, fid), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = http.Header{
+		"User-Agent":                {"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/67.0.3396.62 Safari/537.36"},
+		"Upgrade-Insecure-Requests": {"1"},
+		"Accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8"},
+		"Accept-Encoding":           {"gzip, deflate, br"},
+		"Accept-Language":           {"en-US,en;q=0.9"},
+		"Connection":                {"keep-alive"},
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, resp.Body.Close())
+	}()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to find file on network")
+	}
+
+	chunkSize, err := strconv.ParseInt(resp.Header.Get(types.ChunkSizeHeader), 10, 64)
+	if err == nil && chunkSize > 0 {
+		blockSize = chunkSize
+	}
+
+	file, err = IngestFile(a, resp.Body, blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("saveFile: Write To Disk Error: %w", err)
+	}
+
+	if file.Fid != fid {
+		err = fmt.Errorf("downloaded file does not match fid: expected %s, got %s", fid, file.Fid)
+		return nil, errors.Join(err, file.Discard())
+	}
+
+	return file, nil
+}
+
+var (
+	// ErrProbeUnsupported is returned by ProbeFileFromURL for providers that
+	// can't answer a probe, their files have to be downloaded instead.
+	ErrProbeUnsupported = errors.New("provider does not support file probes")
+	// ErrProviderUnavailable is returned when a provider is too busy or
+	// failing to answer, it says nothing about whether the file is stored.
+	ErrProviderUnavailable = errors.New("provider is unavailable")
+)
+
+// unavailable reports whether status means the provider can't answer right
+// now. 501 isn't included, it means the request isn't supported at all.
+func unavailable(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		(status >= 500 && status != http.StatusNotImplemented)
+}
+
+// probes should never take as long as downloading a file
+const probeTimeout = 30 * time.Second
+
+// ProbeFileFromURL checks that the provider at url stores fid without
+// downloading the whole file. The size of the file must match filesize and
+// a chunk must be proven against merkleRoot. pick chooses the index of that
+// chunk out of the number of chunks the provider stored the file in.
+func ProbeFileFromURL(url string, fid string, filesize int64, merkleRoot []byte, pick func(chunks int64) int64) error {
+	cli := http.Client{Timeout: probeTimeout}
+
+	resp, err := cli.Head(fmt.Sprintf("%s/download/%s", url, fid))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed, resp.StatusCode == http.StatusNotImplemented:
+		return ErrProbeUnsupported
+	case unavailable(resp.StatusCode):
+		return ErrProviderUnavailable
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("failed to find file on network")
+	case resp.ContentLength != filesize:
+		return fmt.Errorf("file size %d does not match contract size %d", resp.ContentLength, filesize)
+	case filesize == 0:
+		return nil
+	}
+
+	// the chunk can only be picked from the chunk size the file was stored with
+	chunkSize, err := strconv.ParseInt(resp.Header.Get(types.ChunkSizeHeader), 10, 64)
+	if err != nil || chunkSize <= 0 {
+		return ErrProbeUnsupported
+	}
+	index := pick((filesize + chunkSize - 1) / chunkSize)
+
+	resp, err = cli.Get(fmt.Sprintf("%s/download/%s/chunk/%d", url, fid, index))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound,
+		resp.StatusCode == http.StatusMethodNotAllowed,
+		resp.StatusCode == http.StatusNotImplemented:
+		// the file exists, so the provider doesn't serve chunks
+		return ErrProbeUnsupported
+	case unavailable(resp.StatusCode):
+		return ErrProviderUnavailable
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("failed to get chunk %d: status %d", index, resp.StatusCode)
+	}
+
+	var chunk types.ChunkResponse
+	err = json.NewDecoder(resp.Body).Decode(&chunk)
+	if err != nil {
+		return err
+	}
+
+	if chunk.Index != index || chunk.Proof == nil {
+		return fmt.Errorf("invalid proof for chunk %d", index)
+	}
+
+	leaf := sha256.New()
+	_, err = io.WriteString(leaf, strconv.FormatInt(index, 10)+hex.EncodeToString(chunk.Data))
+	if err != nil {
+		return err
+	}
+
+	valid, err := merkletree.VerifyProofUsing(leaf.Sum(nil), false, chunk.Proof, [][]byte{merkleRoot}, sha3.New512())
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("invalid proof for chunk %d", index)
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package utils_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/JackalLabs/jackal-provider/jprov/archive"
+	"github.com/JackalLabs/jackal-provider/jprov/types"
+	"github.com/JackalLabs/jackal-provider/jprov/utils"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeFileFromURL(t *testing.T) {
+	const blockSize = 10
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	hasher := utils.NewFileHasher(blockSize)
+	_, err := io.Copy(hasher, bytes.NewReader(data))
+	require.NoError(t, err)
+	fid, err := hasher.FID()
+	require.NoError(t, err)
+	tree, err := hasher.MerkleTree()
+	require.NoError(t, err)
+
+	// peer answers like a provider storing data, a status other than 200
+	// is returned instead for HEAD or chunk requests when set
+	peer := func(headStatus, chunkStatus int, chunkSize bool) string {
+		router := httprouter.New()
+		router.HEAD("/download/:file", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			if ps.ByName("file") != fid {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if headStatus != 0 {
+				w.WriteHeader(headStatus)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			if chunkSize {
+				w.Header().Set(types.ChunkSizeHeader, strconv.Itoa(blockSize))
+			}
+		})
+		router.GET("/download/:file/chunk/:index", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			if chunkStatus != 0 {
+				w.WriteHeader(chunkStatus)
+				return
+			}
+			index, err := strconv.ParseInt(ps.ByName("index"), 10, 64)
+			require.NoError(t, err)
+
+			chunk := data[index*blockSize : min((index+1)*blockSize, int64(len(data)))]
+			leaf := sha256.Sum256([]byte(fmt.Sprintf("%d%s", index, hex.EncodeToString(chunk))))
+			proof, err := tree.GenerateProof(leaf[:], 0)
+			require.NoError(t, err)
+
+			require.NoError(t, json.NewEncoder(w).Encode(types.ChunkResponse{
+				FID:   fid,
+				Index: index,
+				Data:  chunk,
+				Proof: proof,
+			}))
+		})
+		server := httptest.NewServer(router)
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+
+	legacy := httprouter.New()
+	legacy.GET("/download/:file", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		_, _ = w.Write(data)
+	})
+	legacyServer := httptest.NewServer(legacy)
+	defer legacyServer.Close()
+
+	cases := map[string]struct {
+		url    string
+		fid    string
+		size   int64
+		root   []byte
+		expErr error
+		fails  bool
+	}{
+		"valid": {
+			size: int64(len(data)),
+			root: tree.Root(),
+		},
+		"wrong_root": {
+			size:  int64(len(data)),
+			root:  make([]byte, 64),
+			fails: true,
+		},
+		"wrong_size": {
+			size:  int64(len(data)) - 1,
+			root:  tree.Root(),
+			fails: true,
+		},
+		"missing_file": {
+			fid:   "jklf1missing",
+			size:  int64(len(data)),
+			root:  tree.Root(),
+			fails: true,
+		},
+		"legacy_provider": {
+			url:    legacyServer.URL,
+			size:   int64(len(data)),
+			root:   tree.Root(),
+			expErr: utils.ErrProbeUnsupported,
+		},
+		"no_chunk_size": {
+			url:    peer(0, 0, false),
+			size:   int64(len(data)),
+			root:   tree.Root(),
+			expErr: utils.ErrProbeUnsupported,
+		},
+		"no_chunk_route": {
+			url:    peer(0, http.StatusNotFound, true),
+			size:   int64(len(data)),
+			root:   tree.Root(),
+			expErr: utils.ErrProbeUnsupported,
+		},
+		"busy": {
+			url:    peer(0, http.StatusTooManyRequests, true),
+			size:   int64(len(data)),
+			root:   tree.Root(),
+			expErr: utils.ErrProviderUnavailable,
+		},
+		"failing_chunk": {
+			url:    peer(0, http.StatusServiceUnavailable, true),
+			size:   int64(len(data)),
+			root:   tree.Root(),
+			expErr: utils.ErrProviderUnavailable,
+		},
+		"failing_head": {
+			url:    peer(http.StatusInternalServerError, 0, true),
+			size:   int64(len(data)),
+			root:   tree.Root(),
+			expErr: utils.ErrProviderUnavailable,
+		},
+		"bad_chunk": {
+			url:   peer(0, http.StatusRequestedRangeNotSatisfiable, true),
+			size:  int64(len(data)),
+			root:  tree.Root(),
+			fails: true,
+		},
+	}
+
+	server := peer(0, 0, true)
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			url := server
+			if len(c.url) > 0 {
+				url = c.url
+			}
+			probed := fid
+			if len(c.fid) > 0 {
+				probed = c.fid
+			}
+
+			// every chunk, including the short last one, can be proven
+			for index := int64(0); index*blockSize < int64(len(data)); index++ {
+				chunks := int64(-1)
+				err := utils.ProbeFileFromURL(url, probed, c.size, c.root, func(n int64) int64 {
+					chunks = n
+					return index
+				})
+				if chunks >= 0 {
+					require.EqualValues(t, (len(data)+blockSize-1)/blockSize, chunks)
+				}
+				switch {
+				case c.expErr != nil:
+					require.ErrorIs(t, err, c.expErr)
+				case c.fails:
+					require.Error(t, err)
+				default:
+					require.NoError(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadFileFromURLChunkSize(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	cases := map[string]struct {
+		header       string
+		expChunkSize int64
+	}{
+		"announced": {header: "10", expChunkSize: 10},
+		"unknown":   {expChunkSize: 1024},
+		"invalid":   {header: "-1", expChunkSize: 1024},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if len(c.header) > 0 {
+					w.Header().Set(types.ChunkSizeHeader, c.header)
+				}
+				_, _ = w.Write(data)
+			}))
+			defer server.Close()
+
+			hasher := utils.NewFileHasher(c.expChunkSize)
+			_, err := hasher.Write(data)
+			require.NoError(err)
+			fid, err := hasher.FID()
+			require.NoError(err)
+			tree, err := hasher.MerkleTree()
+			require.NoError(err)
+
+			file, err := utils.DownloadFileFromURL(archive.NewSingleCellArchive(t.TempDir()), server.URL, fid, 1024)
+			require.NoError(err)
+			require.Equal(c.expChunkSize, file.ChunkSize)
+			require.Equal(tree.Root(), file.Tree.Root())
+			require.NoError(file.Discard())
+		})
+	}
+}
@@ -19,6 +19,15 @@ import (
 //		/ fid2
 //			/ fid2.jkl
 //			/ fid2.tree
+//
+// New files are sharded by the hash of their fid instead, see
+// archive.ShardedPathFactory. The flat directories above are migrated
+// by the provider while it runs.
+//
+//	/ storage
+//		/ ab / cd / fid1
+//			/ fid1.jkl
+//			/ fid1.tree
 
 const (
 	FileKey     = "FILE-"
@@ -37,6 +46,12 @@ func GetStorageRootDir(homeDir string) string {
 	return filepath.Join(homeDir, "storage")
 }
 
+// GetEncryptionKeyCheckPath is the checksum of the encryption key, it is
+// kept with the files so a missing key is noticed.
+func GetEncryptionKeyCheckPath(homeDir string) string {
+	return filepath.Join(homeDir, "encryption_key_check")
+}
+
 func GetContentsFileName(fid string) string {
 	return fid
 }
@@ -78,3 +93,15 @@ func GetDowntimeDBPath(ctx client.Context) string {
 
 	return dataPath
 }
+
+func GetUploadSessionsPath(ctx client.Context) string {
+	dataPath := filepath.Join(ctx.HomeDir, "uploads")
+
+	return dataPath
+}
+
+func GetUploadSignaturesPath(ctx client.Context) string {
+	dataPath := filepath.Join(ctx.HomeDir, "upload_signatures.json")
+
+	return dataPath
+}